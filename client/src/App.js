@@ -78,7 +78,7 @@ function App() {
     else if(section === "hosting")
       newFileInfo = {hash: fileInfo.hash, price: fileInfo.price}
     else if(section === "sharing")
-      newFileInfo = {hash: fileInfo.hash, password: ""}
+      newFileInfo = {hash: fileInfo.hash, label: "", expiry: 0, maxDownloads: 0, encrypted: false}
     else if(section === "explore")
       newFileInfo = fileInfo
     else
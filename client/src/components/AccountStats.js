@@ -13,6 +13,7 @@ const AccountStats = () => {
   const [hostedFiles, setHostedFiles] = useState({ num: 0, size: 0 });
   const [sharedFiles, setSharedFiles] = useState({ num: 0, size: 0 });
   const [savedFiles, setSavedFiles] = useState({ num: 0, size: 0 });
+  const [shareUsage, setShareUsage] = useState({ downloads: 0, accesses: 0, size: 0 });
   const [uploads, setUploads] = useState([]);
   const [downloads, setDownloads] = useState([]);
 
@@ -31,6 +32,7 @@ const AccountStats = () => {
       setHostedFiles({ num: data.hostingNum, size: formatSize(data.hostingSize) });
       setSharedFiles({ num: data.sharingNum, size: formatSize(data.sharingSize) });
       setSavedFiles({ num: data.savedNum, size: formatSize(data.savedSize) });
+      setShareUsage({ downloads: data.shareDownloads, accesses: data.shareAccesses, size: formatSize(data.shareBytes) });
     } catch (error) {
       console.error('Error fetching statistics:', error);
     }
@@ -168,6 +170,16 @@ const AccountStats = () => {
               <span>{savedFiles.size}</span>
             </div>
           </div>
+          <div className="row">
+            <div className="label-value-pair">
+              <label>Share Link Downloads:</label>
+              <span>{shareUsage.downloads} of {shareUsage.accesses} accesses</span>
+            </div>
+            <div className="label-value-pair">
+              <label>Total Size Sent through Share Links:</label>
+              <span>{shareUsage.size}</span>
+            </div>
+          </div>
         </div>
       </div>
 
@@ -27,9 +27,12 @@ export default function ConnectProxy() {
     const saveProxySettings = async () => {
         // TODO: replace the alerts with `setMessage` from `App.js`
         try {
-            await axios.post("http://localhost:3001/updateproxy", {
+            await axios.post("http://localhost:3001/addproxyoffer", {
+                protocol: "socks5",
                 ip: ipAddress,
-                rate: usageRate,
+                port: 8000,
+                rate: parseFloat(usageRate),
+                enabled: true,
             });
             alert("proxy settings saved successfully!");
         } catch (error) {
@@ -53,11 +56,23 @@ export default function ConnectProxy() {
         fetchProxies();
     }, []);
 
+    const withdrawProxyOffers = async () => {
+        try {
+            const response = await axios.get("http://localhost:3001/proxyoffers");
+            for (const offer of response.data) {
+                await axios.post("http://localhost:3001/withdrawproxyoffer", String(offer.id));
+            }
+        } catch (error) {
+            console.error("error withdrawing proxy offers:", error);
+        }
+    };
+
     const handleChange = (event) => {
         setChecked(event.target.checked);
         if (!event.target.checked) {
             setUsageRate(0);
             setIPAddress("");
+            withdrawProxyOffers();
         }
     };
 
@@ -27,25 +27,15 @@ export default function SharePopup({trigger, hash}) {
                  <h2 className="share-title">Share Links</h2>
                  <hr className="clip-hr"/>
                  <div className="copy-holder">
-                     <b data-tooltip-id="local-tooltip"
-                        data-tooltip-content="Share link on the local server"
+                     <b data-tooltip-id="gateway-tooltip"
+                        data-tooltip-content="Share link on the public URL of your gateway"
                         data-tooltip-place="top">
-                          Local Link: 
+                          Link: 
                       </b>
-                     <i>http://localhost:3002/...</i>
+                     <i>{link ? new URL(link).origin : ""}/...</i>
                      <CopyToClipboard text={link}/>                       
                  </div>
-                 <Tooltip id="local-tooltip"/>
-                 <Tooltip id="cloud-tooltip"/>
-                 <div className="copy-holder">
-                     <b data-tooltip-id="cloud-tooltip"
-                        data-tooltip-content="Persistent link on the public Blubberbytes Server"
-                        data-tooltip-place="top">
-                      Cloud Link: 
-                      </b>
-                     <i>http://23.239.12.179:3002/...</i>
-                     <CopyToClipboard text={link.replace("localhost", "23.239.12.179")}/>                               
-                 </div>
+                 <Tooltip id="gateway-tooltip"/>
              </div>
          </>)}
  </Popup>)}
@@ -176,7 +176,7 @@ function FileActions({ currSection, selectedFiles, addFile, removeFiles }) {
         addFile={addFile} />}
       {((currSection !== "sharing" && currSection !== "storing") || selectedFiles.length > 1) && <Host className="grayedout" />}
 
-      {currSection === "sharing" && selectedFiles.length === 1 && <SharePopup trigger={<Share className="icon" />} hash={confirmationInfo[0].hash} password={confirmationInfo[0].password}/>}
+      {currSection === "sharing" && selectedFiles.length === 1 && <SharePopup trigger={<Share className="icon" />} hash={confirmationInfo[0].hash}/>}
       {currSection === "sharing" && selectedFiles.length > 1 && <Share className="grayedout"/>}
       {((currSection === "hosting" || currSection === "storing") && selectedFiles.length === 1) && <ConfirmationPopup trigger={<SharingOriginal className="icon" />}
         action={shareOnClick}
@@ -5,7 +5,7 @@ import (
 )
 
 // Create a new RPC client using websockets.
-func createClient(port string, net string) (*rpcclient.Client, error) {
+func createClient(port string, net string, handlers *rpcclient.NotificationHandlers) (*rpcclient.Client, error) {
 	netParam := net
 	if net == "testnet" {
 		netParam = "testnet3"
@@ -20,7 +20,7 @@ func createClient(port string, net string) (*rpcclient.Client, error) {
 		Params:     netParam,
 	}
 
-	client, err := rpcclient.New(connCfg, nil)
+	client, err := rpcclient.New(connCfg, handlers)
 	if err != nil {
 		return nil, err
 	}
@@ -30,12 +30,25 @@ func createClient(port string, net string) (*rpcclient.Client, error) {
 
 // Create a new RPC client for btcd using websockets.
 func createBtcdClient(net string) (*rpcclient.Client, error) {
-	return createClient("8334", net)
+	client, err := createClient("8334", net, notificationHandlers())
+	if err != nil {
+		return nil, err
+	}
+
+	// Register for block notifications so recorded transactions can be updated. Transactions of the
+	// wallet are notified once its transaction filter is loaded, see WatchTransactions.
+	err = client.NotifyBlocks()
+	if err != nil {
+		ShutdownClient(client)
+		return nil, err
+	}
+
+	return client, nil
 }
 
 // Create a new RPC client for btcwallet using websockets.
 func createBtcwalletClient(net string) (*rpcclient.Client, error) {
-	return createClient("8332", net)
+	return createClient("8332", net, nil)
 }
 
 // Shutdown a client.
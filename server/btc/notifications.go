@@ -0,0 +1,183 @@
+package btc
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"server/database/operations"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// Channel for signaling when btcd connects a new block or accepts a transaction of the wallet
+	walletChanged = make(chan struct{}, 1)
+
+	// Channel for addresses to add to the transaction filter, such as addresses payments are awaited on
+	watchedAddresses = make(chan btcutil.Address, 16)
+
+	// Channel closed and replaced every time a block or transaction is seen
+	walletUpdate      = make(chan struct{})
+	walletUpdateMutex sync.Mutex
+)
+
+// Time the wallet is given to take in a transaction accepted by btcd before it is synced
+const syncDelay = time.Second
+
+// Create the notification handlers used by the btcd client. Only transactions that pass the
+// transaction filter of the wallet are notified, see loadTxFilter.
+func notificationHandlers() *rpcclient.NotificationHandlers {
+	return &rpcclient.NotificationHandlers{
+		OnBlockConnected: func(hash *chainhash.Hash, height int32, t time.Time) {
+			notifyWalletChanged()
+		},
+		OnRelevantTxAccepted: func(transaction []byte) {
+			notifyWalletChanged()
+		},
+	}
+}
+
+// Load the addresses and unspent outputs of the wallet into the transaction filter of btcd, so it
+// notifies the transactions that pay to or spend from the wallet.
+func loadTxFilter(btcd *rpcclient.Client, btcwallet *rpcclient.Client) error {
+	addresses, err := btcwallet.GetAddressesByAccount("default")
+	if err != nil {
+		return fmt.Errorf("error getting wallet addresses: %v", err)
+	}
+
+	unspent, err := btcwallet.ListUnspent()
+	if err != nil {
+		return fmt.Errorf("error listing unspent outputs: %v", err)
+	}
+
+	outPoints := []wire.OutPoint{}
+	for _, output := range unspent {
+		hash, err := chainhash.NewHashFromStr(output.TxID)
+		if err != nil {
+			return err
+		}
+		outPoints = append(outPoints, wire.OutPoint{Hash: *hash, Index: output.Vout})
+	}
+
+	err = btcd.LoadTxFilter(true, addresses, outPoints)
+	if err != nil {
+		return fmt.Errorf("error loading transaction filter: %v", err)
+	}
+
+	return nil
+}
+
+// Add an address to the transaction filter, so payments to it are seen before the next block.
+func watchAddress(address btcutil.Address) {
+	// Addresses that do not fit are added when the filter is reloaded on the next block
+	select {
+	case watchedAddresses <- address:
+	default:
+	}
+}
+
+// Signal a sync of the Transactions table and wake up everything waiting on a wallet update.
+func notifyWalletChanged() {
+	// Drop the signal if a sync is already pending
+	select {
+	case walletChanged <- struct{}{}:
+	default:
+	}
+
+	notifyWalletUpdate()
+}
+
+// Wake up everything waiting on a wallet update.
+func notifyWalletUpdate() {
+	walletUpdateMutex.Lock()
+	defer walletUpdateMutex.Unlock()
+
+	close(walletUpdate)
+	walletUpdate = make(chan struct{})
+}
+
+// Get a channel that is closed on the next wallet update.
+func walletUpdated() <-chan struct{} {
+	walletUpdateMutex.Lock()
+	defer walletUpdateMutex.Unlock()
+
+	return walletUpdate
+}
+
+// Keep the Transactions table in sync with the wallet, recording transactions as soon as they are accepted
+// and updating their confirmations every time a block is connected. The transaction filter is reloaded
+// with every sync, so it follows the addresses and outputs the wallet gained since.
+func WatchTransactions(btcd *rpcclient.Client, btcwallet *rpcclient.Client, db *sql.DB) {
+	err := loadTxFilter(btcd, btcwallet)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = operations.SyncTransactions(btcwallet, db)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for {
+		select {
+		case <-walletChanged:
+			// Changes seen while waiting are synced together
+			time.Sleep(syncDelay)
+
+			err := loadTxFilter(btcd, btcwallet)
+			if err != nil {
+				log.Println(err)
+			}
+
+			err = operations.SyncTransactions(btcwallet, db)
+			if err != nil {
+				log.Println(err)
+			}
+		case address := <-watchedAddresses:
+			err := btcd.LoadTxFilter(false, []btcutil.Address{address}, nil)
+			if err != nil {
+				log.Printf("Error adding address %s to transaction filter: %v", address, err)
+			}
+		}
+	}
+}
+
+// Wait until an address has received at least amount with the given number of confirmations.
+func WaitForPayment(btcwallet *rpcclient.Client, address btcutil.Address, amount float64, confirmations int, timeout time.Duration) error {
+	expected, err := btcutil.NewAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	watchAddress(address)
+
+	deadline := time.After(timeout)
+	for {
+		// Get the channel before checking so no update is missed in between
+		updated := walletUpdated()
+
+		received, err := btcwallet.GetReceivedByAddressMinConf(address, confirmations)
+		if err != nil {
+			return err
+		}
+
+		if received >= expected {
+			log.Printf("Received %v of %v on address %s", received, expected, address)
+			return nil
+		}
+
+		// Check again on the next notification, or periodically in case notifications are missed
+		select {
+		case <-updated:
+		case <-time.After(10 * time.Second):
+		case <-deadline:
+			return fmt.Errorf("payment of %v to address %s not received in time", expected, address)
+		}
+	}
+}
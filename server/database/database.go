@@ -45,24 +45,72 @@ func CreateNewTables(db *sql.DB) error {
 		return fmt.Errorf("failed to set up files tables: %v", err)
 	}
 
+	// Create pricing tables
+	err = SetupPricingTables(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up pricing tables: %v", err)
+	}
+
 	// Create WalletInfo table
 	err = SetupWalletInfoTable(db)
 	if err != nil {
 		return fmt.Errorf("failed to set up WalletInfo table: %v", err)
 	}
 
+	// Create Addresses table
+	err = SetupAddressesTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up Addresses table: %v", err)
+	}
+
+	// Create PaymentSettings table
+	err = SetupPaymentSettingsTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up PaymentSettings table: %v", err)
+	}
+
 	// Create Proxy table
 	err = SetupProxyTable(db)
 	if err != nil {
 		return fmt.Errorf("failed to set up Proxy table: %v", err)
 	}
 
+	// Create ProxyOffers table
+	err = SetupProxyOffersTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up ProxyOffers table: %v", err)
+	}
+
 	// Create ProxyLogs table
 	err = SetupProxyLogsTable(db)
 	if err != nil {
 		return fmt.Errorf("failed to set up ProxyLogs table: %v", err)
 	}
 
+	// Create ProxySessions table
+	err = SetupProxySessionsTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up ProxySessions table: %v", err)
+	}
+
+	// Create ProxyPolicies and ProxyRejections tables
+	err = SetupProxyPolicyTables(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up proxy policy tables: %v", err)
+	}
+
+	// Create ProxyHealth table
+	err = SetupProxyHealthTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up ProxyHealth table: %v", err)
+	}
+
+	// Create Gateway table
+	err = SetupGatewayTable(db)
+	if err != nil {
+		return fmt.Errorf("failed to set up Gateway table: %v", err)
+	}
+
 	// Create IPtoNode table
 	err = SetupIPtoNodeTable(db)
 	if err != nil {
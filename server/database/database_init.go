@@ -5,7 +5,7 @@ import (
 	"fmt"
 )
 
-// SetupFilesTables initializes tables related to file management (storing, hosting, sharing, saved).
+// SetupFilesTables initializes tables related to file management (storing, folder manifests, hosting, sharing, share accesses, saved).
 func SetupFilesTables(db *sql.DB) error {
 	tables := map[string]string{
 		"Storing": `
@@ -25,10 +25,48 @@ func SetupFilesTables(db *sql.DB) error {
 			);`,
 		"Sharing": `
 			CREATE TABLE IF NOT EXISTS Sharing (
-				hash TEXT PRIMARY KEY NOT NULL,
-				password TEXT NOT NULL,
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				hash TEXT NOT NULL,
+				tokenId TEXT UNIQUE NOT NULL,
+				tokenHash TEXT NOT NULL,
+				permissions TEXT NOT NULL DEFAULT 'read',
+				label TEXT NOT NULL DEFAULT '',
+				created INTEGER NOT NULL,
+				expiry INTEGER NOT NULL DEFAULT 0,
+				maxDownloads INTEGER NOT NULL DEFAULT 0,
+				downloads INTEGER NOT NULL DEFAULT 0,
+				revoked BOOLEAN NOT NULL DEFAULT 0,
+				encrypted BOOLEAN NOT NULL DEFAULT 0,
+				content TEXT NOT NULL DEFAULT '',
 				FOREIGN KEY(hash) REFERENCES Storing(hash)
 			);`,
+		"ShareAccesses": `
+			CREATE TABLE IF NOT EXISTS ShareAccesses (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				link INTEGER NOT NULL,
+				tokenID TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				peer TEXT NOT NULL,
+				result TEXT NOT NULL,
+				bytes INTEGER NOT NULL,
+				time INTEGER NOT NULL
+			);`,
+		"Manifests": `
+			CREATE TABLE IF NOT EXISTS Manifests (
+				hash TEXT NOT NULL,
+				root TEXT NOT NULL,
+				data TEXT NOT NULL,
+				PRIMARY KEY(hash, root),
+				FOREIGN KEY(root) REFERENCES Storing(hash)
+			);`,
+		"ManifestFiles": `
+			CREATE TABLE IF NOT EXISTS ManifestFiles (
+				hash TEXT NOT NULL,
+				root TEXT NOT NULL,
+				path TEXT NOT NULL,
+				PRIMARY KEY(hash, root),
+				FOREIGN KEY(root) REFERENCES Storing(hash)
+			);`,
 		"Saved": `
 			CREATE TABLE IF NOT EXISTS Saved (
 				hash TEXT PRIMARY KEY NOT NULL,
@@ -50,6 +88,63 @@ func SetupFilesTables(db *sql.DB) error {
 	return nil
 }
 
+// SetupPricingTables initializes tables related to pricing hosted files (trusted peers, served downloads, quotes and pricing rules).
+func SetupPricingTables(db *sql.DB) error {
+	tables := map[string]string{
+		"TrustedPeers": `
+			CREATE TABLE IF NOT EXISTS TrustedPeers (
+				peer TEXT PRIMARY KEY NOT NULL
+			);`,
+		"HostingDownloads": `
+			CREATE TABLE IF NOT EXISTS HostingDownloads (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				hash TEXT NOT NULL,
+				peer TEXT NOT NULL,
+				time INTEGER NOT NULL
+			);`,
+		"Quotes": `
+			CREATE TABLE IF NOT EXISTS Quotes (
+				nonce TEXT PRIMARY KEY NOT NULL,
+				hash TEXT NOT NULL,
+				peer TEXT NOT NULL,
+				price REAL NOT NULL,
+				address TEXT NOT NULL,
+				expiry INTEGER NOT NULL,
+				used INTEGER NOT NULL
+			);`,
+		"PricingRules": `
+			CREATE TABLE IF NOT EXISTS PricingRules (
+				perMB REAL NOT NULL,
+				peakStart INTEGER NOT NULL,
+				peakEnd INTEGER NOT NULL,
+				peakMultiplier REAL NOT NULL,
+				demandThreshold INTEGER NOT NULL,
+				demandMultiplier REAL NOT NULL,
+				repeatDiscount REAL NOT NULL
+			);`,
+	}
+
+	// Execute each table creation statement
+	for tableName, createStmt := range tables {
+		_, err := db.Exec(createStmt)
+		if err != nil {
+			return fmt.Errorf("error creating %s table: %v", tableName, err)
+		}
+		fmt.Printf("%s table created successfully.\n", tableName)
+	}
+
+	// Default rules leave the hosting price unchanged
+	query := `INSERT INTO PricingRules (perMB, peakStart, peakEnd, peakMultiplier, demandThreshold, demandMultiplier, repeatDiscount)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, 0, 0, 0, 1, 0, 1, 0)
+	if err != nil {
+		return fmt.Errorf("error initializing PricingRules table: %v", err)
+	}
+	fmt.Printf("PricingRules table initialized successfully.\n")
+
+	return nil
+}
+
 // SetupHistoriesTables initializes tables related to histories (uploads, downloads, transactions, proxies).
 func SetupHistoriesTables(db *sql.DB) error {
 	tables := map[string]string{
@@ -74,11 +169,19 @@ func SetupHistoriesTables(db *sql.DB) error {
 			);`,
 		"Transactions": `
 			CREATE TABLE IF NOT EXISTS Transactions (
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				id TEXT NOT NULL,
 				date TEXT NOT NULL,
+				time INTEGER NOT NULL,
 				wallet TEXT NOT NULL,
 				amount REAL NOT NULL,
-				balance REAL NOT NULL
+				category TEXT NOT NULL,
+				fee REAL NOT NULL,
+				confirmations INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				purpose TEXT NOT NULL,
+				reference TEXT NOT NULL,
+				peer TEXT NOT NULL,
+				PRIMARY KEY (id, category)
 			);`,
 		"Proxies": `
 			CREATE TABLE IF NOT EXISTS Proxies (
@@ -125,14 +228,64 @@ func SetupWalletInfoTable(db *sql.DB) error {
 	return nil
 }
 
-// SetupProxyTable initializes the Proxy table with a placeholder row.
+// SetupAddressesTable initializes the Addresses table, which maps receive addresses to what they were issued for.
+func SetupAddressesTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS Addresses (
+			address TEXT PRIMARY KEY NOT NULL,
+			date TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			peer TEXT NOT NULL
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating Addresses table: %v", err)
+	}
+	fmt.Printf("Addresses table created successfully.\n")
+
+	return nil
+}
+
+// SetupPaymentSettingsTable initializes the PaymentSettings table with a default row.
+func SetupPaymentSettingsTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS PaymentSettings (
+			mode TEXT NOT NULL,
+			confirmations INTEGER NOT NULL,
+			timeout INTEGER NOT NULL
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating PaymentSettings table: %v", err)
+	}
+	fmt.Printf("PaymentSettings table created successfully.\n")
+
+	query := `INSERT INTO PaymentSettings (mode, confirmations, timeout) VALUES (?, ?, ?)`
+	_, err = db.Exec(query, "none", 1, 600)
+	if err != nil {
+		return fmt.Errorf("error initializing PaymentSettings table: %v", err)
+	}
+	fmt.Printf("PaymentSettings table initialized successfully.\n")
+
+	return nil
+}
+
+// SetupProxyTable initializes the Proxy table, which holds the settings shared by all proxy offers, with a placeholder row.
 func SetupProxyTable(db *sql.DB) error {
 	createTable :=
 		`CREATE TABLE IF NOT EXISTS Proxy (
-			ip TEXT PRIMARY KEY NOT NULL,
-			rate REAL NOT NULL,
 			node TEXT NOT NULL,
-			wallet TEXT NOT NULL
+			wallet TEXT NOT NULL,
+			clientLimit INTEGER NOT NULL,
+			globalLimit INTEGER NOT NULL,
+			quota INTEGER NOT NULL,
+			quotaPeriod INTEGER NOT NULL,
+			upstream TEXT NOT NULL
 		);`
 
 	// Execute the table creation statement
@@ -142,8 +295,8 @@ func SetupProxyTable(db *sql.DB) error {
 	}
 	fmt.Printf("Proxy table created successfully.\n")
 
-	query := `INSERT INTO Proxy (ip, rate, node, wallet) VALUES (?, ?, ?, ?)`
-	_, err = db.Exec(query, "", 0, "", "")
+	query := `INSERT INTO Proxy (node, wallet, clientLimit, globalLimit, quota, quotaPeriod, upstream) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, "", "", 0, 0, 0, 86400, "")
 	if err != nil {
 		return fmt.Errorf("error initializing Proxy table: %v", err)
 	}
@@ -152,11 +305,69 @@ func SetupProxyTable(db *sql.DB) error {
 	return nil
 }
 
+// SetupGatewayTable initializes the Gateway table with a row serving plain HTTP on the local machine,
+// with limits loose enough for browsing and streaming but not for hammering peers.
+func SetupGatewayTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS Gateway (
+			listen TEXT NOT NULL,
+			baseURL TEXT NOT NULL,
+			certFile TEXT NOT NULL,
+			keyFile TEXT NOT NULL,
+			selfSigned INTEGER NOT NULL,
+			clientLimit INTEGER NOT NULL,
+			tokenLimit INTEGER NOT NULL,
+			maxFetches INTEGER NOT NULL,
+			timeout INTEGER NOT NULL
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating Gateway table: %v", err)
+	}
+	fmt.Printf("Gateway table created successfully.\n")
+
+	query := `INSERT INTO Gateway (listen, baseURL, certFile, keyFile, selfSigned, clientLimit, tokenLimit, maxFetches, timeout) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(query, ":3002", "http://localhost:3002", "", "", false, 120, 300, 64, 30)
+	if err != nil {
+		return fmt.Errorf("error initializing Gateway table: %v", err)
+	}
+	fmt.Printf("Gateway table initialized successfully.\n")
+
+	return nil
+}
+
+func SetupProxyOffersTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS ProxyOffers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			protocol TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			listen TEXT NOT NULL,
+			rate REAL NOT NULL,
+			enabled INTEGER NOT NULL,
+			time INTEGER NOT NULL
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating ProxyOffers table: %v", err)
+	}
+	fmt.Printf("ProxyOffers table created successfully.\n")
+
+	return nil
+}
+
 func SetupProxyLogsTable(db *sql.DB) error {
 	createTable :=
 		`CREATE TABLE IF NOT EXISTS ProxyLogs (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			ip TEXT NOT NULL,
+			identity TEXT NOT NULL,
+			peer TEXT NOT NULL,
 			bytes INTEGER NOT NULL,
 			time INTEGER NOT NULL
 		);`
@@ -171,6 +382,90 @@ func SetupProxyLogsTable(db *sql.DB) error {
 	return nil
 }
 
+func SetupProxySessionsTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS ProxySessions (
+			username TEXT PRIMARY KEY NOT NULL,
+			passwordHash TEXT NOT NULL,
+			peer TEXT NOT NULL,
+			offer INTEGER NOT NULL,
+			rate REAL NOT NULL,
+			time INTEGER NOT NULL
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating ProxySessions table: %v", err)
+	}
+	fmt.Printf("ProxySessions table created successfully.\n")
+
+	return nil
+}
+
+func SetupProxyHealthTable(db *sql.DB) error {
+	createTable :=
+		`CREATE TABLE IF NOT EXISTS ProxyHealth (
+			node TEXT NOT NULL,
+			offer INTEGER NOT NULL,
+			protocol TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			reachable INTEGER NOT NULL DEFAULT 0,
+			latency INTEGER NOT NULL DEFAULT 0,
+			peerThroughput INTEGER NOT NULL DEFAULT 0,
+			checks INTEGER NOT NULL DEFAULT 0,
+			successes INTEGER NOT NULL DEFAULT 0,
+			lastChecked INTEGER NOT NULL DEFAULT 0,
+			lastSuccess INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (node, offer)
+		);`
+
+	// Execute the table creation statement
+	_, err := db.Exec(createTable)
+	if err != nil {
+		return fmt.Errorf("error creating ProxyHealth table: %v", err)
+	}
+	fmt.Printf("ProxyHealth table created successfully.\n")
+
+	return nil
+}
+
+// SetupProxyPolicyTables initializes the ProxyPolicies and ProxyRejections tables.
+func SetupProxyPolicyTables(db *sql.DB) error {
+	tables := map[string]string{
+		"ProxyPolicies": `
+			CREATE TABLE IF NOT EXISTS ProxyPolicies (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				action TEXT NOT NULL,
+				cidr TEXT NOT NULL,
+				ports TEXT NOT NULL,
+				domain TEXT NOT NULL
+			);`,
+		"ProxyRejections": `
+			CREATE TABLE IF NOT EXISTS ProxyRejections (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				identity TEXT NOT NULL,
+				ip TEXT NOT NULL,
+				destination TEXT NOT NULL,
+				port INTEGER NOT NULL,
+				reason TEXT NOT NULL,
+				time INTEGER NOT NULL
+			);`,
+	}
+
+	// Execute each table creation statement
+	for tableName, createStmt := range tables {
+		_, err := db.Exec(createStmt)
+		if err != nil {
+			return fmt.Errorf("error creating %s table: %v", tableName, err)
+		}
+		fmt.Printf("%s table created successfully.\n", tableName)
+	}
+
+	return nil
+}
+
 func SetupIPtoNodeTable(db *sql.DB) error {
 	createTable :=
 		`CREATE TABLE IF NOT EXISTS IPtoNode (
@@ -10,6 +10,44 @@ type Storing struct {
 	Date      string `json:"date"`
 }
 
+// Struct (not a table) for the manifest of a stored folder. It is stored as JSON
+// and addressed by the hash of that JSON, like files are by their content
+type Manifest struct {
+	Name    string          `json:"name"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// Struct (not a table) for a file or subfolder listed in a manifest
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash"` // Hash of the file, or of the manifest of the subfolder
+	Size   int64  `json:"size"`
+	Folder bool   `json:"folder"`
+}
+
+// Struct (not a table) for a hashed folder: the manifests of it and its
+// subfolders, and the paths of its files, by hash
+type FolderTree struct {
+	Hash      string
+	Size      int64
+	Manifests map[string]string
+	Files     map[string]string
+}
+
+// Table for Manifests of stored folders and their subfolders
+type Manifests struct {
+	Hash string `json:"hash"`
+	Root string `json:"root"` // Hash of the stored folder the manifest is part of
+	Data string `json:"data"`
+}
+
+// Table for ManifestFiles, the files inside stored folders
+type ManifestFiles struct {
+	Hash string `json:"hash"`
+	Root string `json:"root"`
+	Path string `json:"path"`
+}
+
 // Table for Hosting
 type Hosting struct {
 	Hash  string  `json:"hash"`
@@ -27,13 +65,87 @@ type JoinedHosting struct {
 	Price     float64 `json:"price"`
 }
 
-// Table for Sharing
+// Table for PricingRules
+type PricingRules struct {
+	PerMB            float64 `json:"perMB"`            // Price added per MB of file size
+	PeakStart        int64   `json:"peakStart"`        // Hour of the day the peak window starts
+	PeakEnd          int64   `json:"peakEnd"`          // Hour of the day the peak window ends
+	PeakMultiplier   float64 `json:"peakMultiplier"`   // Multiplier applied during the peak window
+	DemandThreshold  int64   `json:"demandThreshold"`  // Downloads in the last day that trigger the demand multiplier
+	DemandMultiplier float64 `json:"demandMultiplier"` // Multiplier applied when the file is in demand
+	RepeatDiscount   float64 `json:"repeatDiscount"`   // Fraction taken off for peers that downloaded the file before
+}
+
+// Table for TrustedPeers
+type TrustedPeers struct {
+	Peer string `json:"peer"`
+}
+
+// Table for HostingDownloads
+type HostingDownloads struct {
+	Id   int64  `json:"id"`
+	Hash string `json:"hash"`
+	Peer string `json:"peer"`
+	Time int64  `json:"time"`
+}
+
+// Table for Quotes
+type Quotes struct {
+	Nonce   string  `json:"nonce"`
+	Hash    string  `json:"hash"`
+	Peer    string  `json:"peer"`
+	Price   float64 `json:"price"`
+	Address string  `json:"address"`
+	Expiry  int64   `json:"expiry"`
+	Used    bool    `json:"used"`
+}
+
+// Struct (not a table) for a quote signed by the provider
+type SignedQuote struct {
+	Hash      string  `json:"hash"`
+	Price     float64 `json:"price"`
+	Address   string  `json:"address"`
+	Expiry    int64   `json:"expiry"`
+	Nonce     string  `json:"nonce"`
+	Provider  string  `json:"provider"`
+	Buyer     string  `json:"buyer"`
+	Signature []byte  `json:"signature"`
+}
+
+// Table for Sharing, one row per share link of a stored file
 type Sharing struct {
-	Hash     string `json:"hash"`
-	Password string `json:"password"`
+	ID           int64  `json:"id"`
+	Hash         string `json:"hash"`
+	TokenID      string `json:"tokenId"`
+	TokenHash    string `json:"tokenHash"` // Only the hash of the token is stored
+	Permissions  string `json:"permissions"`
+	Label        string `json:"label"`
+	Created      int64  `json:"created"`
+	Expiry       int64  `json:"expiry"`       // Unix time, 0 for never
+	MaxDownloads int64  `json:"maxDownloads"` // 0 for unlimited
+	Downloads    int64  `json:"downloads"`
+	Revoked      bool   `json:"revoked"`
+	Encrypted    bool   `json:"encrypted"` // The link serves an encrypted copy, its key is only in the link
+	Content      string `json:"content"`   // Hash of the encrypted copy, empty for plain links
+}
+
+// Struct (not a table) for a share link together with its URL
+type SharingLink struct {
+	Sharing
+	Link string `json:"link"`
+}
+
+// Struct (not a table) for the claims of a share link token, signed by the sharing node
+type ShareCapability struct {
+	Issuer      string `json:"iss"`
+	Hash        string `json:"hash"`
+	ID          string `json:"id"`
+	Expiry      int64  `json:"exp"` // Unix time, 0 for never
+	Permissions string `json:"perms"`
+	Content     string `json:"content,omitempty"` // Hash of the encrypted copy an encrypted link serves
 }
 
-// Struct (not a table) for Sharing joined with Storing
+// Struct (not a table) for Sharing joined with Storing, one row per shared file
 type JoinedSharing struct {
 	Hash      string `json:"hash"`
 	Name      string `json:"name"`
@@ -41,7 +153,78 @@ type JoinedSharing struct {
 	Size      int64  `json:"size"`
 	Path      string `json:"path"`
 	Date      string `json:"date"`
-	Password  string `json:"password"`
+	Links     int64  `json:"links"`
+}
+
+// Struct (not a table) for a request to stream a shared or hosted file from a peer that has it
+type ShareRequest struct {
+	Hash    string `json:"hash"`
+	Token   string `json:"token"`   // Empty to fetch a file the peer hosts publicly
+	Range   string `json:"range"`   // HTTP Range header, empty for the whole file
+	Head    bool   `json:"head"`    // Only answer with the response, without content
+	Cached  bool   `json:"cached"`  // The gateway serves the content from its cache, so only authorize the request
+	IfRange string `json:"ifRange"` // HTTP If-Range header, the Range only applies if it matches
+	Path    string `json:"path"`    // Entry inside a shared folder, empty for the shared file or folder itself
+	Archive string `json:"archive"` // "zip" or "tar" to stream the whole folder as an archive
+	Session string `json:"session"` // Session of a download already counted, to fetch more ranges of it
+}
+
+// Struct (not a table) for the answer to a ShareRequest, followed by Length bytes
+// of content, or content up to the end of the stream when Length is -1
+type ShareResponse struct {
+	Result    string  `json:"result"`
+	Hash      string  `json:"hash"`   // Hash of the content sent
+	Folder    bool    `json:"folder"` // The content is the manifest of a folder
+	Name      string  `json:"name"`
+	Extension string  `json:"extension"`
+	Size      int64   `json:"size"`
+	Offset    int64   `json:"offset"`
+	Length    int64   `json:"length"`
+	Partial   bool    `json:"partial"`
+	Price     float64 `json:"price"`   // Asked for a hosted file that is not free
+	Session   string  `json:"session"` // Session the download was counted under, empty when it is not counted
+}
+
+// Table for ShareAccesses, every use of a share link
+type ShareAccesses struct {
+	ID      int64  `json:"id"`
+	Link    int64  `json:"link"`    // 0 when no link matched the token
+	TokenID string `json:"tokenId"` // Empty when no link matched the token
+	Hash    string `json:"hash"`
+	Peer    string `json:"peer"`
+	Result  string `json:"result"`
+	Bytes   int64  `json:"bytes"` // Bytes of content sent to the peer
+	Time    int64  `json:"time"`
+}
+
+// Struct (not a table) for ShareAccessFilter, which accesses of a shared file to list
+type ShareAccessFilter struct {
+	Link   int64  // 0 for every link
+	Peer   string // Empty for every peer
+	Result string // Empty for every result
+	Since  int64  // Unix time, 0 for no bound
+	Until  int64  // Unix time, 0 for no bound
+	Limit  int64  // Newest accesses listed, 0 for all
+}
+
+// Struct (not a table) for ShareLinkUsage, the accesses of one share link added up
+type ShareLinkUsage struct {
+	Link      int64  `json:"link"`
+	TokenID   string `json:"tokenId"`
+	Label     string `json:"label"` // Empty when the link was deleted
+	Accesses  int64  `json:"accesses"`
+	Downloads int64  `json:"downloads"` // Accesses that succeeded
+	Refused   int64  `json:"refused"`   // Accesses that did not
+	Bytes     int64  `json:"bytes"`
+	Peers     int64  `json:"peers"` // Distinct peers
+	First     int64  `json:"first"`
+	Last      int64  `json:"last"`
+}
+
+// Struct (not a table) for ShareAccessReport, the accesses of a shared file and their totals per link
+type ShareAccessReport struct {
+	Accesses []ShareAccesses  `json:"accesses"`
+	Links    []ShareLinkUsage `json:"links"`
 }
 
 // Table for saved files
@@ -0,0 +1,14 @@
+package models
+
+// Table for Gateway, the settings of the HTTP gateway that serves share links
+type Gateway struct {
+	Listen      string `json:"listen"`      // Local address the gateway listens on
+	BaseURL     string `json:"baseUrl"`     // Public URL share links are generated against
+	CertFile    string `json:"certFile"`    // TLS certificate, empty to serve plain HTTP
+	KeyFile     string `json:"keyFile"`     // Key of the TLS certificate
+	SelfSigned  bool   `json:"selfSigned"`  // Serve TLS with generated self-signed certificates, for testing
+	ClientLimit int64  `json:"clientLimit"` // Requests per minute from each client IP, 0 for no limit
+	TokenLimit  int64  `json:"tokenLimit"`  // Requests per minute for each share link, 0 for no limit
+	MaxFetches  int64  `json:"maxFetches"`  // Outstanding fetches from peers, 0 for no limit
+	Timeout     int64  `json:"timeout"`     // Seconds a request is given to find and reach a peer that serves it
+}
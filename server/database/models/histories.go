@@ -21,15 +21,20 @@ type Downloads struct {
 	Price     float64 `json:"price"`
 }
 
-// Struct (not a table) for Transactions
+// Table for Transactions
 type Transactions struct {
 	Id            string  `json:"id"`
 	Date          string  `json:"date"`
+	Time          int64   `json:"time"`
 	Wallet        string  `json:"wallet"`
 	Amount        float64 `json:"amount"`
 	Category      string  `json:"category"`
 	Fee           float64 `json:"fee"`
 	Confirmations int64   `json:"confirmations"`
+	Status        string  `json:"status"`
+	Purpose       string  `json:"purpose"`
+	Reference     string  `json:"reference"`
+	Peer          string  `json:"peer"`
 }
 
 // Put this on hold until proxies are implemented
@@ -1,19 +1,122 @@
 package models
 
-// Table for Proxy
+// Table for Proxy, the settings shared by all proxy offers
 type Proxy struct {
-	IP     string  `json:"ip"`
-	Rate   float64 `json:"rate"`
-	Node   string  `json:"node"`
-	Wallet string  `json:"wallet"`
+	Node        string `json:"node"`
+	Wallet      string `json:"wallet"`
+	ClientLimit int64  `json:"clientLimit"` // Bytes per second for each client, 0 for no limit
+	GlobalLimit int64  `json:"globalLimit"` // Bytes per second for all clients, 0 for no limit
+	Quota       int64  `json:"quota"`       // Bytes for each client per period, 0 for no quota
+	QuotaPeriod int64  `json:"quotaPeriod"` // Seconds
+	Upstream    string `json:"upstream"`    // Peer ID of the proxy egress is routed through, empty to connect directly
+}
+
+// Table for ProxyOffers
+type ProxyOffers struct {
+	Id       int64   `json:"id"`
+	Protocol string  `json:"protocol"` // socks5, http or tunnel
+	IP       string  `json:"ip"`       // Advertised address, empty for tunnel offers
+	Port     int64   `json:"port"`     // 0 for tunnel offers
+	Listen   string  `json:"listen"`   // Local address to listen on, empty for 0.0.0.0 and the advertised port
+	Rate     float64 `json:"rate"`
+	Enabled  bool    `json:"enabled"`
+	Time     int64   `json:"time"`
+}
+
+// Struct (not a table) for a proxy offer as advertised to other peers
+type ProxyInfo struct {
+	Offer    int64   `json:"offer"`
+	Protocol string  `json:"protocol"`
+	IP       string  `json:"ip"`
+	Port     int64   `json:"port"`
+	Rate     float64 `json:"rate"`
+	Node     string  `json:"node"`
+	Wallet   string  `json:"wallet"`
 }
 
 // Table for ProxyLogs
 type ProxyLogs struct {
-	Id    string `json:"id"`
-	IP    string `json:"ip"`
-	Bytes int64  `json:"bytes"`
-	Time  int64  `json:"time"`
+	Id       string `json:"id"`
+	IP       string `json:"ip"`
+	Identity string `json:"identity"`
+	Peer     string `json:"peer"`
+	Bytes    int64  `json:"bytes"`
+	Time     int64  `json:"time"`
+}
+
+// Table for ProxySessions
+type ProxySessions struct {
+	Username     string  `json:"username"`
+	PasswordHash string  `json:"passwordHash"`
+	Peer         string  `json:"peer"`
+	Offer        int64   `json:"offer"` // Offer the session is used over
+	Rate         float64 `json:"rate"`  // Rate of the offer when the session was opened, its traffic is billed at
+	Time         int64   `json:"time"`
+}
+
+// Struct (not a table) for a proxy session with open connections
+type LiveProxySessions struct {
+	IP          string   `json:"ip"`
+	Identity    string   `json:"identity"`
+	Connections int      `json:"connections"`
+	Targets     []string `json:"targets"`
+	Bytes       int64    `json:"bytes"`
+	Since       int64    `json:"since"`
+}
+
+// Struct (not a table) for the credentials of a proxy session
+type ProxyCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Offer    int64  `json:"offer"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"` // Advertised IP and port of the offer, empty for tunnel offers
+}
+
+// Table for ProxyPolicies
+type ProxyPolicies struct {
+	Id     int64  `json:"id"`
+	Action string `json:"action"` // allow or deny
+	CIDR   string `json:"cidr"`   // Empty to match any address
+	Ports  string `json:"ports"`  // Ports and port ranges such as 80,8000-8100, empty to match any port
+	Domain string `json:"domain"` // Domain such as example.com or *.example.com, empty to match any domain
+}
+
+// Table for ProxyRejections
+type ProxyRejections struct {
+	Id          int64  `json:"id"`
+	Identity    string `json:"identity"`
+	IP          string `json:"ip"`
+	Destination string `json:"destination"`
+	Port        int64  `json:"port"`
+	Reason      string `json:"reason"`
+	Time        int64  `json:"time"`
+}
+
+// Table for ProxyHealth
+type ProxyHealth struct {
+	Node           string `json:"node"`
+	Offer          int64  `json:"offer"`
+	Protocol       string `json:"protocol"`
+	IP             string `json:"ip"`
+	Port           int64  `json:"port"`
+	Reachable      bool   `json:"reachable"`      // Whether the advertised address accepted connections in the last check
+	Latency        int64  `json:"latency"`        // Milliseconds, as of the last successful check
+	PeerThroughput int64  `json:"peerThroughput"` // Bytes per second over a libp2p stream to the peer, not through the offer
+	Checks         int64  `json:"checks"`
+	Successes      int64  `json:"successes"`
+	LastChecked    int64  `json:"lastChecked"`
+	LastSuccess    int64  `json:"lastSuccess"`
+}
+
+// Struct (not a table) for a proxy with its measured quality
+type RankedProxies struct {
+	ProxyInfo
+	Reachable      bool    `json:"reachable"`
+	Latency        int64   `json:"latency"`
+	PeerThroughput int64   `json:"peerThroughput"` // Not part of the score, see ProxyHealth
+	Uptime         float64 `json:"uptime"`         // Fraction of checks that succeeded
+	Score          float64 `json:"score"`          // Quality adjusted for the rate, higher is better
 }
 
 // Table for IPtoNode
@@ -24,6 +127,7 @@ type IPtoNode struct {
 
 // Struct (not a table) for ProxyBill
 type ProxyBill struct {
+	Id     string  `json:"id"` // Identifies the bill, so it is not paid twice
 	IP     string  `json:"ip"`
 	Rate   float64 `json:"rate"`
 	Bytes  int64   `json:"bytes"`
@@ -10,4 +10,9 @@ type Statistics struct {
 	SharingSize int64 `json:"sharingSize"`
 	SavedNum    int64 `json:"savedNum"`
 	SavedSize   int64 `json:"savedSize"`
+
+	// Use of share links
+	ShareAccesses  int64 `json:"shareAccesses"`
+	ShareDownloads int64 `json:"shareDownloads"` // Accesses that succeeded
+	ShareBytes     int64 `json:"shareBytes"`     // Bytes sent through share links
 }
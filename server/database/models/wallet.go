@@ -13,3 +13,28 @@ type Wallet struct {
 	CurrentBalance float64 `json:"currentBalance"`
 	PendingBalance float64 `json:"pendingBalance"`
 }
+
+// Table for Addresses
+type Addresses struct {
+	Address   string `json:"address"`
+	Date      string `json:"date"`
+	Purpose   string `json:"purpose"`   // "download" or "proxy"
+	Reference string `json:"reference"` // File hash or proxy bill id
+	Peer      string `json:"peer"`
+}
+
+// Table for PaymentSettings
+type PaymentSettings struct {
+	Mode          string `json:"mode"`          // "none", "pay_first" or "pay_on_delivery"
+	Confirmations int64  `json:"confirmations"` // Confirmations required before content is released
+	Timeout       int64  `json:"timeout"`       // Seconds to wait for a payment
+}
+
+// Struct (not a table) for Invoice
+type Invoice struct {
+	Address       string  `json:"address"`
+	Amount        float64 `json:"amount"`
+	Mode          string  `json:"mode"`
+	Confirmations int64   `json:"confirmations"`
+	Timeout       int64   `json:"timeout"` // Seconds the payment is waited for
+}
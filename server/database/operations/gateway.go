@@ -0,0 +1,47 @@
+package operations
+
+import (
+	"database/sql"
+	"fmt"
+	"server/database/models"
+)
+
+// UpdateGateway updates the only record in the Gateway table.
+func UpdateGateway(db *sql.DB, listen, baseURL, certFile, keyFile string, selfSigned bool) error {
+	query := `UPDATE Gateway SET listen = ?, baseURL = ?, certFile = ?, keyFile = ?, selfSigned = ?`
+	_, err := db.Exec(query, listen, baseURL, certFile, keyFile, selfSigned)
+	if err != nil {
+		return fmt.Errorf("error updating record from Gateway: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in Gateway.\n")
+	return nil
+}
+
+// UpdateGatewayLimits updates the rate limits and timeouts of the only record in the Gateway table.
+func UpdateGatewayLimits(db *sql.DB, clientLimit, tokenLimit, maxFetches, timeout int64) error {
+	query := `UPDATE Gateway SET clientLimit = ?, tokenLimit = ?, maxFetches = ?, timeout = ?`
+	_, err := db.Exec(query, clientLimit, tokenLimit, maxFetches, timeout)
+	if err != nil {
+		return fmt.Errorf("error updating record from Gateway: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in Gateway.\n")
+	return nil
+}
+
+// GetGateway retrieves the only record from the Gateway table.
+func GetGateway(db *sql.DB) (*models.Gateway, error) {
+	var gateway models.Gateway
+	query := `SELECT listen, baseURL, certFile, keyFile, selfSigned, clientLimit, tokenLimit, maxFetches, timeout FROM Gateway`
+	err := db.QueryRow(query).Scan(&gateway.Listen, &gateway.BaseURL, &gateway.CertFile, &gateway.KeyFile, &gateway.SelfSigned,
+		&gateway.ClientLimit, &gateway.TokenLimit, &gateway.MaxFetches, &gateway.Timeout)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in Gateway: %v", err)
+	}
+
+	return &gateway, nil
+}
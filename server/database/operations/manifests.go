@@ -0,0 +1,155 @@
+package operations
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server/database/models"
+)
+
+// Extension a stored folder is recorded with in the Storing table
+const FolderExtension = "folder"
+
+// HashFolder hashes every file under a folder and builds the manifests of the
+// folder and its subfolders. Entries are sorted by name, so the same content
+// always gives the same manifests and hash. Links and special files are skipped.
+func HashFolder(folderPath string) (models.FolderTree, error) {
+	tree := models.FolderTree{Manifests: map[string]string{}, Files: map[string]string{}}
+
+	entry, err := hashFolder(folderPath, filepath.Base(folderPath), &tree)
+	if err != nil {
+		return tree, err
+	}
+
+	tree.Hash = entry.Hash
+	tree.Size = entry.Size
+	return tree, nil
+}
+
+func hashFolder(folderPath, name string, tree *models.FolderTree) (models.ManifestEntry, error) {
+	files, err := os.ReadDir(folderPath)
+	if err != nil {
+		return models.ManifestEntry{}, fmt.Errorf("error reading folder %s: %v", folderPath, err)
+	}
+
+	manifest := models.Manifest{Name: name, Entries: []models.ManifestEntry{}}
+	var size int64
+	for _, file := range files {
+		path := filepath.Join(folderPath, file.Name())
+
+		if file.IsDir() {
+			entry, err := hashFolder(path, file.Name(), tree)
+			if err != nil {
+				return models.ManifestEntry{}, err
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			size += entry.Size
+			continue
+		}
+		if !file.Type().IsRegular() {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			return models.ManifestEntry{}, fmt.Errorf("error reading file %s: %v", path, err)
+		}
+		hash, err := HashFile(path)
+		if err != nil {
+			return models.ManifestEntry{}, err
+		}
+
+		tree.Files[hash] = path
+		manifest.Entries = append(manifest.Entries, models.ManifestEntry{Name: file.Name(), Hash: hash, Size: info.Size()})
+		size += info.Size()
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return models.ManifestEntry{}, fmt.Errorf("error encoding manifest of %s: %v", folderPath, err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	tree.Manifests[hash] = string(data)
+
+	return models.ManifestEntry{Name: name, Hash: hash, Size: size, Folder: true}, nil
+}
+
+// AddManifests inserts the manifests and files of a stored folder into the Manifests and ManifestFiles tables.
+func AddManifests(db *sql.DB, tree models.FolderTree) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error adding records to Manifests: %v", err)
+	}
+	defer tx.Rollback()
+
+	for hash, data := range tree.Manifests {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO Manifests (hash, root, data) VALUES (?, ?, ?)`, hash, tree.Hash, data)
+		if err != nil {
+			return fmt.Errorf("error adding record to Manifests: %v", err)
+		}
+	}
+	for hash, path := range tree.Files {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO ManifestFiles (hash, root, path) VALUES (?, ?, ?)`, hash, tree.Hash, path)
+		if err != nil {
+			return fmt.Errorf("error adding record to ManifestFiles: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error adding records to Manifests: %v", err)
+	}
+
+	fmt.Printf("Records added to Manifests for folder with hash: %s\n", tree.Hash)
+	return nil
+}
+
+// DeleteManifests removes the manifests and files of a stored folder.
+func DeleteManifests(db *sql.DB, root string) error {
+	_, err := db.Exec(`DELETE FROM Manifests WHERE root = ?`, root)
+	if err != nil {
+		return fmt.Errorf("error deleting records from Manifests with root %s: %v", root, err)
+	}
+
+	_, err = db.Exec(`DELETE FROM ManifestFiles WHERE root = ?`, root)
+	if err != nil {
+		return fmt.Errorf("error deleting records from ManifestFiles with root %s: %v", root, err)
+	}
+
+	return nil
+}
+
+// FindManifests retrieves a manifest that is part of a stored folder by its hash.
+func FindManifests(db *sql.DB, root, hash string) (*models.Manifests, error) {
+	var manifest models.Manifests
+	query := `SELECT hash, root, data FROM Manifests WHERE root = ? AND hash = ?`
+	err := db.QueryRow(query, root, hash).Scan(&manifest.Hash, &manifest.Root, &manifest.Data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in Manifests with hash %s: %v", hash, err)
+	}
+
+	return &manifest, nil
+}
+
+// FindManifestFiles retrieves a file that is part of a stored folder by its hash.
+func FindManifestFiles(db *sql.DB, root, hash string) (*models.ManifestFiles, error) {
+	var file models.ManifestFiles
+	query := `SELECT hash, root, path FROM ManifestFiles WHERE root = ? AND hash = ?`
+	err := db.QueryRow(query, root, hash).Scan(&file.Hash, &file.Root, &file.Path)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in ManifestFiles with hash %s: %v", hash, err)
+	}
+
+	return &file, nil
+}
@@ -0,0 +1,223 @@
+package operations
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"server/database/models"
+	"time"
+)
+
+// RoundToSatoshi rounds an amount in BTC to whole satoshis, the way btcutil.NewAmount does, so the payer
+// and the payee of a price compare the same amount.
+func RoundToSatoshi(amount float64) float64 {
+	return math.Round(amount*1e8) / 1e8
+}
+
+// UpdatePricingRules updates the only record in the PricingRules table.
+func UpdatePricingRules(db *sql.DB, rules models.PricingRules) error {
+	query := `UPDATE PricingRules SET perMB = ?, peakStart = ?, peakEnd = ?, peakMultiplier = ?, demandThreshold = ?, demandMultiplier = ?, repeatDiscount = ?`
+	_, err := db.Exec(query, rules.PerMB, rules.PeakStart, rules.PeakEnd, rules.PeakMultiplier, rules.DemandThreshold, rules.DemandMultiplier, rules.RepeatDiscount)
+	if err != nil {
+		return fmt.Errorf("error updating record from PricingRules: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in PricingRules.\n")
+	return nil
+}
+
+// GetPricingRules retrieves the only record from the PricingRules table.
+func GetPricingRules(db *sql.DB) (*models.PricingRules, error) {
+	var rules models.PricingRules
+	query := `SELECT perMB, peakStart, peakEnd, peakMultiplier, demandThreshold, demandMultiplier, repeatDiscount FROM PricingRules`
+	err := db.QueryRow(query).Scan(&rules.PerMB, &rules.PeakStart, &rules.PeakEnd, &rules.PeakMultiplier, &rules.DemandThreshold, &rules.DemandMultiplier, &rules.RepeatDiscount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in PricingRules: %v", err)
+	}
+
+	return &rules, nil
+}
+
+// AddTrustedPeers inserts a new record into the TrustedPeers table.
+func AddTrustedPeers(db *sql.DB, peer string) error {
+	query := `INSERT OR IGNORE INTO TrustedPeers (peer) VALUES (?)`
+	_, err := db.Exec(query, peer)
+	if err != nil {
+		return fmt.Errorf("error adding record to TrustedPeers: %v", err)
+	}
+
+	fmt.Printf("Record added to TrustedPeers with peer: %s\n", peer)
+	return nil
+}
+
+// DeleteTrustedPeers removes a record from the TrustedPeers table by its peer.
+func DeleteTrustedPeers(db *sql.DB, peer string) error {
+	query := `DELETE FROM TrustedPeers WHERE peer = ?`
+	_, err := db.Exec(query, peer)
+	if err != nil {
+		return fmt.Errorf("error deleting record from TrustedPeers with peer %s: %v", peer, err)
+	}
+
+	fmt.Printf("Record with peer %s deleted successfully from TrustedPeers.\n", peer)
+	return nil
+}
+
+// GetAllTrustedPeers retrieves all records from the TrustedPeers table.
+func GetAllTrustedPeers(db *sql.DB) ([]models.TrustedPeers, error) {
+	query := `SELECT peer FROM TrustedPeers`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying TrustedPeers table: %v", err)
+	}
+	defer rows.Close()
+
+	trustedPeersRecords := []models.TrustedPeers{}
+	for rows.Next() {
+		var record models.TrustedPeers
+		err := rows.Scan(&record.Peer)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning TrustedPeers record: %v", err)
+		}
+		trustedPeersRecords = append(trustedPeersRecords, record)
+	}
+
+	return trustedPeersRecords, nil
+}
+
+// AddHostingDownloads records that a hosted file was downloaded by a peer.
+func AddHostingDownloads(db *sql.DB, hash, peer string) error {
+	query := `INSERT INTO HostingDownloads (hash, peer, time) VALUES (?, ?, ?)`
+	_, err := db.Exec(query, hash, peer, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error adding record to HostingDownloads: %v", err)
+	}
+
+	fmt.Printf("Record added to HostingDownloads with hash: %s\n", hash)
+	return nil
+}
+
+// AddQuotes inserts a new record into the Quotes table.
+func AddQuotes(db *sql.DB, nonce, hash, peer, address string, price float64, expiry int64) error {
+	query := `INSERT INTO Quotes (nonce, hash, peer, price, address, expiry, used) VALUES (?, ?, ?, ?, ?, ?, 0)`
+	_, err := db.Exec(query, nonce, hash, peer, price, address, expiry)
+	if err != nil {
+		return fmt.Errorf("error adding record to Quotes: %v", err)
+	}
+
+	fmt.Printf("Record added to Quotes with hash: %s\n", hash)
+	return nil
+}
+
+// FindOpenQuotes retrieves the unused quote of a peer for a hash that expires last, provided it expires
+// no earlier than the given time. It returns nil if there is no such quote.
+func FindOpenQuotes(db *sql.DB, hash, peer string, until time.Time) (*models.Quotes, error) {
+	var quote models.Quotes
+	query := `SELECT nonce, hash, peer, price, address, expiry, used FROM Quotes
+	          WHERE hash = ? AND peer = ? AND expiry >= ? AND used = 0 ORDER BY expiry DESC LIMIT 1`
+	err := db.QueryRow(query, hash, peer, until.Unix()).Scan(&quote.Nonce, &quote.Hash, &quote.Peer, &quote.Price, &quote.Address, &quote.Expiry, &quote.Used)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in Quotes with hash %s: %v", hash, err)
+	}
+
+	return &quote, nil
+}
+
+// UseQuotes marks a quote as used and returns it, provided it matches the hash and peer, has not expired and has not been used.
+// It returns nil if there is no such quote.
+func UseQuotes(db *sql.DB, nonce, hash, peer string, now time.Time) (*models.Quotes, error) {
+	query := `UPDATE Quotes SET used = 1 WHERE nonce = ? AND hash = ? AND peer = ? AND expiry >= ? AND used = 0`
+	result, err := db.Exec(query, nonce, hash, peer, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error updating record in Quotes with nonce %s: %v", nonce, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error updating record in Quotes with nonce %s: %v", nonce, err)
+	}
+	if updated == 0 {
+		return nil, nil // No valid quote found
+	}
+
+	var quote models.Quotes
+	query = `SELECT nonce, hash, peer, price, address, expiry, used FROM Quotes WHERE nonce = ?`
+	err = db.QueryRow(query, nonce).Scan(&quote.Nonce, &quote.Hash, &quote.Peer, &quote.Price, &quote.Address, &quote.Expiry, &quote.Used)
+	if err != nil {
+		return nil, fmt.Errorf("error finding record in Quotes with nonce %s: %v", nonce, err)
+	}
+
+	return &quote, nil
+}
+
+// inPeakWindow checks whether an hour falls in the peak window, which may wrap around midnight.
+func inPeakWindow(hour, start, end int64) bool {
+	if start == end {
+		return false
+	} else if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+// CalcPrice calculates the effective price of a hosted file for a peer at the given time.
+func CalcPrice(db *sql.DB, hosting models.JoinedHosting, peer string, now time.Time) (float64, error) {
+	// Trusted peers download for free
+	var trusted int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM TrustedPeers WHERE peer = ?`, peer).Scan(&trusted)
+	if err != nil {
+		return 0, fmt.Errorf("error counting rows in TrustedPeers table: %v", err)
+	}
+	if trusted > 0 {
+		return 0, nil
+	}
+
+	rules, err := GetPricingRules(db)
+	if err != nil {
+		return 0, err
+	}
+
+	price := hosting.Price
+	if rules == nil {
+		return RoundToSatoshi(price), nil
+	}
+
+	// Per-size pricing
+	price += rules.PerMB * float64(hosting.Size) / 1e6
+
+	// Time-of-day multiplier
+	if inPeakWindow(int64(now.Local().Hour()), rules.PeakStart, rules.PeakEnd) {
+		price *= rules.PeakMultiplier
+	}
+
+	// Demand multiplier based on downloads in the last day
+	if rules.DemandThreshold > 0 {
+		var recent int64
+		err = db.QueryRow(`SELECT COUNT(*) FROM HostingDownloads WHERE hash = ? AND time >= ?`, hosting.Hash, now.Add(-24*time.Hour).Unix()).Scan(&recent)
+		if err != nil {
+			return 0, fmt.Errorf("error counting rows in HostingDownloads table: %v", err)
+		}
+		if recent >= rules.DemandThreshold {
+			price *= rules.DemandMultiplier
+		}
+	}
+
+	// Discount for peers that downloaded the file before
+	if rules.RepeatDiscount > 0 {
+		var previous int64
+		err = db.QueryRow(`SELECT COUNT(*) FROM HostingDownloads WHERE hash = ? AND peer = ?`, hosting.Hash, peer).Scan(&previous)
+		if err != nil {
+			return 0, fmt.Errorf("error counting rows in HostingDownloads table: %v", err)
+		}
+		if previous > 0 {
+			price *= 1 - rules.RepeatDiscount
+		}
+	}
+
+	return RoundToSatoshi(price), nil
+}
@@ -4,12 +4,37 @@ import (
 	"database/sql"
 	"fmt"
 	"server/database/models"
+	"time"
 )
 
-// UpdateProxy updates the only record in the Proxy table.
-func UpdateProxy(db *sql.DB, ip string, rate float64, node string, wallet string) error {
-	query := `UPDATE Proxy SET ip = ?, rate = ?, node = ?, wallet = ?`
-	_, err := db.Exec(query, ip, rate, node, wallet)
+// UpdateProxy updates the node and wallet in the only record in the Proxy table.
+func UpdateProxy(db *sql.DB, node string, wallet string) error {
+	query := `UPDATE Proxy SET node = ?, wallet = ?`
+	_, err := db.Exec(query, node, wallet)
+	if err != nil {
+		return fmt.Errorf("error updating record from Proxy: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in Proxy.\n")
+	return nil
+}
+
+// UpdateProxyLimits updates the rate limits and quota of the only record in the Proxy table.
+func UpdateProxyLimits(db *sql.DB, clientLimit, globalLimit, quota, quotaPeriod int64) error {
+	query := `UPDATE Proxy SET clientLimit = ?, globalLimit = ?, quota = ?, quotaPeriod = ?`
+	_, err := db.Exec(query, clientLimit, globalLimit, quota, quotaPeriod)
+	if err != nil {
+		return fmt.Errorf("error updating record from Proxy: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in Proxy.\n")
+	return nil
+}
+
+// UpdateProxyUpstream updates the upstream proxy in the only record in the Proxy table.
+func UpdateProxyUpstream(db *sql.DB, upstream string) error {
+	query := `UPDATE Proxy SET upstream = ?`
+	_, err := db.Exec(query, upstream)
 	if err != nil {
 		return fmt.Errorf("error updating record from Proxy: %v", err)
 	}
@@ -21,8 +46,9 @@ func UpdateProxy(db *sql.DB, ip string, rate float64, node string, wallet string
 // GetProxy retrieves the only record from the Proxy table.
 func GetProxy(db *sql.DB) (*models.Proxy, error) {
 	var proxy models.Proxy
-	query := `SELECT ip, rate, node, wallet FROM Proxy`
-	err := db.QueryRow(query).Scan(&proxy.IP, &proxy.Rate, &proxy.Node, &proxy.Wallet)
+	query := `SELECT node, wallet, clientLimit, globalLimit, quota, quotaPeriod, upstream FROM Proxy`
+	err := db.QueryRow(query).Scan(&proxy.Node, &proxy.Wallet,
+		&proxy.ClientLimit, &proxy.GlobalLimit, &proxy.Quota, &proxy.QuotaPeriod, &proxy.Upstream)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No record found
@@ -33,10 +59,111 @@ func GetProxy(db *sql.DB) (*models.Proxy, error) {
 	return &proxy, nil
 }
 
+// AddProxyOffers inserts a new record into the ProxyOffers table.
+func AddProxyOffers(db *sql.DB, protocol, ip string, port int64, listen string, rate float64, enabled bool) error {
+	query := `INSERT INTO ProxyOffers (protocol, ip, port, listen, rate, enabled, time) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, protocol, ip, port, listen, rate, enabled, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error adding record to ProxyOffers: %v", err)
+	}
+
+	fmt.Printf("Record added to ProxyOffers\n")
+	return nil
+}
+
+// UpdateProxyOffers updates a record in the ProxyOffers table by its id.
+func UpdateProxyOffers(db *sql.DB, id int64, protocol, ip string, port int64, listen string, rate float64, enabled bool) error {
+	query := `UPDATE ProxyOffers SET protocol = ?, ip = ?, port = ?, listen = ?, rate = ?, enabled = ? WHERE id = ?`
+	result, err := db.Exec(query, protocol, ip, port, listen, rate, enabled, id)
+	if err != nil {
+		return fmt.Errorf("error updating record from ProxyOffers with id %d: %v", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking update result for ProxyOffers with id %d: %v", id, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no record found in ProxyOffers with id %d", id)
+	}
+
+	fmt.Printf("Record with id %d updated successfully in ProxyOffers.\n", id)
+	return nil
+}
+
+// EnableProxyOffers enables or disables every record in the ProxyOffers table.
+func EnableProxyOffers(db *sql.DB, enabled bool) error {
+	query := `UPDATE ProxyOffers SET enabled = ?`
+	_, err := db.Exec(query, enabled)
+	if err != nil {
+		return fmt.Errorf("error updating records from ProxyOffers: %v", err)
+	}
+
+	fmt.Printf("Records updated successfully in ProxyOffers.\n")
+	return nil
+}
+
+// DeleteProxyOffers removes a record from the ProxyOffers table by its id.
+func DeleteProxyOffers(db *sql.DB, id int64) error {
+	query := `DELETE FROM ProxyOffers WHERE id = ?`
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("error deleting record from ProxyOffers with id %d: %v", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking delete result for ProxyOffers with id %d: %v", id, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no record found in ProxyOffers with id %d", id)
+	}
+
+	fmt.Printf("Record with id %d deleted successfully from ProxyOffers.\n", id)
+	return nil
+}
+
+// FindProxyOffers retrieves a record from the ProxyOffers table by its id.
+func FindProxyOffers(db *sql.DB, id int64) (*models.ProxyOffers, error) {
+	var offer models.ProxyOffers
+	query := `SELECT id, protocol, ip, port, listen, rate, enabled, time FROM ProxyOffers WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&offer.Id, &offer.Protocol, &offer.IP, &offer.Port, &offer.Listen, &offer.Rate, &offer.Enabled, &offer.Time)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in ProxyOffers with id %d: %v", id, err)
+	}
+
+	return &offer, nil
+}
+
+// GetAllProxyOffers retrieves all records from the ProxyOffers table.
+func GetAllProxyOffers(db *sql.DB) ([]models.ProxyOffers, error) {
+	query := `SELECT id, protocol, ip, port, listen, rate, enabled, time FROM ProxyOffers ORDER BY id`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ProxyOffers table: %v", err)
+	}
+	defer rows.Close()
+
+	proxyOffersRecords := []models.ProxyOffers{}
+	for rows.Next() {
+		var record models.ProxyOffers
+		err := rows.Scan(&record.Id, &record.Protocol, &record.IP, &record.Port, &record.Listen, &record.Rate, &record.Enabled, &record.Time)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ProxyOffers record: %v", err)
+		}
+		proxyOffersRecords = append(proxyOffersRecords, record)
+	}
+
+	return proxyOffersRecords, nil
+}
+
 // AddProxyLogs inserts a new record into the ProxyLogs table.
-func AddProxyLogs(db *sql.DB, ip string, bytes, time int64) error {
-	query := `INSERT INTO ProxyLogs (ip, bytes, time) VALUES (?, ?, ?)`
-	_, err := db.Exec(query, ip, bytes, time)
+func AddProxyLogs(db *sql.DB, ip, identity, peer string, bytes, time int64) error {
+	query := `INSERT INTO ProxyLogs (ip, identity, peer, bytes, time) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, ip, identity, peer, bytes, time)
 	if err != nil {
 		return fmt.Errorf("error adding record to ProxyLogs: %v", err)
 	}
@@ -45,8 +172,20 @@ func AddProxyLogs(db *sql.DB, ip string, bytes, time int64) error {
 	return nil
 }
 
+// GetProxyUsage sums the bytes logged in the ProxyLogs table for a peer since the given time.
+func GetProxyUsage(db *sql.DB, peer string, since int64) (int64, error) {
+	var bytes int64
+	query := `SELECT COALESCE(SUM(bytes), 0) FROM ProxyLogs WHERE peer = ? AND time >= ?`
+	err := db.QueryRow(query, peer, since).Scan(&bytes)
+	if err != nil {
+		return 0, fmt.Errorf("error summing bytes in ProxyLogs table: %v", err)
+	}
+
+	return bytes, nil
+}
+
 func GetProxyLogs(db *sql.DB) ([]models.ProxyLogs, error) {
-	query := `SELECT id, ip, bytes, time FROM ProxyLogs`
+	query := `SELECT id, ip, identity, peer, bytes, time FROM ProxyLogs`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("error querying ProxyLogs table: %v", err)
@@ -56,7 +195,7 @@ func GetProxyLogs(db *sql.DB) ([]models.ProxyLogs, error) {
 	proxyLogsRecords := []models.ProxyLogs{}
 	for rows.Next() {
 		var record models.ProxyLogs
-		err := rows.Scan(&record.Id, &record.IP, &record.Bytes, &record.Time)
+		err := rows.Scan(&record.Id, &record.IP, &record.Identity, &record.Peer, &record.Bytes, &record.Time)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning ProxyLogs record: %v", err)
 		}
@@ -66,6 +205,33 @@ func GetProxyLogs(db *sql.DB) ([]models.ProxyLogs, error) {
 	return proxyLogsRecords, nil
 }
 
+// AddProxySessions inserts a new record into the ProxySessions table.
+func AddProxySessions(db *sql.DB, username, passwordHash, peer string, offer int64, rate float64) error {
+	query := `INSERT INTO ProxySessions (username, passwordHash, peer, offer, rate, time) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, username, passwordHash, peer, offer, rate, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error adding record to ProxySessions: %v", err)
+	}
+
+	fmt.Printf("Record added to ProxySessions with username: %s\n", username)
+	return nil
+}
+
+// FindProxySessions retrieves a record from the ProxySessions table by its username.
+func FindProxySessions(db *sql.DB, username string) (*models.ProxySessions, error) {
+	var session models.ProxySessions
+	query := `SELECT username, passwordHash, peer, offer, rate, time FROM ProxySessions WHERE username = ?`
+	err := db.QueryRow(query, username).Scan(&session.Username, &session.PasswordHash, &session.Peer, &session.Offer, &session.Rate, &session.Time)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in ProxySessions with username %s: %v", username, err)
+	}
+
+	return &session, nil
+}
+
 func AddIPtoNode(db *sql.DB, ip, node string) error {
 	query := `INSERT INTO IPtoNode (ip, node) VALUES (?, ?)`
 	_, err := db.Exec(query, ip, node)
@@ -80,3 +246,149 @@ func AddIPtoNode(db *sql.DB, ip, node string) error {
 // func CalcProxyBill(db *sql.DB) error {
 // 	query := `SELECT SUM(bytes) FROM `
 // }
+
+// AddProxyPolicies inserts a new record into the ProxyPolicies table.
+func AddProxyPolicies(db *sql.DB, action, cidr, ports, domain string) error {
+	query := `INSERT INTO ProxyPolicies (action, cidr, ports, domain) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(query, action, cidr, ports, domain)
+	if err != nil {
+		return fmt.Errorf("error adding record to ProxyPolicies: %v", err)
+	}
+
+	fmt.Printf("Record added to ProxyPolicies\n")
+	return nil
+}
+
+// DeleteProxyPolicies removes a record from the ProxyPolicies table by its id.
+func DeleteProxyPolicies(db *sql.DB, id int64) error {
+	query := `DELETE FROM ProxyPolicies WHERE id = ?`
+	_, err := db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("error deleting record from ProxyPolicies with id %d: %v", id, err)
+	}
+
+	fmt.Printf("Record with id %d deleted successfully from ProxyPolicies.\n", id)
+	return nil
+}
+
+// GetAllProxyPolicies retrieves all records from the ProxyPolicies table.
+func GetAllProxyPolicies(db *sql.DB) ([]models.ProxyPolicies, error) {
+	query := `SELECT id, action, cidr, ports, domain FROM ProxyPolicies`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ProxyPolicies table: %v", err)
+	}
+	defer rows.Close()
+
+	proxyPoliciesRecords := []models.ProxyPolicies{}
+	for rows.Next() {
+		var record models.ProxyPolicies
+		err := rows.Scan(&record.Id, &record.Action, &record.CIDR, &record.Ports, &record.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ProxyPolicies record: %v", err)
+		}
+		proxyPoliciesRecords = append(proxyPoliciesRecords, record)
+	}
+
+	return proxyPoliciesRecords, nil
+}
+
+// AddProxyRejections inserts a new record into the ProxyRejections table.
+func AddProxyRejections(db *sql.DB, identity, ip, destination string, port int64, reason string) error {
+	query := `INSERT INTO ProxyRejections (identity, ip, destination, port, reason, time) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, identity, ip, destination, port, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error adding record to ProxyRejections: %v", err)
+	}
+
+	fmt.Printf("Record added to ProxyRejections\n")
+	return nil
+}
+
+// GetProxyRejections retrieves all records from the ProxyRejections table, most recent first.
+func GetProxyRejections(db *sql.DB) ([]models.ProxyRejections, error) {
+	query := `SELECT id, identity, ip, destination, port, reason, time FROM ProxyRejections ORDER BY time DESC`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ProxyRejections table: %v", err)
+	}
+	defer rows.Close()
+
+	proxyRejectionsRecords := []models.ProxyRejections{}
+	for rows.Next() {
+		var record models.ProxyRejections
+		err := rows.Scan(&record.Id, &record.Identity, &record.IP, &record.Destination, &record.Port, &record.Reason, &record.Time)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ProxyRejections record: %v", err)
+		}
+		proxyRejectionsRecords = append(proxyRejectionsRecords, record)
+	}
+
+	return proxyRejectionsRecords, nil
+}
+
+// UpdateProxyHealth records the result of a check of a proxy in the ProxyHealth table.
+// The latency and peer throughput are only updated by successful checks.
+func UpdateProxyHealth(db *sql.DB, node string, offer int64, protocol, ip string, port int64, success, reachable bool, latency, peerThroughput int64) error {
+	now := time.Now().Unix()
+	successes, lastSuccess := int64(0), int64(0)
+	if success {
+		successes, lastSuccess = 1, now
+	}
+
+	query := `INSERT INTO ProxyHealth (node, offer, protocol, ip, port, reachable, latency, peerThroughput, checks, successes, lastChecked, lastSuccess)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?)
+	          ON CONFLICT(node, offer) DO UPDATE SET protocol = excluded.protocol, ip = excluded.ip, port = excluded.port, reachable = excluded.reachable,
+	          latency = CASE WHEN excluded.successes > 0 THEN excluded.latency ELSE latency END,
+	          peerThroughput = CASE WHEN excluded.successes > 0 THEN excluded.peerThroughput ELSE peerThroughput END,
+	          checks = checks + 1, successes = successes + excluded.successes, lastChecked = excluded.lastChecked,
+	          lastSuccess = CASE WHEN excluded.successes > 0 THEN excluded.lastSuccess ELSE lastSuccess END`
+	_, err := db.Exec(query, node, offer, protocol, ip, port, reachable, latency, peerThroughput, successes, now, lastSuccess)
+	if err != nil {
+		return fmt.Errorf("error updating record in ProxyHealth: %v", err)
+	}
+
+	return nil
+}
+
+// FindProxyHealth retrieves a record from the ProxyHealth table by its node and offer.
+func FindProxyHealth(db *sql.DB, node string, offer int64) (*models.ProxyHealth, error) {
+	var health models.ProxyHealth
+	query := `SELECT node, offer, protocol, ip, port, reachable, latency, peerThroughput, checks, successes, lastChecked, lastSuccess
+	          FROM ProxyHealth WHERE node = ? AND offer = ?`
+	err := db.QueryRow(query, node, offer).Scan(&health.Node, &health.Offer, &health.Protocol, &health.IP, &health.Port,
+		&health.Reachable, &health.Latency, &health.PeerThroughput,
+		&health.Checks, &health.Successes, &health.LastChecked, &health.LastSuccess)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in ProxyHealth with node %s and offer %d: %v", node, offer, err)
+	}
+
+	return &health, nil
+}
+
+// GetAllProxyHealth retrieves all records from the ProxyHealth table.
+func GetAllProxyHealth(db *sql.DB) ([]models.ProxyHealth, error) {
+	query := `SELECT node, offer, protocol, ip, port, reachable, latency, peerThroughput, checks, successes, lastChecked, lastSuccess FROM ProxyHealth`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ProxyHealth table: %v", err)
+	}
+	defer rows.Close()
+
+	proxyHealthRecords := []models.ProxyHealth{}
+	for rows.Next() {
+		var record models.ProxyHealth
+		err := rows.Scan(&record.Node, &record.Offer, &record.Protocol, &record.IP, &record.Port,
+			&record.Reachable, &record.Latency, &record.PeerThroughput,
+			&record.Checks, &record.Successes, &record.LastChecked, &record.LastSuccess)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ProxyHealth record: %v", err)
+		}
+		proxyHealthRecords = append(proxyHealthRecords, record)
+	}
+
+	return proxyHealthRecords, nil
+}
@@ -4,21 +4,28 @@ import (
 	"database/sql"
 	"fmt"
 	"server/database/models"
+	"time"
 )
 
-// AddSharing inserts a new record into the Sharing table.
-func AddSharing(db *sql.DB, hash, password string) error {
-	query := `INSERT INTO Sharing (hash, password) VALUES (?, ?)`
-	_, err := db.Exec(query, hash, password)
+// AddSharing inserts a new share link for a stored file into the Sharing table and returns its id.
+// Only the hash of the link token is stored, and for encrypted links the hash of the encrypted copy.
+func AddSharing(db *sql.DB, hash, tokenID, tokenHash, permissions, label string, expiry, maxDownloads int64, encrypted bool, content string) (int64, error) {
+	query := `INSERT INTO Sharing (hash, tokenId, tokenHash, permissions, label, created, expiry, maxDownloads, encrypted, content) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, hash, tokenID, tokenHash, permissions, label, time.Now().Unix(), expiry, maxDownloads, encrypted, content)
 	if err != nil {
-		return fmt.Errorf("error adding record to Sharing: %v", err)
+		return 0, fmt.Errorf("error adding record to Sharing: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading id of Sharing record: %v", err)
 	}
 
 	fmt.Printf("Record added to Sharing with hash: %s\n", hash)
-	return nil
+	return id, nil
 }
 
-// DeleteSharing removes a record from the Sharing table by its hash.
+// DeleteSharing removes every share link of a file from the Sharing table by its hash.
 func DeleteSharing(db *sql.DB, hash string) error {
 	query := `DELETE FROM Sharing WHERE hash = ?`
 	_, err := db.Exec(query, hash)
@@ -30,24 +37,103 @@ func DeleteSharing(db *sql.DB, hash string) error {
 	return nil
 }
 
-// FindSharing retrieves a record from the Sharing table by its hash.
-func FindSharing(db *sql.DB, hash string) (*models.JoinedSharing, error) {
-	var sharing models.JoinedSharing
-	query := `SELECT Storing.*, password FROM Sharing JOIN Storing ON Sharing.hash == Storing.hash WHERE Sharing.hash = ?`
-	err := db.QueryRow(query, hash).Scan(&sharing.Hash, &sharing.Name, &sharing.Extension, &sharing.Size, &sharing.Path, &sharing.Date, &sharing.Password)
+// RevokeSharing marks a share link as revoked so it can no longer be used.
+func RevokeSharing(db *sql.DB, id int64) error {
+	query := `UPDATE Sharing SET revoked = 1 WHERE id = ?`
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("error revoking record in Sharing with id %d: %v", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking revoke result for Sharing with id %d: %v", id, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no record found in Sharing with id %d", id)
+	}
+
+	fmt.Printf("Record with id %d revoked successfully in Sharing.\n", id)
+	return nil
+}
+
+// UseSharing counts a download against a share link. It only succeeds while the
+// link is not revoked, not expired and below its download limit, so concurrent
+// requests cannot go over the limit. Returns false if the link could not be used.
+func UseSharing(db *sql.DB, id int64) (bool, error) {
+	query := `UPDATE Sharing SET downloads = downloads + 1
+		WHERE id = ? AND revoked = 0 AND (expiry = 0 OR expiry > ?) AND (maxDownloads = 0 OR downloads < maxDownloads)`
+	result, err := db.Exec(query, id, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("error using record in Sharing with id %d: %v", id, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error checking use result for Sharing with id %d: %v", id, err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// FindSharing retrieves a share link from the Sharing table by its token id.
+func FindSharing(db *sql.DB, tokenID string) (*models.Sharing, error) {
+	var sharing models.Sharing
+	query := `SELECT id, hash, tokenId, tokenHash, permissions, label, created, expiry, maxDownloads, downloads, revoked, encrypted, content FROM Sharing WHERE tokenId = ?`
+	err := db.QueryRow(query, tokenID).Scan(&sharing.ID, &sharing.Hash, &sharing.TokenID, &sharing.TokenHash, &sharing.Permissions, &sharing.Label, &sharing.Created,
+		&sharing.Expiry, &sharing.MaxDownloads, &sharing.Downloads, &sharing.Revoked, &sharing.Encrypted, &sharing.Content)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No record found
 		}
-		return nil, fmt.Errorf("error finding record in Sharing with hash %s: %v", hash, err)
+		return nil, fmt.Errorf("error finding record in Sharing: %v", err)
 	}
 
 	return &sharing, nil
 }
 
-// GetAllSharing retrieves all records from the Sharing table.
+// FindSharingByID retrieves a share link from the Sharing table by its id.
+func FindSharingByID(db *sql.DB, id int64) (*models.Sharing, error) {
+	var sharing models.Sharing
+	query := `SELECT id, hash, tokenId, tokenHash, permissions, label, created, expiry, maxDownloads, downloads, revoked, encrypted, content FROM Sharing WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&sharing.ID, &sharing.Hash, &sharing.TokenID, &sharing.TokenHash, &sharing.Permissions, &sharing.Label, &sharing.Created,
+		&sharing.Expiry, &sharing.MaxDownloads, &sharing.Downloads, &sharing.Revoked, &sharing.Encrypted, &sharing.Content)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in Sharing with id %d: %v", id, err)
+	}
+
+	return &sharing, nil
+}
+
+// GetSharingLinks retrieves every share link of a file, newest first.
+func GetSharingLinks(db *sql.DB, hash string) ([]models.Sharing, error) {
+	query := `SELECT id, hash, tokenId, tokenHash, permissions, label, created, expiry, maxDownloads, downloads, revoked, encrypted, content FROM Sharing WHERE hash = ? ORDER BY created DESC, id DESC`
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error querying Sharing table: %v", err)
+	}
+	defer rows.Close()
+
+	links := []models.Sharing{}
+	for rows.Next() {
+		var link models.Sharing
+		err := rows.Scan(&link.ID, &link.Hash, &link.TokenID, &link.TokenHash, &link.Permissions, &link.Label, &link.Created,
+			&link.Expiry, &link.MaxDownloads, &link.Downloads, &link.Revoked, &link.Encrypted, &link.Content)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning Sharing record: %v", err)
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// GetAllSharing retrieves every shared file with its number of share links.
 func GetAllSharing(db *sql.DB) ([]models.JoinedSharing, error) {
-	query := `SELECT Storing.*, password FROM Sharing JOIN Storing ON Sharing.hash == Storing.hash`
+	query := `SELECT Storing.*, COUNT(Sharing.id) FROM Sharing JOIN Storing ON Sharing.hash == Storing.hash GROUP BY Storing.hash`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("error querying Sharing table: %v", err)
@@ -57,7 +143,7 @@ func GetAllSharing(db *sql.DB) ([]models.JoinedSharing, error) {
 	sharingRecords := []models.JoinedSharing{}
 	for rows.Next() {
 		var record models.JoinedSharing
-		err := rows.Scan(&record.Hash, &record.Name, &record.Extension, &record.Size, &record.Path, &record.Date, &record.Password)
+		err := rows.Scan(&record.Hash, &record.Name, &record.Extension, &record.Size, &record.Path, &record.Date, &record.Links)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning Sharing record: %v", err)
 		}
@@ -66,3 +152,80 @@ func GetAllSharing(db *sql.DB) ([]models.JoinedSharing, error) {
 
 	return sharingRecords, nil
 }
+
+// AddShareAccesses records one use of a share link, its result and the bytes sent.
+func AddShareAccesses(db *sql.DB, link int64, tokenID, hash, peer, result string, bytes int64) error {
+	query := `INSERT INTO ShareAccesses (link, tokenID, hash, peer, result, bytes, time) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, link, tokenID, hash, peer, result, bytes, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error adding record to ShareAccesses: %v", err)
+	}
+
+	return nil
+}
+
+// Conditions of ShareAccessFilter, followed by the hash of the file
+const shareAccessConditions = `hash = ? AND (? = 0 OR link = ?) AND (? = '' OR peer = ?) AND (? = '' OR result = ?)
+	          AND (? = 0 OR time >= ?) AND (? = 0 OR time <= ?)`
+
+func shareAccessArgs(hash string, filter models.ShareAccessFilter) []any {
+	return []any{hash, filter.Link, filter.Link, filter.Peer, filter.Peer, filter.Result, filter.Result,
+		filter.Since, filter.Since, filter.Until, filter.Until}
+}
+
+// GetShareAccesses retrieves the accesses of a shared file that match a filter, newest first.
+func GetShareAccesses(db *sql.DB, hash string, filter models.ShareAccessFilter) ([]models.ShareAccesses, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+
+	query := `SELECT id, link, tokenID, hash, peer, result, bytes, time FROM ShareAccesses
+	          WHERE ` + shareAccessConditions + ` ORDER BY time DESC, id DESC LIMIT ?`
+	rows, err := db.Query(query, append(shareAccessArgs(hash, filter), limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ShareAccesses table: %v", err)
+	}
+	defer rows.Close()
+
+	shareAccessesRecords := []models.ShareAccesses{}
+	for rows.Next() {
+		var record models.ShareAccesses
+		err := rows.Scan(&record.ID, &record.Link, &record.TokenID, &record.Hash, &record.Peer, &record.Result, &record.Bytes, &record.Time)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ShareAccesses record: %v", err)
+		}
+		shareAccessesRecords = append(shareAccessesRecords, record)
+	}
+
+	return shareAccessesRecords, nil
+}
+
+// GetShareLinkUsage adds up the accesses of a shared file that match a filter for
+// each link, with the limit of the filter ignored. Accesses with a token that
+// matched no link are added up under link 0.
+func GetShareLinkUsage(db *sql.DB, hash string, filter models.ShareAccessFilter) ([]models.ShareLinkUsage, error) {
+	query := `SELECT a.link, a.tokenID, COALESCE(MAX(Sharing.label), ''), COUNT(*), SUM(a.result = 'ok'), SUM(a.result != 'ok'),
+	          SUM(a.bytes), COUNT(DISTINCT a.peer), MIN(a.time), MAX(a.time)
+	          FROM (SELECT * FROM ShareAccesses WHERE ` + shareAccessConditions + `) AS a
+	          LEFT JOIN Sharing ON Sharing.id = a.link
+	          GROUP BY a.link, a.tokenID ORDER BY MAX(a.time) DESC`
+	rows, err := db.Query(query, shareAccessArgs(hash, filter)...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying ShareAccesses table: %v", err)
+	}
+	defer rows.Close()
+
+	usageRecords := []models.ShareLinkUsage{}
+	for rows.Next() {
+		var record models.ShareLinkUsage
+		err := rows.Scan(&record.Link, &record.TokenID, &record.Label, &record.Accesses, &record.Downloads, &record.Refused,
+			&record.Bytes, &record.Peers, &record.First, &record.Last)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ShareAccesses record: %v", err)
+		}
+		usageRecords = append(usageRecords, record)
+	}
+
+	return usageRecords, nil
+}
@@ -11,17 +11,25 @@ func CalcStatistics(db *sql.DB) (models.Statistics, error) {
 	tables := []string{"Storing", "Hosting", "Sharing", "Saved"}
 	var stats [8]int64
 	for i, table := range tables {
+		// A file can have many share links, so shared files are counted once
+		countQuery := "SELECT COUNT(*) FROM " + table
+		if table == "Sharing" {
+			countQuery = "SELECT COUNT(DISTINCT hash) FROM Sharing"
+		}
+
 		var num int64
-		err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&num)
+		err := db.QueryRow(countQuery).Scan(&num)
 		if err != nil {
 			return models.Statistics{}, fmt.Errorf("error counting rows in %s table: %v", table, err)
 		}
 
 		var size int64
 		if table == "Storing" || table == "Saved" {
-			err = db.QueryRow("SELECT SUM(size) FROM " + table).Scan(&size)
+			err = db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM " + table).Scan(&size)
+		} else if table == "Sharing" {
+			err = db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM Storing WHERE hash IN (SELECT hash FROM Sharing)").Scan(&size)
 		} else {
-			err = db.QueryRow(fmt.Sprintf("SELECT SUM(size) FROM %s JOIN Storing ON %s.hash == Storing.hash", table, table)).Scan(&size)
+			err = db.QueryRow(fmt.Sprintf("SELECT COALESCE(SUM(size), 0) FROM %s JOIN Storing ON %s.hash == Storing.hash", table, table)).Scan(&size)
 		}
 		if err != nil {
 			return models.Statistics{}, fmt.Errorf("error calculating total size in %s table: %v", table, err)
@@ -42,5 +50,11 @@ func CalcStatistics(db *sql.DB) (models.Statistics, error) {
 		SavedSize:   stats[7],
 	}
 
+	query := `SELECT COUNT(*), COALESCE(SUM(result = 'ok'), 0), COALESCE(SUM(bytes), 0) FROM ShareAccesses`
+	err := db.QueryRow(query).Scan(&statistics.ShareAccesses, &statistics.ShareDownloads, &statistics.ShareBytes)
+	if err != nil {
+		return models.Statistics{}, fmt.Errorf("error calculating share link use from ShareAccesses table: %v", err)
+	}
+
 	return statistics, nil
 }
@@ -0,0 +1,104 @@
+package operations
+
+import (
+	"database/sql"
+	"fmt"
+	"server/database/models"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// transactionStatus returns the status of a transaction with the given number of confirmations.
+func transactionStatus(confirmations int64) string {
+	if confirmations > 0 {
+		return "confirmed"
+	}
+	return "pending"
+}
+
+// AddTransactions records a payment along with its purpose, reference and counterparty peer.
+// If the transaction has already been synced from the wallet, only its purpose, reference and peer are updated.
+func AddTransactions(db *sql.DB, id, wallet, category, purpose, reference, peer string, amount float64) error {
+	now := time.Now()
+	query := `INSERT INTO Transactions (id, date, time, wallet, amount, category, fee, confirmations, status, purpose, reference, peer)
+	          VALUES (?, ?, ?, ?, ?, ?, 0, 0, ?, ?, ?, ?)
+	          ON CONFLICT(id, category) DO UPDATE SET purpose = excluded.purpose, reference = excluded.reference, peer = excluded.peer`
+	_, err := db.Exec(query, id, now.Local().Format("01/02/2006"), now.Unix(), wallet, amount, category, transactionStatus(0), purpose, reference, peer)
+	if err != nil {
+		return fmt.Errorf("error adding record to Transactions: %v", err)
+	}
+
+	fmt.Printf("Record added to Transactions with id: %s\n", id)
+	return nil
+}
+
+// GetTransactions retrieves records from the Transactions table, optionally filtered by purpose and peer.
+func GetTransactions(db *sql.DB, purpose, peer string) ([]models.Transactions, error) {
+	query := `SELECT id, date, time, wallet, amount, category, fee, confirmations, status, purpose, reference, peer FROM Transactions
+	          WHERE (? = '' OR purpose = ?) AND (? = '' OR peer = ?) ORDER BY time DESC`
+	rows, err := db.Query(query, purpose, purpose, peer, peer)
+	if err != nil {
+		return nil, fmt.Errorf("error querying Transactions table: %v", err)
+	}
+	defer rows.Close()
+
+	transactionsRecords := []models.Transactions{}
+	for rows.Next() {
+		var record models.Transactions
+		err := rows.Scan(&record.Id, &record.Date, &record.Time, &record.Wallet, &record.Amount, &record.Category, &record.Fee,
+			&record.Confirmations, &record.Status, &record.Purpose, &record.Reference, &record.Peer)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning Transactions record: %v", err)
+		}
+		transactionsRecords = append(transactionsRecords, record)
+	}
+
+	return transactionsRecords, nil
+}
+
+// SyncTransactions records every wallet transaction in the Transactions table and updates confirmations and status.
+// Transactions not mined yet are recorded as pending with no confirmations. Purpose, reference and peer of already
+// recorded transactions are kept.
+func SyncTransactions(btcwallet *rpcclient.Client, db *sql.DB) error {
+	listSinceBlockResult, err := btcwallet.ListSinceBlock(nil)
+	if err != nil {
+		return fmt.Errorf("error listing wallet transactions: %v", err)
+	}
+
+	query := `INSERT INTO Transactions (id, date, time, wallet, amount, category, fee, confirmations, status, purpose, reference, peer)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', '')
+	          ON CONFLICT(id, category) DO UPDATE SET date = excluded.date, time = excluded.time, wallet = excluded.wallet,
+	          amount = excluded.amount, fee = excluded.fee, confirmations = excluded.confirmations, status = excluded.status`
+	for _, transaction := range listSinceBlockResult.Transactions {
+		var fee float64
+		if transaction.Fee != nil {
+			fee = *transaction.Fee
+		}
+
+		// Skip the send half of transactions to our own wallet
+		if transaction.Category == "send" && fee == 0 {
+			continue
+		}
+
+		date := time.Unix(transaction.Time, 0).Local().Format("01/02/2006")
+		_, err := db.Exec(query, transaction.TxID, date, transaction.Time, transaction.Address, transaction.Amount, transaction.Category,
+			fee, transaction.Confirmations, transactionStatus(transaction.Confirmations))
+		if err != nil {
+			return fmt.Errorf("error syncing record in Transactions with id %s: %v", transaction.TxID, err)
+		}
+	}
+
+	// Attribute received payments using the addresses they were sent to
+	query = `UPDATE Transactions SET
+	         purpose = (SELECT purpose FROM Addresses WHERE Addresses.address = Transactions.wallet),
+	         reference = (SELECT reference FROM Addresses WHERE Addresses.address = Transactions.wallet),
+	         peer = (SELECT peer FROM Addresses WHERE Addresses.address = Transactions.wallet)
+	         WHERE category = 'receive' AND purpose = '' AND wallet IN (SELECT address FROM Addresses)`
+	_, err = db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("error attributing records in Transactions: %v", err)
+	}
+
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"server/database/models"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/rpcclient"
 )
 
@@ -49,6 +51,50 @@ func StoreAddress(btcwallet *rpcclient.Client, db *sql.DB) (string, error) {
 	return address.String(), nil
 }
 
+// NewReceiveAddress generates a fresh receive address and records what it was issued for in the Addresses table.
+func NewReceiveAddress(btcwallet *rpcclient.Client, db *sql.DB, purpose, reference, peer string) (btcutil.Address, error) {
+	// Query the RPC server for a new address.
+	address, err := btcwallet.GetNewAddress("default")
+	if err != nil {
+		return nil, err
+	}
+
+	err = AddAddresses(db, address.String(), purpose, reference, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// AddAddresses inserts a new record into the Addresses table.
+func AddAddresses(db *sql.DB, address, purpose, reference, peer string) error {
+	date := time.Now().Local().Format("01/02/2006")
+	query := `INSERT INTO Addresses (address, date, purpose, reference, peer) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, address, date, purpose, reference, peer)
+	if err != nil {
+		return fmt.Errorf("error adding record to Addresses: %v", err)
+	}
+
+	fmt.Printf("Record added to Addresses with address: %s\n", address)
+	return nil
+}
+
+// FindAddresses retrieves a record from the Addresses table by its address.
+func FindAddresses(db *sql.DB, address string) (*models.Addresses, error) {
+	var addresses models.Addresses
+	query := `SELECT address, date, purpose, reference, peer FROM Addresses WHERE address = ?`
+	err := db.QueryRow(query, address).Scan(&addresses.Address, &addresses.Date, &addresses.Purpose, &addresses.Reference, &addresses.Peer)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in Addresses with address %s: %v", address, err)
+	}
+
+	return &addresses, nil
+}
+
 // GetWalletInfo retrieves the only record from the WalletInfo table.
 func GetWalletInfo(db *sql.DB) (*models.WalletInfo, error) {
 	var walletInfo models.WalletInfo
@@ -63,3 +109,30 @@ func GetWalletInfo(db *sql.DB) (*models.WalletInfo, error) {
 
 	return &walletInfo, nil
 }
+
+// UpdatePaymentSettings updates the only record in the PaymentSettings table.
+func UpdatePaymentSettings(db *sql.DB, mode string, confirmations, timeout int64) error {
+	query := `UPDATE PaymentSettings SET mode = ?, confirmations = ?, timeout = ?`
+	_, err := db.Exec(query, mode, confirmations, timeout)
+	if err != nil {
+		return fmt.Errorf("error updating record from PaymentSettings: %v", err)
+	}
+
+	fmt.Printf("Record updated successfully in PaymentSettings.\n")
+	return nil
+}
+
+// GetPaymentSettings retrieves the only record from the PaymentSettings table.
+func GetPaymentSettings(db *sql.DB) (*models.PaymentSettings, error) {
+	var paymentSettings models.PaymentSettings
+	query := `SELECT mode, confirmations, timeout FROM PaymentSettings`
+	err := db.QueryRow(query).Scan(&paymentSettings.Mode, &paymentSettings.Confirmations, &paymentSettings.Timeout)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No record found
+		}
+		return nil, fmt.Errorf("error finding record in PaymentSettings: %v", err)
+	}
+
+	return &paymentSettings, nil
+}
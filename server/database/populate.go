@@ -108,7 +108,7 @@ func populateSharing(db *sql.DB, filePath string) error {
 	}
 
 	for _, record := range sharingRecords {
-		err = operations.AddSharing(db, record.Hash, record.Password)
+		_, err = operations.AddSharing(db, record.Hash, record.TokenID, record.TokenHash, record.Permissions, record.Label, record.Expiry, record.MaxDownloads, record.Encrypted, record.Content)
 		if err != nil {
 			return fmt.Errorf("error inserting into Sharing: %v", err)
 		}
@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Folder and size cap of the cache of fetched shared content
+const (
+	cacheDir  = "./gateway/cache"
+	cacheSize = 1 << 30 // 1 GiB
+)
+
+// Cache keeps fetched content on disk under its hash and evicts the least
+// recently used objects once it grows over its size cap. It only stores content,
+// access to it is checked with the sharing peer on every request.
+type Cache struct {
+	dir      string
+	capacity int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List // Most recently used at the front
+	mutex    sync.Mutex
+}
+
+type cacheEntry struct {
+	hash string
+	size int64
+}
+
+// NewCache opens the cache in a folder, picking up the objects already in it.
+func NewCache(dir string, capacity int64) (*Cache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache folder: %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache folder: %v", err)
+	}
+
+	// Older objects were used less recently
+	var infos []os.FileInfo
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if !validHash(info.Name()) {
+			os.Remove(filepath.Join(dir, info.Name())) // Left over from an interrupted fetch
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+
+	c := &Cache{dir: dir, capacity: capacity, entries: map[string]*list.Element{}, order: list.New()}
+	for _, info := range infos {
+		c.entries[info.Name()] = c.order.PushBack(&cacheEntry{hash: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+
+	c.mutex.Lock()
+	c.evict()
+	c.mutex.Unlock()
+
+	return c, nil
+}
+
+// Open returns the cached content of a hash and marks it as recently used.
+func (c *Cache) Open(hash string) (*os.File, bool) {
+	if !validHash(hash) {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[hash]
+	if !found {
+		return nil, false
+	}
+
+	file, err := os.Open(c.path(hash))
+	if err != nil {
+		log.Printf("Error opening cached content %s: %v", hash, err)
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return file, true
+}
+
+// Create starts caching the content of a hash. The content is written to the
+// returned writer and only kept if Commit finds it matches the hash.
+func (c *Cache) Create(hash string) (*CacheWriter, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("invalid content hash %q", hash)
+	}
+
+	file, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %v", err)
+	}
+
+	return &CacheWriter{cache: c, hash: hash, file: file, hasher: sha256.New()}, nil
+}
+
+// CacheWriter receives content to cache while it is streamed to a client.
+type CacheWriter struct {
+	cache  *Cache
+	hash   string
+	file   *os.File
+	hasher hash.Hash
+	size   int64
+	failed bool
+}
+
+// Write never fails, so streaming to the client goes on if the cache cannot be written.
+func (w *CacheWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		_, err := w.file.Write(p)
+		if err != nil {
+			log.Printf("Error writing cached content %s: %v", w.hash, err)
+			w.failed = true
+		}
+		w.hasher.Write(p)
+		w.size += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// Commit adds the written content to the cache if it hashes to the expected hash.
+func (w *CacheWriter) Commit() error {
+	err := w.file.Close()
+	if err != nil || w.failed {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write cached content %s", w.hash)
+	}
+
+	if hex.EncodeToString(w.hasher.Sum(nil)) != w.hash {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("content received for %s does not match its hash", w.hash)
+	}
+
+	c := w.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.entries[w.hash]; found {
+		// Cached by a concurrent request in the meantime
+		os.Remove(w.file.Name())
+		c.order.MoveToFront(element)
+		return nil
+	}
+
+	err = os.Rename(w.file.Name(), c.path(w.hash))
+	if err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to store cached content %s: %v", w.hash, err)
+	}
+
+	c.entries[w.hash] = c.order.PushFront(&cacheEntry{hash: w.hash, size: w.size})
+	c.size += w.size
+	c.evict()
+	return nil
+}
+
+// Abort drops the written content.
+func (w *CacheWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// evict removes the least recently used objects until the cache fits its cap.
+// The caller must hold the mutex.
+func (c *Cache) evict() {
+	for c.size > c.capacity && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an object from the cache. The caller must hold the mutex.
+func (c *Cache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.hash)
+	c.size -= entry.size
+
+	err := os.Remove(c.path(entry.hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cached content %s: %v", entry.hash, err)
+	}
+}
+
+// path returns where the content of a hash is cached. Only hashes checked by
+// validHash get here, so the path cannot point outside the cache folder.
+func (c *Cache) path(hash string) string {
+	return filepath.Join(c.dir, hash)
+}
+
+// validHash tells whether a hash has the form of a content hash.
+func validHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
@@ -0,0 +1,305 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"server/database/models"
+	"server/p2p"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+/*
+Encrypted links carry their key in the URL fragment, which browsers never send. The
+first visit gets a page that posts the key from the fragment to the link, which sets
+it in an HttpOnly cookie scoped to the link, and reloads, so the key reaches this
+gateway and nothing else. Other clients can pass the key in the Share-Key header.
+Keys are only accepted over TLS, so encrypted links are refused by gateways serving
+plain HTTP. The sharing peer only sends the encrypted copy, which is also what the
+cache keeps, and it is decrypted chunk by chunk as it streams to the client.
+*/
+
+// Header a client can pass the key of an encrypted link in
+const shareKeyHeader = "Share-Key"
+
+// Page that posts the key of an encrypted link from the fragment, to be kept in a cookie
+var keyTemplate = template.Must(template.New("key").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Encrypted file</title>
+</head>
+<body>
+<p id="status">Decrypting...</p>
+<script>
+var message = document.getElementById("status");
+var key = new URLSearchParams(location.hash.slice(1)).get("key");
+if (key) {
+	var link = location.pathname + location.search;
+	fetch(link, {method: "POST", headers: {"Share-Key": key}, credentials: "same-origin"}).then(function (response) {
+		if (response.ok) {
+			location.replace(link);
+		} else {
+			response.text().then(function (text) { message.textContent = text; });
+		}
+	}, function () {
+		message.textContent = "The key of this link could not be sent to the gateway.";
+	});
+} else {
+	message.textContent = "This link is missing the key to decrypt the file.";
+}
+</script>
+</body>
+</html>
+`))
+
+// keyCookie returns the name of the cookie the key of an encrypted link is kept in.
+func keyCookie(capability models.ShareCapability) string {
+	return "sharekey-" + capability.ID
+}
+
+// serveEncrypted streams the file of an encrypted link, decrypting its encrypted
+// copy as it is fetched from the sharing peer or read from the cache.
+func serveEncrypted(w http.ResponseWriter, r *http.Request, node host.Host, cache *Cache, capability models.ShareCapability, token string) {
+	if r.TLS == nil {
+		http.Error(w, "encrypted links are only served over HTTPS", http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("path") != "" || r.URL.Query().Get("archive") != "" {
+		http.Error(w, "encrypted links only serve a single file", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPost {
+		keepKey(w, r, capability)
+		return
+	}
+
+	encodedKey := r.Header.Get(shareKeyHeader)
+	if cookie, err := r.Cookie(keyCookie(capability)); encodedKey == "" && err == nil {
+		encodedKey = cookie.Value
+	}
+	if encodedKey == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		keyTemplate.Execute(w, nil)
+		return
+	}
+	key, err := p2p.DecodeShareKey(encodedKey)
+	if err != nil {
+		forgetKey(w, r, capability)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The encrypted copy never changes for a link, so its hash is a strong ETag
+	etag := fmt.Sprintf("\"%s\"", capability.Content)
+	request := models.ShareRequest{
+		Hash:    capability.Hash,
+		IfRange: r.Header.Get("If-Range"),
+		Head:    r.Method == http.MethodHead || etagMatches(r.Header.Get("If-None-Match"), etag),
+		Session: downloadSession(r),
+	}
+
+	// A range of the file is served from the chunks of the copy that hold it
+	start, end, ranged := parsePlainRange(r.Header.Get("Range"))
+	if ranged {
+		request.Range = fmt.Sprintf("bytes=%d-", start/p2p.EncryptedChunkSize*p2p.EncryptedChunkLen)
+		if end >= 0 {
+			request.Range += strconv.FormatInt((end/p2p.EncryptedChunkSize+1)*p2p.EncryptedChunkLen-1, 10)
+		}
+	}
+
+	// Cached copies are still only served once the sharing peer accepts the token
+	var cached *os.File
+	if cache != nil && !request.Head {
+		cached, request.Cached = cache.Open(capability.Content)
+	}
+	if cached != nil {
+		defer cached.Close()
+	}
+
+	response, body, source, err := fetchContent(r, node, []contentSource{{peer: capability.Issuer, token: token}}, request)
+	if err != nil {
+		fetchFailed(w, err)
+		return
+	}
+	defer body.Close()
+
+	switch response.Result {
+	case p2p.ShareOK:
+	case p2p.ShareUnsatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", p2p.DecryptedSize(response.Size)))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	default:
+		refuseContent(w, response, source)
+		return
+	}
+	if response.Hash != capability.Content {
+		http.Error(w, "shared content does not match its link", http.StatusBadGateway)
+		return
+	}
+	keepDownloadSession(w, r, response)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "private")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Find the requested bytes of the file within the chunks that were sent
+	size := p2p.DecryptedSize(response.Size)
+	first := response.Offset / p2p.EncryptedChunkLen
+	offset, length := int64(0), size
+	if response.Partial {
+		if start >= size {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if end < 0 || end >= size {
+			end = size - 1
+		}
+		offset, length = start, end-start+1
+	}
+
+	// Decrypt the copy from the cache, or as it streams from the peer while caching
+	// complete transfers
+	var content io.Reader = body
+	var writer *CacheWriter
+	if cached != nil {
+		content = io.NewSectionReader(cached, response.Offset, response.Length)
+	} else if cache != nil && !request.Head && !response.Partial && response.Size <= cache.capacity {
+		writer, err = cache.Create(response.Hash)
+		if err != nil {
+			log.Printf("Error caching file hash %s: %v", response.Hash, err)
+		} else {
+			content = io.TeeReader(body, writer)
+		}
+	}
+	abort := func() {
+		if writer != nil {
+			writer.Abort()
+		}
+	}
+	decrypter, err := p2p.NewDecrypter(content, key, first, response.Size)
+	if err != nil {
+		abort()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reader := bufio.NewReaderSize(decrypter, sniffLen)
+
+	// Decrypting the first chunk checks the key before anything is sent
+	var head []byte
+	if !request.Head {
+		_, err = reader.Discard(int(offset - first*p2p.EncryptedChunkSize))
+		if err == nil {
+			head, err = reader.Peek(sniffLen)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			abort()
+			http.Error(w, fmt.Sprintf("failed to fetch encrypted content: %v", err), http.StatusBadGateway)
+			return
+		} else if err != nil && err != io.EOF {
+			log.Printf("Error decrypting file hash %s: %v", capability.Hash, err)
+			abort()
+			forgetKey(w, r, capability)
+			http.Error(w, "content does not decrypt with the key of this link", http.StatusForbidden)
+			return
+		}
+		if offset != 0 {
+			head = nil
+		}
+	}
+
+	setContentHeaders(w, response.Name, contentType(response.Name, response.Extension, head))
+	w.Header().Set("Content-Length", fmt.Sprint(length))
+	if response.Partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if request.Head {
+		return
+	}
+
+	// Stream the file as it is decrypted
+	_, err = io.CopyN(w, reader, length)
+	if err != nil {
+		log.Printf("Error streaming encrypted file hash %s from peer %s: %v", capability.Hash, source.peer, err)
+	}
+
+	if writer != nil {
+		if err != nil {
+			writer.Abort()
+		} else if err = writer.Commit(); err != nil {
+			log.Printf("Error caching file hash %s: %v", response.Hash, err)
+		}
+	}
+}
+
+// keepKey sets the key posted by the page of an encrypted link in a cookie scoped
+// to the link, which scripts cannot read.
+func keepKey(w http.ResponseWriter, r *http.Request, capability models.ShareCapability) {
+	encodedKey := r.Header.Get(shareKeyHeader)
+	_, err := p2p.DecodeShareKey(encodedKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     keyCookie(capability),
+		Value:    encodedKey,
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetKey drops a key cookie that turned out to be wrong, so the next visit of
+// the link asks the page for the key again.
+func forgetKey(w http.ResponseWriter, r *http.Request, capability models.ShareCapability) {
+	http.SetCookie(w, &http.Cookie{Name: keyCookie(capability), Path: r.URL.Path, MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// parsePlainRange reads a single range with a start from an HTTP Range header. The
+// end is -1 when the range runs to the end of the file. Other ranges are not
+// supported for encrypted links and the whole file is sent instead.
+func parsePlainRange(header string) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || first == "" {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
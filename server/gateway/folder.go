@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"server/database/models"
+	"server/p2p"
+	"strings"
+)
+
+// Largest manifest the gateway reads for an index page
+const maxManifestSize = 16 << 20 // 16 MiB
+
+// MIME type of each archive format a shared folder can be downloaded as
+var archiveTypes = map[string]string{
+	p2p.ArchiveZip: "application/zip",
+	p2p.ArchiveTar: "application/x-tar",
+}
+
+// Index page of a shared folder
+var folderTemplate = template.Must(template.New("folder").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Download as <a href="{{.Zip}}">zip</a> or <a href="{{.Tar}}">tar</a></p>
+<table>
+<tr><th>Name</th><th>Size</th></tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">..</a></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Link}}">{{.Name}}{{if .Folder}}/{{end}}</a></td><td>{{.Size}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type folderPage struct {
+	Name    string
+	Parent  string
+	Zip     string
+	Tar     string
+	Entries []folderPageEntry
+}
+
+type folderPageEntry struct {
+	Name   string
+	Size   int64
+	Folder bool
+	Link   string
+}
+
+// shareLink returns the link to an entry of a shared folder. It is relative to
+// the page, so it works behind whatever base URL the gateway is reached by.
+func shareLink(token, entryPath, archive string) string {
+	query := url.Values{}
+	if token != "" {
+		query.Set("token", token)
+	}
+	if entryPath != "" {
+		query.Set("path", entryPath)
+	}
+	if archive != "" {
+		query.Set("archive", archive)
+	}
+	return "?" + query.Encode()
+}
+
+// serveFolderIndex renders the manifest of a shared folder as a page linking to
+// its entries. The manifest is checked against its hash and cached, so later
+// requests for its entries can be served from the cache.
+func serveFolderIndex(w http.ResponseWriter, body io.Reader, response models.ShareResponse, cache *Cache, token, entryPath string, head bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if head {
+		return
+	}
+
+	if response.Length < 0 || response.Length > maxManifestSize {
+		http.Error(w, "folder manifest too large", http.StatusBadGateway)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, response.Length))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read folder manifest: %v", err), http.StatusBadGateway)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != response.Hash {
+		http.Error(w, "folder manifest does not match its hash", http.StatusBadGateway)
+		return
+	}
+
+	var manifest models.Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid folder manifest: %v", err), http.StatusBadGateway)
+		return
+	}
+	cacheManifest(cache, response.Hash, data)
+
+	page := folderPage{
+		Name: manifest.Name,
+		Zip:  shareLink(token, entryPath, p2p.ArchiveZip),
+		Tar:  shareLink(token, entryPath, p2p.ArchiveTar),
+	}
+	if entryPath != "" {
+		page.Name = entryPath
+		page.Parent = shareLink(token, strings.TrimPrefix(path.Dir(entryPath), "."), "")
+	}
+	for _, entry := range manifest.Entries {
+		page.Entries = append(page.Entries, folderPageEntry{
+			Name:   entry.Name,
+			Size:   entry.Size,
+			Folder: entry.Folder,
+			Link:   shareLink(token, path.Join(entryPath, entry.Name), ""),
+		})
+	}
+
+	err = folderTemplate.Execute(w, page)
+	if err != nil {
+		log.Printf("Error rendering folder %s: %v", response.Hash, err)
+	}
+}
+
+// serveArchive streams a zip or tar archive of a shared folder as it is written
+// by the sharing peer. Its size is not known, so it has no Content-Length.
+func serveArchive(w http.ResponseWriter, body io.Reader, response models.ShareResponse, head bool) {
+	w.Header().Set("Content-Type", archiveTypes[response.Extension])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": response.Name}))
+	w.Header().Set("Cache-Control", "private")
+	if head {
+		return
+	}
+
+	_, err := io.Copy(w, body)
+	if err != nil {
+		log.Printf("Error streaming archive %s: %v", response.Name, err)
+	}
+}
+
+// cacheManifest keeps a manifest that was checked against its hash.
+func cacheManifest(cache *Cache, hash string, data []byte) {
+	if cache == nil {
+		return
+	}
+	writer, err := cache.Create(hash)
+	if err == nil {
+		writer.Write(data)
+		err = writer.Commit()
+	}
+	if err != nil {
+		log.Printf("Error caching manifest %s: %v", hash, err)
+	}
+}
+
+// resolveCached walks the cached manifests of a shared folder down a path and
+// returns the hash of the entry it names, or "" when a manifest is not cached.
+func resolveCached(cache *Cache, root, entryPath string) string {
+	if entryPath == "" {
+		return root
+	}
+	if cache == nil {
+		return ""
+	}
+
+	hash := root
+	for _, name := range strings.Split(entryPath, "/") {
+		file, found := cache.Open(hash)
+		if !found {
+			return ""
+		}
+		var manifest models.Manifest
+		err := json.NewDecoder(io.LimitReader(file, maxManifestSize)).Decode(&manifest)
+		file.Close()
+		if err != nil {
+			return ""
+		}
+
+		hash = ""
+		for _, entry := range manifest.Entries {
+			if entry.Name == name {
+				hash = entry.Hash
+				break
+			}
+		}
+		if hash == "" {
+			return ""
+		}
+	}
+	return hash
+}
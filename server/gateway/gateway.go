@@ -1,21 +1,155 @@
+/*
+The gateway serves share links over HTTP so anyone with a link can open a shared file in a
+browser. It listens on the address in the Gateway table, over TLS when a certificate is set or
+self-signed certificates are enabled. Reload restarts it when its settings change, and links are
+generated against its public base URL so they work for others, not only on this machine.
+
+Links name content by hash under /content/<hash>. The gateway tries the peer that issued the
+link first, then the providers of the hash in the DHT, which serve it if they host it for free.
+Requests are rate limited per client and per link, see limit.go.
+*/
+
 package gateway
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"server/database/models"
+	"server/database/operations"
 
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
+// How long open requests are given to finish when the gateway restarts
+const drainTimeout = 5 * time.Second
+
+// How long clients are given to send the headers of a request
+const headerTimeout = 10 * time.Second
+
+var (
+	gatewayHandler http.Handler
+	gatewayServer  *http.Server
+	gatewayMutex   sync.Mutex
+)
+
 // HTTP server
 func Gateway(node host.Host, db *sql.DB) {
-	http.HandleFunc("/viewfile", func(w http.ResponseWriter, r *http.Request) {
-		viewFileHandler(w, r, node)
+	// Without a cache every request is fetched from the sharing peer
+	cache, err := NewCache(cacheDir, cacheSize)
+	if err != nil {
+		log.Printf("Gateway cache disabled: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/viewfile", func(w http.ResponseWriter, r *http.Request) {
+		viewFileHandler(w, r, node, cache)
+	})
+	mux.HandleFunc("/content/", func(w http.ResponseWriter, r *http.Request) {
+		contentHandler(w, r, node, cache)
 	})
 
-	fmt.Println("Starting server on http://localhost:3002")
-	if err := http.ListenAndServe(":3002", nil); err != nil {
-		panic(fmt.Sprintf("Server failed: %s", err))
+	gatewayMutex.Lock()
+	gatewayHandler = limitRequests(mux)
+	gatewayMutex.Unlock()
+
+	err = Reload(db)
+	if err != nil {
+		log.Printf("Gateway failed to start: %v", err)
+	}
+}
+
+// ValidateSettings checks the settings of the gateway before they are stored.
+func ValidateSettings(settings models.Gateway) error {
+	_, _, err := net.SplitHostPort(settings.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", settings.Listen, err)
+	}
+
+	baseURL, err := url.Parse(settings.BaseURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return fmt.Errorf("base URL must be an absolute http or https URL")
+	}
+	if baseURL.RawQuery != "" || baseURL.Fragment != "" {
+		return fmt.Errorf("base URL must not have a query or fragment")
+	}
+
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return fmt.Errorf("a TLS certificate needs both a certificate and a key file")
 	}
+	if settings.CertFile != "" && settings.SelfSigned {
+		return fmt.Errorf("choose either a TLS certificate or self-signed certificates")
+	}
+
+	if settings.ClientLimit < 0 || settings.TokenLimit < 0 || settings.MaxFetches < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if settings.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
+
+// Reload restarts the gateway with the settings in the Gateway table.
+func Reload(db *sql.DB) error {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+
+	if gatewayHandler == nil {
+		return fmt.Errorf("gateway is not initialized")
+	}
+
+	settings, err := operations.GetGateway(db)
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		return fmt.Errorf("gateway settings not found")
+	}
+
+	tlsConfig, err := loadTLSConfig(*settings)
+	if err != nil {
+		return err
+	}
+	applyLimits(*settings)
+
+	// The old server has to let go of its address before it can be listened on again
+	if gatewayServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		err = gatewayServer.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			gatewayServer.Close()
+		}
+		gatewayServer = nil
+	}
+
+	listener, err := net.Listen("tcp", settings.Listen)
+	if err != nil {
+		return fmt.Errorf("error listening on %s for the gateway: %v", settings.Listen, err)
+	}
+
+	server := &http.Server{Handler: gatewayHandler, TLSConfig: tlsConfig, ReadHeaderTimeout: headerTimeout}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Gateway failed: %v", err)
+		}
+	}()
+	gatewayServer = server
+
+	fmt.Printf("Gateway is running on %s, links point to %s\n", listener.Addr(), settings.BaseURL)
+	return nil
 }
@@ -1,41 +1,433 @@
 package gateway
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
+	"server/database/models"
 	"server/p2p"
+	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
-// /viewfile route:
-func viewFileHandler(w http.ResponseWriter, r *http.Request, node host.Host) {
-	address := r.URL.Query().Get("address")
-	hash := r.URL.Query().Get("hash")
-	password := r.URL.Query().Get("password")
+// Bytes looked at to detect the type of a file without a known extension
+const sniffLen = 512
+
+// How long a provider is given to answer before the next one is tried
+const providerTimeout = 15 * time.Second
+
+// HTTP status of each reason a share request is refused
+var shareStatus = map[string]int{
+	p2p.ShareNotFound:     http.StatusNotFound,
+	p2p.ShareInvalid:      http.StatusForbidden,
+	p2p.ShareRevoked:      http.StatusGone,
+	p2p.ShareExpired:      http.StatusGone,
+	p2p.ShareExhausted:    http.StatusGone,
+	p2p.ShareNeedsPayment: http.StatusPaymentRequired,
+}
+
+// Cookie the session of a download is kept in, so the ranges a browser fetches
+// later in the same download do not count against the share link again
+const sessionCookie = "sharesession"
 
-	if address == "" || hash == "" || password == "" {
+// A peer content can be fetched from, with the token to present to it
+type contentSource struct {
+	peer  string
+	token string
+}
+
+// /viewfile route:
+func viewFileHandler(w http.ResponseWriter, r *http.Request, node host.Host, cache *Cache) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
 
-	// read file bytes:
-	name, data, ext, err := p2p.SendRequest(node, address, hash, password)
+	capability, ok := checkToken(w, token)
+	if !ok {
+		return
+	}
+
+	if capability.Content != "" {
+		serveEncrypted(w, r, node, cache, capability, token)
+		return
+	}
+	serveContent(w, r, node, cache, capability.Hash, []contentSource{{peer: capability.Issuer, token: token}})
+}
+
+// /content/<hash> route:
+func contentHandler(w http.ResponseWriter, r *http.Request, node host.Host, cache *Cache) {
+	hash := strings.TrimPrefix(r.URL.Path, "/content/")
+	if !validHash(hash) {
+		http.Error(w, "invalid content hash", http.StatusBadRequest)
+		return
+	}
+
+	// A share link is tried with the peer that issued it first, any other peer
+	// only serves the content if it hosts it publicly
+	var sources []contentSource
+	token := r.URL.Query().Get("token")
+	if token != "" {
+		capability, ok := checkToken(w, token)
+		if !ok {
+			return
+		}
+		if capability.Hash != hash {
+			http.Error(w, "share link is for other content", http.StatusForbidden)
+			return
+		}
+
+		// Only the issuer has the encrypted copy, other providers would send the file in the clear
+		if capability.Content != "" {
+			serveEncrypted(w, r, node, cache, capability, token)
+			return
+		}
+		sources = append(sources, contentSource{peer: capability.Issuer, token: token})
+	}
+
+	providers, err := findProviders(r, node, hash)
+	if err != nil && len(sources) == 0 {
+		fetchFailed(w, err)
+		return
+	}
+	for _, provider := range providers {
+		if token == "" || provider != sources[0].peer {
+			sources = append(sources, contentSource{peer: provider})
+		}
+	}
+
+	if len(sources) == 0 {
+		http.Error(w, "no providers found for content", http.StatusNotFound)
+		return
+	}
+
+	serveContent(w, r, node, cache, hash, sources)
+}
+
+// checkToken refuses forged or expired share link tokens before any p2p request
+// is made. The token names the sharing peer and the file, and is signed by that peer.
+func checkToken(w http.ResponseWriter, token string) (models.ShareCapability, bool) {
+	capability, err := p2p.ParseCapability(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return capability, false
+	}
+	if capability.Expiry != 0 && time.Now().Unix() >= capability.Expiry {
+		http.Error(w, "share link expired", http.StatusGone)
+		return capability, false
+	}
+	return capability, allowToken(w, capability)
+}
+
+// findProviders looks up the peers that provide content in the DHT. The lookup
+// opens streams to many peers, so it takes a fetch slot while it runs.
+func findProviders(r *http.Request, node host.Host, hash string) ([]string, error) {
+	ctx, cancel := answerContext(r)
+	defer cancel()
+
+	release, err := acquireFetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, cancelLookup := context.WithTimeout(ctx, lookupTimeout)
+	defer cancelLookup()
+	providers, err := p2p.FindProviderIDs(ctx, node, hash)
+	if err != nil {
+		log.Printf("Error finding providers of %s: %v", hash, err)
+	}
+	return providers, err
+}
+
+// fetchContent asks each source for the content in turn and returns the answer
+// of the first that serves it. When none does, the refusal of the first source
+// that answered is returned. Each fetch holds a fetch slot until its body is closed.
+func fetchContent(r *http.Request, node host.Host, sources []contentSource, request models.ShareRequest) (models.ShareResponse, io.ReadCloser, contentSource, error) {
+	var refused *models.ShareResponse
+	var refusedBy contentSource
+	var lastErr error
+
+	answerCtx, cancelAnswer := answerContext(r)
+	defer cancelAnswer()
+
+	for _, source := range sources {
+		release, err := acquireFetch(answerCtx)
+		if err != nil {
+			lastErr = err
+			break
+		}
+		request.Token = source.token
+
+		// The timeouts only cover the answer, the content streams for as long as the client reads it
+		timeout := providerTimeout
+		if deadline, found := answerCtx.Deadline(); found && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		timer := time.AfterFunc(timeout, cancel)
+		response, body, err := p2p.FetchShare(ctx, node, source.peer, request)
+		if !timer.Stop() && err == nil {
+			err = fmt.Errorf("peer %s did not answer in time", source.peer)
+			body.Close()
+		}
+		if err != nil {
+			log.Printf("Error fetching %s from peer %s: %v", request.Hash, source.peer, err)
+			cancel()
+			release()
+			lastErr = err
+			if answerCtx.Err() == context.DeadlineExceeded {
+				lastErr = errRequestTimeout
+				break
+			}
+			continue
+		}
+
+		if response.Result == p2p.ShareOK || response.Result == p2p.ShareUnsatisfiable {
+			return response, &fetchBody{ReadCloser: body, release: release}, source, nil
+		}
+
+		body.Close()
+		cancel()
+		release()
+		if refused == nil {
+			refused, refusedBy = &response, source
+		}
+	}
+
+	if refused != nil {
+		return *refused, io.NopCloser(strings.NewReader("")), refusedBy, nil
+	}
+	return models.ShareResponse{}, nil, contentSource{}, lastErr
+}
+
+// refuseContent answers with the reason a source refused to serve content.
+func refuseContent(w http.ResponseWriter, response models.ShareResponse, source contentSource) {
+	status, found := shareStatus[response.Result]
+	if !found {
+		status = http.StatusBadGateway
+	}
+	if response.Result == p2p.ShareNeedsPayment {
+		http.Error(w, fmt.Sprintf("content costs %f BTC, download it from peer %s in the app", response.Price, source.peer), status)
+		return
+	}
+	if source.token == "" {
+		http.Error(w, fmt.Sprintf("content refused: %s", response.Result), status)
+		return
+	}
+	http.Error(w, fmt.Sprintf("share link refused: %s", response.Result), status)
+}
+
+// serveContent streams content, or an entry of a folder, from the first of its
+// sources that serves it.
+func serveContent(w http.ResponseWriter, r *http.Request, node host.Host, cache *Cache, hash string, sources []contentSource) {
+	// A shared folder is browsed by the path of an entry in it, and can be
+	// downloaded whole as an archive
+	entryPath := strings.Trim(r.URL.Query().Get("path"), "/")
+	archive := r.URL.Query().Get("archive")
+	if archive != "" && archiveTypes[archive] == "" {
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	// The hash of the entry is known without asking the peer when the manifests
+	// leading to it are cached
+	entryHash := resolveCached(cache, hash, entryPath)
+
+	request := models.ShareRequest{
+		Hash:    hash,
+		Path:    entryPath,
+		Archive: archive,
+		Head:    r.Method == http.MethodHead,
+		Session: downloadSession(r),
+	}
+	if archive == "" {
+		request.Range = r.Header.Get("Range")
+		request.IfRange = r.Header.Get("If-Range")
+		if entryHash != "" && etagMatches(r.Header.Get("If-None-Match"), fmt.Sprintf("\"%s\"", entryHash)) {
+			request.Head = true
+		}
+	}
+
+	// Cached content is still only served once the sharing peer accepts the token
+	var cached *os.File
+	if cache != nil && entryHash != "" && archive == "" && !request.Head {
+		cached, request.Cached = cache.Open(entryHash)
+	}
+	if cached != nil {
+		defer cached.Close()
+	}
+
+	response, body, source, err := fetchContent(r, node, sources, request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fetchFailed(w, err)
+		return
+	}
+	defer body.Close()
+
+	switch response.Result {
+	case p2p.ShareOK:
+	case p2p.ShareUnsatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", response.Size))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
 		return
-	} else {
-		// detect file type:
-		var contentType string
-		if ext == "" {
-			contentType = "application/octet-stream"
+	default:
+		refuseContent(w, response, source)
+		return
+	}
+	if cached != nil && response.Hash != entryHash {
+		http.Error(w, "shared content does not match its manifest", http.StatusBadGateway)
+		return
+	}
+	keepDownloadSession(w, r, response)
+
+	if archive != "" {
+		serveArchive(w, body, response, request.Head)
+		return
+	}
+
+	// Content never changes for a hash, so the hash is a strong ETag
+	etag := fmt.Sprintf("\"%s\"", response.Hash)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if response.Folder {
+		serveFolderIndex(w, body, response, cache, r.URL.Query().Get("token"), entryPath, request.Head)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// Serve the content from the cache, or stream it from the peer while caching
+	// complete transfers
+	var content io.Reader = body
+	var writer *CacheWriter
+	if cached != nil {
+		content = io.NewSectionReader(cached, response.Offset, response.Length)
+	} else if cache != nil && !request.Head && !response.Partial && response.Size <= cache.capacity {
+		writer, err = cache.Create(response.Hash)
+		if err != nil {
+			log.Printf("Error caching file hash %s: %v", response.Hash, err)
 		} else {
-			contentType = ext
+			content = io.TeeReader(body, writer)
 		}
+	}
+
+	// Sniff the type from the start of the file when the extension says nothing
+	reader := bufio.NewReaderSize(content, sniffLen)
+	var head []byte
+	if !request.Head && response.Offset == 0 {
+		head, _ = reader.Peek(sniffLen)
+	}
 
-		// serve the file content:
-		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", name))
-		w.Write(data)
+	setContentHeaders(w, response.Name, contentType(response.Name, response.Extension, head))
+	w.Header().Set("Content-Length", fmt.Sprint(response.Length))
+	if response.Partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", response.Offset, response.Offset+response.Length-1, response.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if request.Head {
+		return
+	}
+
+	// Stream the file as it arrives
+	_, err = io.CopyN(w, reader, response.Length)
+	if err != nil {
+		log.Printf("Error streaming file hash %s from peer %s: %v", response.Hash, source.peer, err)
+	}
+
+	if writer != nil {
+		if err != nil {
+			writer.Abort()
+		} else if err = writer.Commit(); err != nil {
+			log.Printf("Error caching file hash %s: %v", response.Hash, err)
+		}
+	}
+}
+
+// downloadSession returns the session of the download a request continues, if any.
+func downloadSession(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// keepDownloadSession hands the client the session a download was counted under.
+func keepDownloadSession(w http.ResponseWriter, r *http.Request, response models.ShareResponse) {
+	if response.Session == "" || response.Session == downloadSession(r) {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    response.Session,
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setContentHeaders sets the headers of a shared file. Files are served from the
+// origin that holds the share key and session cookies, so they are sandboxed and
+// never sniffed, and files a browser would run as a page are downloaded instead.
+func setContentHeaders(w http.ResponseWriter, name, mediaType string) {
+	disposition := "inline"
+	if activeContent(mediaType) {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+}
+
+// activeContent tells whether a browser could run scripts of a file of a MIME
+// type: HTML, SVG and XML documents.
+func activeContent(mediaType string) bool {
+	base, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return true
+	}
+	return base == "text/html" || base == "application/xhtml+xml" || base == "image/svg+xml" ||
+		base == "text/xml" || base == "application/xml" || strings.HasSuffix(base, "+xml")
+}
+
+// contentType returns the MIME type of a file from its extension or name, then
+// from its first bytes.
+func contentType(name, ext string, head []byte) string {
+	for _, e := range []string{"." + strings.TrimPrefix(ext, "."), filepath.Ext(name)} {
+		if t := mime.TypeByExtension(e); e != "." && t != "" {
+			return t
+		}
+	}
+	if len(head) > 0 {
+		return http.DetectContentType(head)
+	}
+	return "application/octet-stream"
+}
+
+// etagMatches tells whether an If-None-Match header matches an ETag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
 	}
+	return false
 }
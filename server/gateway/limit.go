@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"server/database/models"
+)
+
+/*
+Every gateway request can open several p2p streams, so the gateway limits how often each
+client IP and each share link can be requested, and how many fetches from peers are
+outstanding at once. Requests over a limit get a 429 with a JSON body saying which limit
+they hit and when to retry. The work done before the gateway answers, finding providers,
+waiting for a fetch and waiting for peers to answer, ends at the request timeout.
+*/
+
+// How long a client is asked to wait when every fetch is in use
+const busyRetry = 5 * time.Second
+
+// Longest a lookup of providers in the DHT may take of the request timeout
+const lookupTimeout = 10 * time.Second
+
+var (
+	errGatewayBusy    = errors.New(limitErrors["fetches"])
+	errRequestTimeout = errors.New("no peer answered in time")
+)
+
+// What each limit a request can hit means for the client
+var limitErrors = map[string]string{
+	"client":  "too many requests from this address",
+	"token":   "too many requests for this share link",
+	"fetches": "too many fetches from peers in progress",
+}
+
+// Body of a 429 response
+type limitResponse struct {
+	Error      string `json:"error"`
+	Limit      string `json:"limit"`      // client, token or fetches
+	RetryAfter int64  `json:"retryAfter"` // Seconds
+}
+
+// Bucket of requests a client or link has left, refilled at its limit per minute
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Rate limiter with a bucket for each key that allows bursts of up to a minute of requests
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limit   float64 // Requests per minute, 0 for no limit
+	buckets map[string]*requestBucket
+	swept   time.Time
+}
+
+func (l *rateLimiter) setLimit(limit float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if limit != l.limit {
+		l.limit = limit
+		l.buckets = make(map[string]*requestBucket)
+	}
+}
+
+// Take a request from the bucket of a key, or return how long until it has one.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limit <= 0 {
+		return true, 0
+	}
+	rate := l.limit / 60 // Requests per second
+	now := time.Now()
+
+	// Forget the keys whose buckets have refilled, they are back where new keys start
+	if now.Sub(l.swept) >= time.Minute {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= l.limit {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &requestBucket{tokens: l.limit, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.limit, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+var (
+	clientLimiter  = &rateLimiter{}
+	tokenLimiter   = &rateLimiter{}
+	fetchSlots     chan struct{} // nil for no limit
+	requestTimeout time.Duration
+	limitsMutex    sync.Mutex
+)
+
+// Key of the deadline of a request in its context
+type deadlineKey struct{}
+
+// applyLimits loads the limits in the settings of the gateway. Fetches in
+// progress keep the slot they hold when the cap changes.
+func applyLimits(settings models.Gateway) {
+	clientLimiter.setLimit(float64(settings.ClientLimit))
+	tokenLimiter.setLimit(float64(settings.TokenLimit))
+
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+
+	if settings.MaxFetches <= 0 {
+		fetchSlots = nil
+	} else if fetchSlots == nil || cap(fetchSlots) != int(settings.MaxFetches) {
+		fetchSlots = make(chan struct{}, settings.MaxFetches)
+	}
+	requestTimeout = time.Duration(settings.Timeout) * time.Second
+}
+
+// limitRequests refuses clients over their rate limit and gives the others a
+// deadline to be answered by.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retry := clientLimiter.allow(clientKey(r))
+		if !allowed {
+			tooManyRequests(w, "client", retry)
+			return
+		}
+
+		limitsMutex.Lock()
+		timeout := requestTimeout
+		limitsMutex.Unlock()
+
+		if timeout > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), deadlineKey{}, time.Now().Add(timeout)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey returns the key a client is rate limited by. Clients are told apart
+// by the address they connect from, as forwarded addresses can be made up. IPv6
+// clients usually hold a whole /64, so it is limited as one client.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return host
+}
+
+// allowToken refuses a share link that is over its rate limit.
+func allowToken(w http.ResponseWriter, capability models.ShareCapability) bool {
+	allowed, retry := tokenLimiter.allow(capability.Issuer + "/" + capability.ID)
+	if !allowed {
+		tooManyRequests(w, "token", retry)
+	}
+	return allowed
+}
+
+// answerContext returns a context for the work done before the gateway answers a
+// request, which ends with the request or at its deadline.
+func answerContext(r *http.Request) (context.Context, context.CancelFunc) {
+	deadline, found := r.Context().Value(deadlineKey{}).(time.Time)
+	if !found {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithDeadline(r.Context(), deadline)
+}
+
+// acquireFetch waits for a free slot to fetch from a peer and returns the
+// function that frees it, which can be called more than once.
+func acquireFetch(ctx context.Context) (func(), error) {
+	limitsMutex.Lock()
+	slots := fetchSlots
+	limitsMutex.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-slots }) }, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errGatewayBusy
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Body of a fetch that frees its slot when it is closed
+type fetchBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *fetchBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// tooManyRequests answers a request that is over a limit.
+func tooManyRequests(w http.ResponseWriter, limit string, retry time.Duration) {
+	seconds := int64(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(limitResponse{
+		Error:      limitErrors[limit],
+		Limit:      limit,
+		RetryAfter: seconds,
+	})
+}
+
+// fetchFailed answers a request that no peer could be fetched from.
+func fetchFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errGatewayBusy):
+		tooManyRequests(w, "fetches", busyRetry)
+	case errors.Is(err, errRequestTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"server/database/models"
+)
+
+// How long a generated self-signed certificate is valid
+const selfSignedValidity = 90 * 24 * time.Hour
+
+// loadTLSConfig returns the TLS configuration of the gateway, or nil to serve plain HTTP.
+func loadTLSConfig(settings models.Gateway) (*tls.Config, error) {
+	if settings.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	if settings.SelfSigned {
+		certificates := &selfSignedCertificates{certificates: map[string]*tls.Certificate{}}
+		return &tls.Config{GetCertificate: certificates.get, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	return nil, nil
+}
+
+// selfSignedCertificates generates a certificate for each name the gateway is
+// reached by when it is first asked for, the way autocert does, but signs it
+// itself. Browsers warn about them, so they are only meant for testing.
+type selfSignedCertificates struct {
+	certificates map[string]*tls.Certificate
+	mutex        sync.Mutex
+}
+
+func (c *selfSignedCertificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		name = "localhost" // Clients do not send IP addresses as server names
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	certificate, found := c.certificates[name]
+	if found && time.Now().Before(certificate.Leaf.NotAfter) {
+		return certificate, nil
+	}
+
+	certificate, err := generateCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+	c.certificates[name] = certificate
+	return certificate, nil
+}
+
+// generateCertificate creates a self-signed certificate for a host name, also
+// valid for the loopback addresses.
+func generateCertificate(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -74,6 +74,8 @@ func main() {
 		btc.InterruptCmd(btcdCmd)
 	}()
 
+	go btc.WatchTransactions(btcd, btcwallet, db)
+
 	node, dht, err := p2p.P2PSync()
 	if err != nil {
 		log.Println(err)
@@ -87,4 +89,7 @@ func main() {
 
 	// Blocks until a signal is received
 	<-sigs
+
+	// Drains the proxy and logs its remaining usage before the database is closed
+	proxy.Shutdown()
 }
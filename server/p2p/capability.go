@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/database/models"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Permissions a share link token can grant
+const PermRead = "read"
+
+// IssueCapability signs the claims of a share link with the node key and returns
+// the token: the base64 claims and the base64 signature joined by a dot. The node
+// key is Ed25519, so the same claims always give the same token.
+func IssueCapability(node host.Host, capability models.ShareCapability) (string, error) {
+	claims, err := json.Marshal(capability)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token claims: %v", err)
+	}
+
+	signature, err := node.Peerstore().PrivKey(node.ID()).Sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token claims: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(claims) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseCapability checks the signature of a token against the public key of its
+// issuer and returns its claims. It needs no database lookup.
+func ParseCapability(token string) (models.ShareCapability, error) {
+	var capability models.ShareCapability
+
+	encodedClaims, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return capability, fmt.Errorf("malformed token")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(encodedClaims)
+	if err != nil {
+		return capability, fmt.Errorf("malformed token claims: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return capability, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	err = json.Unmarshal(claims, &capability)
+	if err != nil {
+		return capability, fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	issuerID, err := peer.Decode(capability.Issuer)
+	if err != nil {
+		return capability, fmt.Errorf("invalid issuer in token: %v", err)
+	}
+
+	pubKey, err := issuerID.ExtractPublicKey()
+	if err != nil {
+		return capability, fmt.Errorf("failed to get public key of issuer: %v", err)
+	}
+
+	valid, err := pubKey.Verify(claims, signature)
+	if err != nil || !valid {
+		return capability, fmt.Errorf("invalid token signature")
+	}
+
+	return capability, nil
+}
+
+// VerifyCapability checks a token for a permission on a file shared by the given
+// issuer and returns its claims with the result of the check.
+func VerifyCapability(token, issuer, fileHash, permission string) (models.ShareCapability, string) {
+	capability, err := ParseCapability(token)
+	if err != nil || capability.Issuer != issuer || capability.Hash != fileHash {
+		return capability, ShareInvalid
+	}
+	if !hasPermission(capability.Permissions, permission) {
+		return capability, ShareInvalid
+	}
+	if capability.Expiry != 0 && time.Now().Unix() >= capability.Expiry {
+		return capability, ShareExpired
+	}
+	return capability, ShareOK
+}
+
+// HashToken returns the hash under which a token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RedactToken shortens a token so it can be logged without granting access.
+func RedactToken(token string) string {
+	if len(token) <= 8 {
+		return "[redacted]"
+	}
+	return token[:8] + "...[redacted]"
+}
+
+// hasPermission tells whether a comma separated list of permissions contains one.
+func hasPermission(permissions, permission string) bool {
+	for _, p := range strings.Split(permissions, ",") {
+		if strings.TrimSpace(p) == permission {
+			return true
+		}
+	}
+	return false
+}
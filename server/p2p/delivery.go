@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+A paid download arrives on several streams: in pay-on-delivery mode a part of the file is released
+before the invoice, and the rest once the payment is received, or a note that it was not. Each of them
+carries the address of the invoice, so concurrent downloads are kept apart by keying them on the peer
+and that address.
+*/
+
+// How long parts of deliveries nobody waits for are kept
+const paidDeliveryMax = time.Hour
+
+// How long a peer that does not say how long it waits for payments is waited for
+const defaultPaymentTimeout = 10 * time.Minute
+
+// Time allowed to transfer the rest of a file after the payment timeout
+const paidDeliveryGrace = 5 * time.Minute
+
+// Result of a paid download
+type deliveryResult struct {
+	data []byte
+	err  error
+}
+
+// Paid download in progress, keyed by the peer and the address of its invoice
+type paidDelivery struct {
+	part    []byte              // Part of the file released before payment
+	result  chan deliveryResult // Whole file or failure, holds a single result
+	waiting bool                // Whether a download waits for the result
+	started time.Time
+}
+
+var (
+	paidDeliveries      = make(map[string]*paidDelivery)
+	paidDeliveriesMutex sync.Mutex
+)
+
+// paidDeliveryFor returns the delivery of the invoice of a peer to an address, starting it if
+// needed. The caller must hold paidDeliveriesMutex.
+func paidDeliveryFor(peerID, address string) *paidDelivery {
+	key := peerID + "/" + address
+	now := time.Now()
+	for stale, delivery := range paidDeliveries {
+		if !delivery.waiting && now.Sub(delivery.started) > paidDeliveryMax {
+			delete(paidDeliveries, stale)
+		}
+	}
+
+	delivery, exists := paidDeliveries[key]
+	if !exists {
+		delivery = &paidDelivery{result: make(chan deliveryResult, 1), started: now}
+		paidDeliveries[key] = delivery
+	}
+	return delivery
+}
+
+// waitPaidDelivery registers a download waiting for the delivery of the invoice of a peer to an
+// address and returns the channel its result arrives on.
+func waitPaidDelivery(peerID, address string) <-chan deliveryResult {
+	paidDeliveriesMutex.Lock()
+	defer paidDeliveriesMutex.Unlock()
+
+	delivery := paidDeliveryFor(peerID, address)
+	delivery.waiting = true
+	return delivery.result
+}
+
+// endPaidDelivery forgets the delivery of the invoice of a peer to an address.
+func endPaidDelivery(peerID, address string) {
+	paidDeliveriesMutex.Lock()
+	defer paidDeliveriesMutex.Unlock()
+
+	delete(paidDeliveries, peerID+"/"+address)
+}
+
+// receivePaidFilePart keeps the part of a file a peer released before its invoice to an address is paid.
+func receivePaidFilePart(peerID, address string, data []byte) {
+	paidDeliveriesMutex.Lock()
+	defer paidDeliveriesMutex.Unlock()
+
+	paidDeliveryFor(peerID, address).part = data
+}
+
+// receivePaidFileRest puts the rest of a file after the part released before payment, and checks
+// the whole file against the digest the peer sent.
+func receivePaidFileRest(peerID, address, digest string, data []byte) {
+	paidDeliveriesMutex.Lock()
+	part := paidDeliveryFor(peerID, address).part
+	paidDeliveriesMutex.Unlock()
+
+	file := make([]byte, 0, len(part)+len(data))
+	file = append(append(file, part...), data...)
+
+	sum := sha256.Sum256(file)
+	if hex.EncodeToString(sum[:]) != digest {
+		finishPaidDelivery(peerID, address, nil, fmt.Errorf("received file does not match its digest"))
+		return
+	}
+	finishPaidDelivery(peerID, address, file, nil)
+}
+
+// finishPaidDelivery hands the result of the delivery of the invoice of a peer to an address to the
+// download waiting for it. A delivery already finished keeps its first result.
+func finishPaidDelivery(peerID, address string, data []byte, err error) {
+	paidDeliveriesMutex.Lock()
+	delivery := paidDeliveryFor(peerID, address)
+	delivery.part = nil
+	paidDeliveriesMutex.Unlock()
+
+	select {
+	case delivery.result <- deliveryResult{data: data, err: err}:
+	default:
+	}
+}
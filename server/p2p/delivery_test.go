@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// Parts of concurrent paid downloads from a peer are each put together with
+// the rest of their own file.
+func TestPaidDeliveriesAreKeyedByInvoice(t *testing.T) {
+	files := map[string][]byte{
+		"address-a": []byte("first file released in two parts"),
+		"address-b": []byte("second file, released in two parts as well"),
+	}
+
+	results := make(map[string]<-chan deliveryResult)
+	for address, file := range files {
+		results[address] = waitPaidDelivery("peer", address)
+		defer endPaidDelivery("peer", address)
+		receivePaidFilePart("peer", address, file[:5])
+	}
+	for address, file := range files {
+		sum := sha256.Sum256(file)
+		receivePaidFileRest("peer", address, hex.EncodeToString(sum[:]), file[5:])
+	}
+
+	for address, file := range files {
+		result := <-results[address]
+		if result.err != nil || string(result.data) != string(file) {
+			t.Fatalf("delivery to %s: got %q and error %v", address, result.data, result.err)
+		}
+	}
+}
+
+// A file that does not match the digest sent with its rest is refused.
+func TestPaidDeliveryChecksDigest(t *testing.T) {
+	result := waitPaidDelivery("peer", "address")
+	defer endPaidDelivery("peer", "address")
+
+	receivePaidFilePart("peer", "address", []byte("part of another file "))
+	sum := sha256.Sum256([]byte("part of this file and its rest"))
+	receivePaidFileRest("peer", "address", hex.EncodeToString(sum[:]), []byte("and its rest"))
+
+	if (<-result).err == nil {
+		t.Fatal("file that does not match its digest was delivered")
+	}
+
+	// Later results of a finished delivery do not block
+	finishPaidDelivery("peer", "address", nil, nil)
+}
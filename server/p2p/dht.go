@@ -11,12 +11,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"server/database/models"
 	"server/database/operations"
+	"server/proxy"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/btcsuite/btcd/rpcclient"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/multiformats/go-multibase"
@@ -193,7 +194,7 @@ func periodicTaskHelper(interval time.Duration, db *sql.DB) {
 	}
 }
 
-// Function to provide all keys from the Hosting table
+// Function to provide all keys from the Hosting table, and the PROXY key while a proxy offer is enabled
 func provideAllKeys(db *sql.DB) error {
 	// Retrieve all hosting records
 	hostingRecords, err := operations.GetAllHosting(db)
@@ -208,10 +209,23 @@ func provideAllKeys(db *sql.DB) error {
 			log.Printf("Error providing key for hash %s: %v\n", record.Hash, err)
 		}
 	}
+
+	// The PROXY provider record expires once it is no longer provided
+	offers, err := proxy.EnabledOffers(db)
+	if err != nil {
+		return fmt.Errorf("error retrieving proxy offers: %v", err)
+	}
+	if len(offers) > 0 {
+		err := ProvideKey("PROXY")
+		if err != nil {
+			log.Printf("Error providing key PROXY: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
-func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.DB) {
+func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.DB, btcwallet *rpcclient.Client) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print("User Input \n ")
 	for {
@@ -233,17 +247,38 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 			}
 			peerID := args[1]
 
-			// Create a ProxyBill instance with sample data
-			proxyBill := models.ProxyBill{
-				IP:     "192.168.1.100",
-				Rate:   0.02,
-				Bytes:  2048,
-				Amount: 0.04,
-				Wallet: "0xABCDEF1234567890",
+			// Bill sample usage unless a byte count is given
+			bytes := int64(2048)
+			if len(args) > 2 {
+				parsed, err := strconv.ParseInt(args[2], 10, 64)
+				if err != nil {
+					fmt.Println("Invalid byte count, please provide a valid number")
+					continue
+				}
+				bytes = parsed
+			}
+
+			// Bill at the rate of the given offer, or of the cheapest enabled offer
+			offer, err := proxy.FindOffer(db, 0, "")
+			if len(args) > 3 {
+				id, parseErr := strconv.ParseInt(args[3], 10, 64)
+				if parseErr != nil {
+					fmt.Println("Invalid offer, please provide a valid id")
+					continue
+				}
+				offer, err = proxy.FindOffer(db, id, "")
+			}
+			if err != nil {
+				fmt.Printf("Error finding proxy offer: %v\n", err)
+				continue
 			}
 
-			// Call the new function to send the ProxyBill and wait for confirmation
-			err := SendProxyBillWithConfirmation(node, peerID, proxyBill)
+			// Send the ProxyBill with a fresh receive address and wait for confirmation
+			biller := &proxyBiller{node: node, btcwallet: btcwallet, db: db}
+			proxyBill, err := biller.NewBill(peerID, offer.Rate, bytes)
+			if err == nil {
+				err = biller.SendBill(peerID, proxyBill)
+			}
 			if err != nil {
 				fmt.Printf("Error during ProxyBill transaction: %v\n", err)
 			} else {
@@ -286,13 +321,19 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 			}
 
 		case "UPDATE_PROXY":
-			// Random test data for the Proxy table
+			// Random test data for the Proxy and ProxyOffers tables
 			ip := "192.168.0.100"
 			rate := 50.0
 			address := "123"
 
-			// Call the UpdateProxy function with the random test data
-			err := operations.UpdateProxy(db, ip, rate, node_id, address)
+			// Call the UpdateProxy and AddProxyOffers functions with the random test data
+			err := operations.UpdateProxy(db, node_id, address)
+			if err == nil {
+				err = operations.AddProxyOffers(db, proxy.ProtocolSOCKS5, ip, proxy.SOCKSPort, "", rate, true)
+			}
+			if err == nil {
+				err = proxy.Reload(db)
+			}
 			if err != nil {
 				fmt.Printf("Error updating proxy: %v\n", err)
 			} else {
@@ -301,7 +342,7 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 
 		case "PROXY":
 			// Call the handleProxyRequest function
-			proxies, err := RandomProxiesInfo(node)
+			proxies, err := RandomProxiesInfo(node, db)
 			if err != nil {
 				log.Fatalf("Error handling proxy request: %v", err)
 			}
@@ -321,21 +362,22 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 
 		case "FIND_SHARING":
 			if len(args) < 2 {
-				fmt.Println("Usage: FIND <hash>")
+				fmt.Println("Usage: FIND_SHARING <hash>")
 				continue
 			}
 			hash := args[1] // Extract the hash from the user input
-			sharing, err := operations.FindSharing(db, hash)
+			links, err := operations.GetSharingLinks(db, hash)
 			if err != nil {
-				fmt.Printf("Error finding sharing record for hash %s: %v\n", hash, err)
+				fmt.Printf("Error finding share links for hash %s: %v\n", hash, err)
 				continue
 			}
 
-			if sharing == nil {
-				fmt.Printf("No record found for hash %s\n", hash)
-			} else {
-				fmt.Printf("Record found:\nHash: %s\nName: %s\nExtension: %s\nSize: %d bytes\nPath: %s\nDate: %s\nPassword: %s\n",
-					sharing.Hash, sharing.Name, sharing.Extension, sharing.Size, sharing.Path, sharing.Date, sharing.Password)
+			if len(links) == 0 {
+				fmt.Printf("No share links found for hash %s\n", hash)
+			}
+			for _, link := range links {
+				fmt.Printf("Link %d: Label: %s Created: %d Expiry: %d Downloads: %d/%d Revoked: %t\n",
+					link.ID, link.Label, link.Created, link.Expiry, link.Downloads, link.MaxDownloads, link.Revoked)
 			}
 
 		case "CONNECT":
@@ -371,7 +413,7 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 			fileHash := args[1]
 
 			// Delete file metadata from the Storing table
-			err := operations.DeleteSharing(db, fileHash)
+			err := DeleteLinks(db, fileHash)
 			if err != nil {
 				fmt.Printf("Error deleting file with hash %s: %v\n", fileHash, err)
 				continue
@@ -382,14 +424,24 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 			printPeerList()
 		case "GENERATE_LINK":
 			if len(args) < 2 {
-				fmt.Println("Usage: GENERATE_LINK <file_hash>")
+				fmt.Println("Usage: GENERATE_LINK <file_hash> [max_downloads] [expiry_hours] [encrypted]")
 				continue
 			}
 
 			fileHash := args[1]
 
+			var maxDownloads, expiry int64
+			if len(args) > 2 {
+				maxDownloads, _ = strconv.ParseInt(args[2], 10, 64)
+			}
+			if len(args) > 3 {
+				hours, _ := strconv.ParseInt(args[3], 10, 64)
+				expiry = time.Now().Add(time.Duration(hours) * time.Hour).Unix()
+			}
+			encrypted := len(args) > 4 && args[4] == "encrypted"
+
 			// Generate a shareable link for the file using the hash
-			link, err := GenerateLink(db, node, fileHash)
+			link, err := GenerateLink(db, node, fileHash, "", expiry, maxDownloads, encrypted)
 			if err != nil {
 				fmt.Printf("Error generating link for file hash %s: %v\n", fileHash, err)
 				continue
@@ -501,8 +553,16 @@ func handleInput(ctx context.Context, dht *dht.IpfsDHT, node host.Host, db *sql.
 			// Log the test command
 			fmt.Printf("Testing SEND_DOWNLOAD_REQUEST with target peer: %s and hash: %s\n", targetPeerID, hash)
 
+			// Get a quote for the download
+			quote, err := RequestQuote(node, targetPeerID, hash)
+			if err != nil {
+				fmt.Printf("Failed to get quote: %v\n", err)
+				continue
+			}
+			fmt.Printf("Quoted price: %v to address %s\n", quote.Price, quote.Address)
+
 			// Call the SimplyDownload function
-			name, data, ext, walletAddress, err := SimplyDownload(node, targetPeerID, hash)
+			name, data, ext, walletAddress, err := SimplyDownload(node, targetPeerID, hash, quote.Nonce, nil)
 
 			if err != nil {
 				fmt.Printf("Failed to send download request: %v\n", err)
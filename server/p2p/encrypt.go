@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+Encrypted links serve a copy of the file encrypted with a random key that is only
+kept in the link. The copy is split into chunks of EncryptedChunkSize bytes, each
+sealed with AES-256-GCM under a nonce made of its index and a flag marking the last
+chunk, so chunks cannot be reordered or dropped and any chunk can be decrypted on
+its own to serve a range. An empty file is a single empty last chunk.
+
+Every encrypted link keeps its own copy, as large as the file plus 16 bytes for
+each chunk, so encrypting a file for n links takes n times its size on disk. The
+copy is removed when the link is revoked or deleted, and within the hour after it
+expires or has been used up.
+*/
+
+// Bytes of the file in each chunk of an encrypted copy
+const EncryptedChunkSize = 64 << 10 // 64 KiB
+
+// Bytes each chunk grows by when it is sealed
+const encryptedChunkOverhead = 16
+
+// Bytes of an encrypted chunk, with its tag
+const EncryptedChunkLen = EncryptedChunkSize + encryptedChunkOverhead
+
+// Size of the keys of encrypted links
+const shareKeySize = 32
+
+// Folder the encrypted copies of files shared with encrypted links are kept in
+const encryptedDir = "./shares"
+
+// encryptedPath returns where the encrypted copy of a link is kept.
+func encryptedPath(tokenID string) string {
+	return filepath.Join(encryptedDir, tokenID)
+}
+
+// EncryptedSize returns the size of the encrypted copy of a file.
+func EncryptedSize(size int64) int64 {
+	chunks := (size + EncryptedChunkSize - 1) / EncryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*encryptedChunkOverhead
+}
+
+// DecryptedSize returns the size of a file from the size of its encrypted copy.
+func DecryptedSize(size int64) int64 {
+	chunks := (size + EncryptedChunkLen - 1) / EncryptedChunkLen
+	return size - chunks*encryptedChunkOverhead
+}
+
+// EncodeShareKey and DecodeShareKey convert a key to and from the form it has in links.
+func EncodeShareKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func DecodeShareKey(encoded string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(key) != shareKeySize {
+		return nil, fmt.Errorf("invalid decryption key")
+	}
+	return key, nil
+}
+
+// chunkNonce returns the nonce a chunk is sealed with. Every key seals a single
+// copy, so the index alone keeps nonces unique.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptFile writes an encrypted copy of a file under a new random key and
+// returns the key with the hash of the copy.
+func encryptFile(source, destination string) ([]byte, string, error) {
+	key := make([]byte, shareKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open file: %v", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(destination), 0700)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create folder for encrypted copy: %v", err)
+	}
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create encrypted copy: %v", err)
+	}
+
+	hasher := sha256.New()
+	writer := io.MultiWriter(out, hasher)
+	chunk := make([]byte, EncryptedChunkSize)
+	sealed := make([]byte, 0, EncryptedChunkLen)
+	chunks := (EncryptedSize(info.Size()) + EncryptedChunkLen - 1) / EncryptedChunkLen
+
+	for index := int64(0); index < chunks && err == nil; index++ {
+		var n int
+		n, err = io.ReadFull(in, chunk)
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && index == chunks-1) {
+			err = nil
+		}
+		if err == nil {
+			sealed = aead.Seal(sealed[:0], chunkNonce(index, index == chunks-1), chunk[:n], nil)
+			_, err = writer.Write(sealed)
+		}
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(destination)
+		return nil, "", fmt.Errorf("failed to write encrypted copy: %v", err)
+	}
+
+	return key, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Decrypter reads the file back from chunks of its encrypted copy.
+type Decrypter struct {
+	source io.Reader
+	aead   cipher.AEAD
+	index  int64 // Next chunk to read
+	chunks int64 // Chunks in the whole copy
+	size   int64 // Size of the whole copy
+	sealed []byte
+	plain  []byte // Decrypted bytes not read yet
+}
+
+// NewDecrypter reads chunks of an encrypted copy of the given size, starting at
+// the chunk with index first, and returns their content. A chunk that does not
+// decrypt, because of a wrong key or altered content, fails the read.
+func NewDecrypter(source io.Reader, key []byte, first, size int64) (*Decrypter, error) {
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (size + EncryptedChunkLen - 1) / EncryptedChunkLen
+	return &Decrypter{source: source, aead: aead, index: first, chunks: chunks, size: size, sealed: make([]byte, EncryptedChunkLen)}, nil
+}
+
+func (d *Decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.index >= d.chunks {
+			return 0, io.EOF
+		}
+
+		length := d.size - d.index*EncryptedChunkLen
+		if length > EncryptedChunkLen {
+			length = EncryptedChunkLen
+		}
+		_, err := io.ReadFull(d.source, d.sealed[:length])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		d.plain, err = d.aead.Open(d.sealed[:0], chunkNonce(d.index, d.index == d.chunks-1), d.sealed[:length], nil)
+		if err != nil {
+			return 0, fmt.Errorf("chunk %d does not decrypt: wrong key or altered content", d.index)
+		}
+		d.index++
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
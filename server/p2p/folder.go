@@ -0,0 +1,203 @@
+package p2p
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"server/database/models"
+	"server/database/operations"
+)
+
+// Archive formats a shared folder can be streamed as
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar"
+)
+
+// folderRoot returns the manifest entry of a stored folder itself.
+func folderRoot(storing *models.Storing) models.ManifestEntry {
+	return models.ManifestEntry{Name: storing.Name, Hash: storing.Hash, Size: storing.Size, Folder: true}
+}
+
+// loadManifest reads and decodes a manifest of a stored folder.
+func loadManifest(db *sql.DB, root, hash string) (*models.Manifest, []byte, error) {
+	record, err := operations.FindManifests(db, root, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		return nil, nil, fmt.Errorf("manifest %s not found", hash)
+	}
+
+	var manifest models.Manifest
+	err = json.Unmarshal([]byte(record.Data), &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest %s: %v", hash, err)
+	}
+	return &manifest, []byte(record.Data), nil
+}
+
+// resolveFolderEntry walks the manifests of a stored folder down a slash
+// separated path and returns the entry it names.
+func resolveFolderEntry(db *sql.DB, storing *models.Storing, entryPath string) (models.ManifestEntry, error) {
+	entry := folderRoot(storing)
+	for _, name := range strings.Split(strings.Trim(entryPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !entry.Folder {
+			return entry, fmt.Errorf("%s is not a folder", entry.Name)
+		}
+
+		manifest, _, err := loadManifest(db, storing.Hash, entry.Hash)
+		if err != nil {
+			return entry, err
+		}
+
+		found := false
+		for _, child := range manifest.Entries {
+			if child.Name == name {
+				entry, found = child, true
+				break
+			}
+		}
+		if !found {
+			return entry, fmt.Errorf("no entry %s in %s", name, manifest.Name)
+		}
+	}
+	return entry, nil
+}
+
+// folderFilePath returns where a file inside a stored folder is on disk.
+func folderFilePath(db *sql.DB, root, hash string) (string, error) {
+	file, err := operations.FindManifestFiles(db, root, hash)
+	if err != nil {
+		return "", err
+	}
+	if file == nil {
+		return "", fmt.Errorf("file %s not found", hash)
+	}
+	return file.Path, nil
+}
+
+// archiveWriter adds files to a zip or tar archive.
+type archiveWriter interface {
+	add(name string, size int64, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (a zipArchive) add(name string, size int64, content io.Reader) error {
+	w, err := a.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (a tarArchive) add(name string, size int64, content io.Reader) error {
+	err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.Writer, content, size)
+	return err
+}
+
+// writeFolderArchive writes every file under an entry of a stored folder to an
+// archive, in manifest order, as it reads them.
+func writeFolderArchive(w io.Writer, db *sql.DB, root string, entry models.ManifestEntry, format string) error {
+	var archive archiveWriter
+	switch format {
+	case ArchiveZip:
+		archive = zipArchive{zip.NewWriter(w)}
+	case ArchiveTar:
+		archive = tarArchive{tar.NewWriter(w)}
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	err := addFolderToArchive(archive, db, root, entry, entry.Name)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func addFolderToArchive(archive archiveWriter, db *sql.DB, root string, folder models.ManifestEntry, prefix string) error {
+	manifest, _, err := loadManifest(db, root, folder.Hash)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range manifest.Entries {
+		name := path.Join(prefix, entry.Name)
+		if entry.Folder {
+			err = addFolderToArchive(archive, db, root, entry, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		filePath, err := folderFilePath(db, root, entry.Hash)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		err = archive.add(name, entry.Size, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// servedFile returns the path, size and extension a stored file is sent from by
+// the transfers that need a file on disk. A folder is sent as a tar archive
+// written to a temporary file, which cleanup removes.
+func servedFile(db *sql.DB, storing *models.Storing) (string, int64, string, func(), error) {
+	if storing.Extension != operations.FolderExtension {
+		return storing.Path, storing.Size, storing.Extension, func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "folder-*.tar")
+	if err != nil {
+		return "", 0, "", nil, fmt.Errorf("failed to create folder archive: %v", err)
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+
+	err = writeFolderArchive(file, db, storing.Hash, folderRoot(storing), ArchiveTar)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		cleanup()
+		return "", 0, "", nil, fmt.Errorf("failed to write folder archive: %v", err)
+	}
+
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		cleanup()
+		return "", 0, "", nil, err
+	}
+	return file.Name(), info.Size(), ArchiveTar, cleanup, nil
+}
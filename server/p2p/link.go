@@ -2,46 +2,355 @@ package p2p
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
-	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
+	"server/database/models"
 	"server/database/operations"
 
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
-// GenerateLink generates a link for sharing a file using a hash and stores the details in the database.
-func GenerateLink(db *sql.DB, node host.Host, fileHash string) (string, error) {
-	// Step 1: Get the node's peer address
-	nodeAddress := node.ID()
+// Results of a share link use, as recorded in the ShareAccesses table
+const (
+	ShareOK           = "ok"
+	ShareNotFound     = "not_found"
+	ShareInvalid      = "invalid_token"
+	ShareRevoked      = "revoked"
+	ShareExpired      = "expired"
+	ShareExhausted    = "exhausted"
+	ShareFailed       = "failed"
+	ShareNeedsPayment = "payment_required"
+)
+
+// shareMessages are the messages sent back to the requesting peer when a share link is refused
+var shareMessages = map[string]string{
+	ShareNotFound:  "File not found",
+	ShareInvalid:   "Invalid password",
+	ShareRevoked:   "Link revoked",
+	ShareExpired:   "Link expired",
+	ShareExhausted: "Download limit reached",
+}
+
+// GenerateLink creates a new share link for a file and returns its URL. A zero
+// expiry never expires and a zero maxDownloads allows unlimited downloads. An
+// encrypted link serves an encrypted copy of the file, and its key is only kept
+// in the fragment of the returned URL. Encrypted links need a gateway served over
+// HTTPS, and each of them keeps a copy of the file on disk while it can be used.
+func GenerateLink(db *sql.DB, node host.Host, fileHash, label string, expiry, maxDownloads int64, encrypted bool) (string, error) {
+	// Step 1: Generate a random id for the link token
+	tokenID := make([]byte, 16)
+	_, err := rand.Read(tokenID)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token id: %v", err)
+	}
+
+	link := models.Sharing{
+		Hash:         fileHash,
+		TokenID:      hex.EncodeToString(tokenID),
+		Permissions:  PermRead,
+		Label:        label,
+		Expiry:       expiry,
+		MaxDownloads: maxDownloads,
+		Encrypted:    encrypted,
+	}
+
+	// Step 2: Encrypt a copy of the file under a key of its own
+	var key []byte
+	if encrypted {
+		settings, err := operations.GetGateway(db)
+		if err != nil {
+			return "", err
+		}
+		if settings == nil || !strings.HasPrefix(settings.BaseURL, "https://") {
+			return "", fmt.Errorf("encrypted links need a gateway served over HTTPS")
+		}
+
+		storing, err := operations.FindStoring(db, fileHash)
+		if err != nil || storing == nil {
+			return "", fmt.Errorf("file hash %s is not stored: %v", fileHash, err)
+		}
+		if storing.Extension == operations.FolderExtension {
+			return "", fmt.Errorf("folders cannot be shared with encrypted links")
+		}
+
+		key, link.Content, err = encryptFile(storing.Path, encryptedPath(link.TokenID))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Step 3: Sign the token for the link
+	token, err := IssueCapability(node, linkCapability(node, link))
+	if err == nil {
+		// Step 4: Store the link in the Sharing table, keeping only the hash of its token
+		_, err = operations.AddSharing(db, link.Hash, link.TokenID, HashToken(token), link.Permissions, link.Label, link.Expiry, link.MaxDownloads, link.Encrypted, link.Content)
+		if err != nil {
+			err = fmt.Errorf("failed to add share link for file hash: %v", err)
+		}
+	}
+	if err != nil {
+		removeEncryptedCopy(link)
+		return "", err
+	}
+
+	log.Printf("Generated link %s for file hash %s", link.TokenID, fileHash)
+	url, err := shareURL(db, link.Hash, token)
+	if err != nil || !encrypted {
+		return url, err
+	}
+	return url + "#key=" + EncodeShareKey(key), nil
+}
+
+// RevokeLink revokes a share link and removes its encrypted copy, if any.
+func RevokeLink(db *sql.DB, id int64) error {
+	link, err := operations.FindSharingByID(db, id)
+	if err != nil {
+		return err
+	}
+
+	err = operations.RevokeSharing(db, id)
+	if err != nil {
+		return err
+	}
+	if link != nil {
+		removeEncryptedCopy(*link)
+	}
+	return nil
+}
 
-	// Step 2: Generate a secure random password
-	password, err := generateSecurePassword(16) // Length: 16 characters
+// DeleteLinks removes every share link of a file with their encrypted copies.
+func DeleteLinks(db *sql.DB, fileHash string) error {
+	links, err := operations.GetSharingLinks(db, fileHash)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate password: %v", err)
+		return err
 	}
 
-	// Step 3: Add the generated password to the file's password list
-	err = operations.AddSharing(db, fileHash, password)
+	err = operations.DeleteSharing(db, fileHash)
 	if err != nil {
-		return "", fmt.Errorf("failed to add password to file hash: %v", err)
+		return err
+	}
+	for _, link := range links {
+		removeEncryptedCopy(link)
+	}
+	return nil
+}
+
+// removeEncryptedCopy deletes the encrypted copy of a link once it cannot be used.
+func removeEncryptedCopy(link models.Sharing) {
+	if !link.Encrypted {
+		return
+	}
+	err := os.Remove(encryptedPath(link.TokenID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing encrypted copy of link %s: %v", link.TokenID, err)
 	}
+}
 
-	// Step 4: Generate the shareable link
-	link := fmt.Sprintf("http://localhost:3002/viewfile?address=%s&hash=%s&password=%s", nodeAddress, fileHash, password)
+// removeUnusableCopies deletes the encrypted copies of links that cannot be used
+// anymore: links that are gone, such as those of an earlier run, revoked or
+// expired, and links that reached their download limit once the downloads still
+// in progress ended.
+func removeUnusableCopies(db *sql.DB) {
+	entries, err := os.ReadDir(encryptedDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error listing encrypted copies: %v", err)
+		}
+		return
+	}
 
-	log.Printf("Generated link: %s", link)
-	return link, nil
+	for _, entry := range entries {
+		link, err := operations.FindSharing(db, entry.Name())
+		if err != nil {
+			log.Printf("Error finding link of encrypted copy %s: %v", entry.Name(), err)
+			continue
+		}
+
+		if link != nil {
+			result := CheckShareLink(link, link.Hash)
+			if result == ShareOK || (result == ShareExhausted && shareSessionOpen(link.ID)) {
+				continue
+			}
+		}
+
+		err = os.Remove(encryptedPath(entry.Name()))
+		if err != nil {
+			log.Printf("Error removing encrypted copy %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// sweepEncryptedCopies removes the encrypted copies that cannot be used at start
+// and then at every interval.
+func sweepEncryptedCopies(db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removeUnusableCopies(db)
+		<-ticker.C
+	}
+}
+
+// ShareLink rebuilds the URL of a stored share link by signing its token again.
+// The key of an encrypted link is not stored, so its URL comes without it.
+func ShareLink(db *sql.DB, node host.Host, link models.Sharing) (string, error) {
+	token, err := IssueCapability(node, linkCapability(node, link))
+	if err != nil {
+		return "", err
+	}
+	return shareURL(db, link.Hash, token)
+}
+
+// linkCapability returns the claims of the token of a share link issued by this node.
+func linkCapability(node host.Host, link models.Sharing) models.ShareCapability {
+	return models.ShareCapability{
+		Issuer:      node.ID().String(),
+		Hash:        link.Hash,
+		ID:          link.TokenID,
+		Expiry:      link.Expiry,
+		Permissions: link.Permissions,
+		Content:     link.Content,
+	}
+}
+
+// shareURL builds the URL of a share link token on the public base URL of the
+// gateway. Only the node that issued the token can check it, so the link stops
+// working while that node is offline, even if other peers host the content.
+func shareURL(db *sql.DB, fileHash, token string) (string, error) {
+	settings, err := operations.GetGateway(db)
+	if err != nil {
+		return "", err
+	}
+	if settings == nil {
+		return "", fmt.Errorf("gateway settings not found")
+	}
+
+	return fmt.Sprintf("%s/content/%s?token=%s", strings.TrimSuffix(settings.BaseURL, "/"), fileHash, token), nil
+}
+
+// CheckShareLink tells whether a share link can be used for a file right now.
+func CheckShareLink(link *models.Sharing, fileHash string) string {
+	if link == nil || link.Hash != fileHash {
+		return ShareInvalid
+	}
+	if link.Revoked {
+		return ShareRevoked
+	}
+	if link.Expiry != 0 && time.Now().Unix() >= link.Expiry {
+		return ShareExpired
+	}
+	if link.MaxDownloads != 0 && link.Downloads >= link.MaxDownloads {
+		return ShareExhausted
+	}
+	return ShareOK
+}
+
+// authorizeShare checks a token for a file shared by this node: first the signed
+// claims, then the stored link. It returns the file and link with the result, the
+// link is empty when no link matched the token.
+func authorizeShare(db *sql.DB, node host.Host, fileHash, token string) (*models.Storing, models.Sharing, string) {
+	// Check the signature, file and expiry of the token before touching the database
+	capability, result := VerifyCapability(token, node.ID().String(), fileHash, PermRead)
+	if result != ShareOK {
+		log.Printf("Refused token for file hash %s: %s", fileHash, result)
+		return nil, models.Sharing{}, result
+	}
+
+	// Retrieve file metadata from the database
+	log.Printf("Searching for file metadata in the database for hash: %s", fileHash)
+	storing, err := operations.FindStoring(db, fileHash)
+	if err != nil || storing == nil {
+		log.Printf("File not found or error occurred while fetching file metadata for hash %s: %v", fileHash, err)
+		return nil, models.Sharing{}, ShareNotFound
+	}
+
+	log.Printf("Checking share link %s in the Sharing table for file hash: %s", capability.ID, fileHash)
+	link := findShareLink(db, capability.ID, token)
+	result = CheckShareLink(link, fileHash)
+	if link == nil {
+		return storing, models.Sharing{}, result
+	}
+
+	if result != ShareOK {
+		log.Printf("Refused share link %d for file hash %s: %s", link.ID, fileHash, result)
+	}
+	return storing, *link, result
+}
+
+// authorizeHosted checks that a file is hosted publicly by this node and free for
+// a peer, so it can be fetched without a token. It returns the file with the
+// result and the price asked when it is not free.
+func authorizeHosted(db *sql.DB, fileHash, targetPeerID string) (*models.Storing, float64, string) {
+	hosting, err := operations.FindHosting(db, fileHash)
+	if err != nil || hosting == nil {
+		log.Printf("File hash %s is not hosted: %v", fileHash, err)
+		return nil, 0, ShareNotFound
+	}
+
+	storing, err := operations.FindStoring(db, fileHash)
+	if err != nil || storing == nil {
+		log.Printf("File not found or error occurred while fetching file metadata for hash %s: %v", fileHash, err)
+		return nil, 0, ShareNotFound
+	}
+
+	// Paid files need a quote and a payment, which only the download protocol handles
+	price, err := operations.CalcPrice(db, *hosting, targetPeerID, time.Now())
+	if err != nil {
+		log.Printf("Error calculating price for hash %s: %v", fileHash, err)
+		return nil, 0, ShareFailed
+	}
+	if price > 0 {
+		return nil, price, ShareNeedsPayment
+	}
+	return storing, 0, ShareOK
+}
+
+// countShareDownload counts a download against a share link that passed
+// authorizeShare. Downloads of hosted files without a link are not limited.
+func countShareDownload(db *sql.DB, linkID int64) string {
+	if linkID == 0 {
+		return ShareOK
+	}
+
+	used, err := operations.UseSharing(db, linkID)
+	if err != nil {
+		log.Printf("Error using share link %d: %v", linkID, err)
+	}
+	if !used {
+		// Another request used up the link in the meantime
+		log.Printf("Share link %d was used up by another request", linkID)
+		return ShareExhausted
+	}
+	return ShareOK
+}
+
+// findShareLink retrieves the share link a token was issued for, making sure the
+// token is the one stored for it.
+func findShareLink(db *sql.DB, tokenID, token string) *models.Sharing {
+	link, err := operations.FindSharing(db, tokenID)
+	if err != nil {
+		log.Printf("Error finding share link %s: %v", tokenID, err)
+		return nil
+	}
+	if link == nil || subtle.ConstantTimeCompare([]byte(link.TokenHash), []byte(HashToken(token))) != 1 {
+		return nil
+	}
+	return link
 }
 
-// generateSecurePassword generates a secure random password of the specified length.
-func generateSecurePassword(length int) (string, error) {
-	bytes := make([]byte, length)
-	_, err := rand.Read(bytes)
+// recordShareAccess logs one use of a share link and the bytes it sent, keeping the file
+// request going if the log fails. The link is empty when no link matched the token.
+func recordShareAccess(db *sql.DB, link models.Sharing, fileHash, targetPeerID, result string, bytes int64) {
+	err := operations.AddShareAccesses(db, link.ID, link.TokenID, fileHash, targetPeerID, result, bytes)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+		log.Printf("Error recording access to file hash %s: %v", fileHash, err)
 	}
-	return base64.URLEncoding.EncodeToString(bytes)[:length], nil
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"time"
 
+	"server/proxy"
+
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/rpcclient"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -46,11 +48,21 @@ func P2PAsync(node host.Host, dht *dht.IpfsDHT, db *sql.DB, btcwallet *rpcclient
 	connectToPeer(node, bootstrap_node_addr) // connect to bootstrap node
 	// go handlePeerExchange(node)
 	go receiveDataFromPeer(node, db, "D:/blubberbytes/cse416-dht-go-main/", btcwallet, netParams) // Ensures a folder path is used
-	go handleInput(ctx, dht, node, db)                                                            // Pass db connection to handleInput
+	go handleInput(ctx, dht, node, db, btcwallet)                                                 // Pass db connection to handleInput
+
+	// Stream shared files to gateways
+	serveShares(node, db)
+	go sweepEncryptedCopies(db, time.Hour)
 
 	// Call the helper function to periodically provide keys
 	go periodicTaskHelper(12*time.Hour, db)
 
+	// Bill the usage of the proxy offers of this node
+	proxy.SetBiller(&proxyBiller{node: node, btcwallet: btcwallet, db: db})
+
+	// Keep measuring the uptime of known proxies
+	go monitorProxies(node, db, 10*time.Minute)
+
 	// Keep the program running
 	<-ctx.Done()
 
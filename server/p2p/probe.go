@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/database/models"
+	"server/database/operations"
+	"server/proxy"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Time allowed for each part of a check
+const probeTimeout = 5 * time.Second
+
+// Proxies that have not passed a check for this long are no longer checked
+const probeExpiry = 7 * 24 * time.Hour
+
+// Measure how long the advertised address of an offer takes to answer, in milliseconds.
+// SOCKS5 offers must answer a greeting, HTTP offers only need to accept the connection.
+func measureLatency(p models.ProxyInfo) (int64, error) {
+	if p.Protocol == proxy.ProtocolTunnel {
+		return 0, fmt.Errorf("tunnel offers have no address")
+	}
+
+	address := net.JoinHostPort(p.IP, strconv.FormatInt(p.Port, 10))
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if p.Protocol == proxy.ProtocolHTTP {
+		return time.Since(start).Milliseconds(), nil
+	}
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+
+	// Offer username/password authentication, which the proxy requires
+	_, err = conn.Write([]byte{5, 1, 2})
+	if err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return 0, err
+	}
+	if reply[0] != 5 {
+		return 0, fmt.Errorf("%s is not a SOCKS5 proxy", address)
+	}
+
+	return time.Since(start).Milliseconds(), nil
+}
+
+// Measure the throughput of a test transfer from a proxy peer over a libp2p stream, in bytes per
+// second. Also returns how long the transfer took to start, in milliseconds. This measures the
+// connection to the peer, not the advertised address of any of its offers.
+func measurePeerThroughput(node host.Host, id peer.ID) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, proxy.ProbeProtocol), id, proxy.ProbeProtocol)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(2 * probeTimeout))
+	latency := time.Since(start).Milliseconds()
+
+	n, err := io.Copy(io.Discard, s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n < proxy.ProbeSize {
+		return 0, 0, fmt.Errorf("test transfer from peer %s ended after %d bytes", id, n)
+	}
+
+	elapsed := time.Since(start).Seconds()
+	return int64(float64(n) / elapsed), latency, nil
+}
+
+// Check a proxy offer, record the result and return its measurements so far.
+func probeProxy(node host.Host, db *sql.DB, p models.ProxyInfo) (*models.ProxyHealth, error) {
+	id, err := peer.Decode(p.Node)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy peer ID %s: %v", p.Node, err)
+	}
+
+	latency, err := measureLatency(p)
+	reachable := err == nil
+	if err != nil {
+		log.Printf("Proxy offer %d of peer %s is not reachable: %v", p.Offer, p.Node, err)
+	}
+
+	// Proxies that are not reachable directly can still be used through a tunnel
+	peerThroughput, streamLatency, err := measurePeerThroughput(node, id)
+	if err != nil {
+		log.Printf("Error measuring throughput of proxy peer %s: %v", p.Node, err)
+	}
+	if !reachable {
+		latency = streamLatency
+	}
+	success := reachable || peerThroughput > 0
+
+	err = operations.UpdateProxyHealth(db, p.Node, p.Offer, p.Protocol, p.IP, p.Port, success, reachable, latency, peerThroughput)
+	if err != nil {
+		return nil, err
+	}
+
+	return operations.FindProxyHealth(db, p.Node, p.Offer)
+}
+
+// Score a proxy by its uptime and latency, adjusted for its rate. The peer throughput is reported but
+// not scored, since it is not measured through the offer.
+func rankProxy(p models.ProxyInfo, health *models.ProxyHealth) models.RankedProxies {
+	ranked := models.RankedProxies{ProxyInfo: p}
+	if health == nil || health.Checks == 0 {
+		return ranked
+	}
+
+	ranked.Reachable = health.Reachable
+	ranked.Latency = health.Latency
+	ranked.PeerThroughput = health.PeerThroughput
+	ranked.Uptime = float64(health.Successes) / float64(health.Checks)
+	if health.LastSuccess == 0 {
+		return ranked
+	}
+
+	// The latency factor is between 0 and 1, and is 0.5 at 250 ms
+	latencyFactor := 1 / (1 + float64(health.Latency)/250)
+	quality := ranked.Uptime * latencyFactor
+
+	ranked.Score = quality / (1 + max(p.Rate, 0))
+	return ranked
+}
+
+// Check proxy offers concurrently and rank them, best first.
+func rankProxies(node host.Host, db *sql.DB, proxies []models.ProxyInfo) []models.RankedProxies {
+	ranked := make([]models.RankedProxies, len(proxies))
+
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			health, err := probeProxy(node, db, p)
+			if err != nil {
+				log.Printf("Error checking proxy offer %d of peer %s: %v", p.Offer, p.Node, err)
+			}
+			ranked[i] = rankProxy(p, health)
+		}()
+	}
+	wg.Wait()
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+
+	return ranked
+}
+
+// Periodically check the proxies that have passed a check recently, so their uptime is measured over time.
+// Others are checked again when they are discovered.
+func monitorProxies(node host.Host, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		records, err := operations.GetAllProxyHealth(db)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		proxies := []models.ProxyInfo{}
+		expiry := time.Now().Add(-probeExpiry).Unix()
+		for _, record := range records {
+			if record.LastSuccess < expiry {
+				continue
+			}
+			proxies = append(proxies, models.ProxyInfo{
+				Offer:    record.Offer,
+				Protocol: record.Protocol,
+				IP:       record.IP,
+				Port:     record.Port,
+				Node:     record.Node,
+			})
+		}
+
+		rankProxies(node, db, proxies)
+	}
+}
@@ -0,0 +1,254 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"server/database/models"
+	"server/database/operations"
+
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How long a quote stays valid after it is issued
+const quoteTTL = 10 * time.Minute
+
+// quotePayload returns the bytes covered by the signature of a quote.
+func quotePayload(quote models.SignedQuote) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%.8f|%s|%d|%s", quote.Provider, quote.Buyer, quote.Hash, quote.Price, quote.Address, quote.Expiry, quote.Nonce))
+}
+
+// VerifyQuote checks that a quote was signed by its provider for the given buyer and file, and has not expired.
+func VerifyQuote(quote models.SignedQuote, provider, buyer, hash string) error {
+	if quote.Provider != provider || quote.Buyer != buyer || quote.Hash != hash {
+		return fmt.Errorf("quote does not match the requested download")
+	}
+
+	if time.Now().Unix() > quote.Expiry {
+		return fmt.Errorf("quote has expired")
+	}
+
+	providerID, err := peer.Decode(quote.Provider)
+	if err != nil {
+		return fmt.Errorf("invalid provider in quote: %v", err)
+	}
+
+	pubKey, err := providerID.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to get public key of provider: %v", err)
+	}
+
+	valid, err := pubKey.Verify(quotePayload(quote), quote.Signature)
+	if err != nil || !valid {
+		return fmt.Errorf("invalid quote signature")
+	}
+
+	return nil
+}
+
+// RequestQuote asks a provider for a signed quote to download a file and verifies it.
+func RequestQuote(node host.Host, targetPeerID, hash string) (models.SignedQuote, error) {
+	log.Printf("Requesting quote from peer %s for hash: %s", targetPeerID, hash)
+
+	err := sendDataToPeer(node, targetPeerID, "", "", "request_quote", hash, "")
+	if err != nil {
+		log.Printf("Failed to request quote from peer %s: %v", targetPeerID, err)
+		return models.SignedQuote{}, err
+	}
+
+	// Wait for the quoteSignal or timeout
+	select {
+	case <-quoteSignal:
+		dataMutex.Lock()
+		quote := receivedQuote
+		quoteError := receivedQuoteError
+		receivedQuote = models.SignedQuote{}
+		receivedQuoteError = ""
+		dataMutex.Unlock()
+
+		if quoteError != "" {
+			return models.SignedQuote{}, fmt.Errorf("peer %s refused to quote: %s", targetPeerID, quoteError)
+		}
+
+		err = VerifyQuote(quote, targetPeerID, node.ID().String(), hash)
+		if err != nil {
+			return models.SignedQuote{}, err
+		}
+
+		log.Printf("Received valid quote from peer %s: %+v", targetPeerID, quote)
+		return quote, nil
+	case <-time.After(10 * time.Second):
+		log.Println("Timeout: No quote received.")
+		return models.SignedQuote{}, fmt.Errorf("timed out waiting for quote from peer %s", targetPeerID)
+	}
+}
+
+// handleQuoteRequest issues a signed quote for the file requested by a peer.
+func handleQuoteRequest(s network.Stream, db *sql.DB, node host.Host, btcwallet *rpcclient.Client) {
+	targetPeerID := s.Conn().RemotePeer().String()
+	reader := bufio.NewReader(s)
+
+	// Read the hash from the stream
+	hash, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("Error reading hash from peer %s: %v", targetPeerID, err)
+		return
+	}
+	hash = strings.TrimSpace(hash)
+	log.Printf("Received quote request for hash: %s from peer: %s", hash, targetPeerID)
+
+	storing, err := operations.FindStoring(db, hash)
+	if err != nil || storing == nil {
+		log.Printf("File not found or error occurred while fetching file metadata for hash %s: %v", hash, err)
+		sendQuoteToPeer(node, targetPeerID, nil, "File not found")
+		return
+	}
+
+	// A peer asking again gets the quote it has not used yet while it has time left, so asking does
+	// not create a new wallet address every time
+	unused, err := operations.FindOpenQuotes(db, hash, targetPeerID, time.Now().Add(quoteTTL/2))
+	if err != nil {
+		log.Printf("Error finding open quote for hash %s: %v", hash, err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+	if unused != nil {
+		quote := models.SignedQuote{
+			Hash:     unused.Hash,
+			Price:    unused.Price,
+			Address:  unused.Address,
+			Expiry:   unused.Expiry,
+			Nonce:    unused.Nonce,
+			Provider: node.ID().String(),
+			Buyer:    unused.Peer,
+		}
+		sendSignedQuote(node, targetPeerID, quote)
+		return
+	}
+
+	// Files that are stored but not hosted are free
+	var price float64
+	hosting, err := operations.FindHosting(db, hash)
+	if err != nil {
+		log.Printf("Error retrieving hosting record for hash %s: %v", hash, err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+	if hosting != nil {
+		price, err = operations.CalcPrice(db, *hosting, targetPeerID, time.Now())
+		if err != nil {
+			log.Printf("Error calculating price for hash %s: %v", hash, err)
+			sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+			return
+		}
+	}
+
+	// Issue a fresh address the payment for this quote must go to
+	address, err := operations.NewReceiveAddress(btcwallet, db, "download", hash, targetPeerID)
+	if err != nil {
+		log.Printf("Error generating quote address: %v", err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		log.Printf("Error generating quote nonce: %v", err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+
+	quote := models.SignedQuote{
+		Hash:     hash,
+		Price:    price,
+		Address:  address.String(),
+		Expiry:   time.Now().Add(quoteTTL).Unix(),
+		Nonce:    hex.EncodeToString(nonce),
+		Provider: node.ID().String(),
+		Buyer:    targetPeerID,
+	}
+
+	err = operations.AddQuotes(db, quote.Nonce, quote.Hash, quote.Buyer, quote.Address, quote.Price, quote.Expiry)
+	if err != nil {
+		log.Printf("Error storing quote: %v", err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+
+	sendSignedQuote(node, targetPeerID, quote)
+}
+
+// sendSignedQuote signs a quote and sends it to the peer it was issued to.
+func sendSignedQuote(node host.Host, targetPeerID string, quote models.SignedQuote) {
+	var err error
+	quote.Signature, err = node.Peerstore().PrivKey(node.ID()).Sign(quotePayload(quote))
+	if err != nil {
+		log.Printf("Error signing quote: %v", err)
+		sendQuoteToPeer(node, targetPeerID, nil, "Internal error")
+		return
+	}
+
+	err = sendQuoteToPeer(node, targetPeerID, &quote, "")
+	if err != nil {
+		log.Printf("Failed to send quote for hash %s to peer %s: %v", quote.Hash, targetPeerID, err)
+		return
+	}
+
+	log.Printf("Quote sent successfully for hash %s to peer %s", quote.Hash, targetPeerID)
+}
+
+// sendQuoteToPeer sends a quote, or the reason no quote was issued, to a peer.
+func sendQuoteToPeer(node host.Host, targetPeerID string, quote *models.SignedQuote, reason string) error {
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a stream to the target peer
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	// Write the "requested_quote" header
+	_, err = s.Write([]byte("requested_quote\n"))
+	if err != nil {
+		log.Printf("Failed to send 'requested_quote' header to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	// Send the quote as JSON, or the reason as plain text
+	data := []byte(reason)
+	if quote != nil {
+		data, err = json.Marshal(quote)
+		if err != nil {
+			log.Printf("Error marshaling quote: %v", err)
+			return err
+		}
+	}
+
+	_, err = s.Write(data)
+	if err != nil {
+		log.Printf("Failed to send quote to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,553 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/database/models"
+	"server/database/operations"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Protocol of the streams shared files are fetched over. Each stream carries one
+// ShareRequest line, answered by one ShareResponse line and then the content.
+const ShareProtocol = "/share/fetch/1.0.0"
+
+// How long to wait for the request or response line of a share stream
+const shareHeaderTimeout = 30 * time.Second
+
+// Longest line a share request or response is sent in
+const shareHeaderMax = 8 << 10 // 8 KiB
+
+// Error for a share request or response line that is too long
+var errShareHeaderTooLong = errors.New("share header too long")
+
+// Result of a request for a range that lies outside the file
+const ShareUnsatisfiable = "unsatisfiable"
+
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// How long a counted download can go on fetching ranges without counting again,
+// after its last request and in total
+const (
+	shareSessionIdle = 10 * time.Minute
+	shareSessionMax  = 6 * time.Hour
+)
+
+// A download counted against a share link, which later ranges of the same
+// content fetched by the same peer do not count again
+type shareSession struct {
+	link    int64
+	peer    string
+	hash    string
+	started time.Time
+	used    time.Time
+}
+
+var (
+	shareSessions      = make(map[string]*shareSession) // Keyed by session id
+	shareSessionsMutex sync.Mutex
+)
+
+// shareSessionOpen tells whether a download of a share link can still be resumed.
+func shareSessionOpen(linkID int64) bool {
+	now := time.Now()
+	shareSessionsMutex.Lock()
+	defer shareSessionsMutex.Unlock()
+
+	for _, session := range shareSessions {
+		if session.link == linkID && now.Sub(session.used) <= shareSessionIdle && now.Sub(session.started) <= shareSessionMax {
+			return true
+		}
+	}
+	return false
+}
+
+// startShareSession returns the id of a new session for a download that was
+// counted against a link, or "" for downloads without a link.
+func startShareSession(linkID int64, targetPeerID, hash string) string {
+	if linkID == 0 {
+		return ""
+	}
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Printf("Error generating share session: %v", err)
+		return ""
+	}
+
+	now := time.Now()
+	shareSessionsMutex.Lock()
+	defer shareSessionsMutex.Unlock()
+
+	// Forget the sessions that ended
+	for key, session := range shareSessions {
+		if now.Sub(session.used) > shareSessionIdle || now.Sub(session.started) > shareSessionMax {
+			delete(shareSessions, key)
+		}
+	}
+
+	session := hex.EncodeToString(id)
+	shareSessions[session] = &shareSession{link: linkID, peer: targetPeerID, hash: hash, started: now, used: now}
+	return session
+}
+
+// resumeShareSession checks that a session is still open for the same link, peer
+// and content, and keeps it open.
+func resumeShareSession(id string, linkID int64, targetPeerID, hash string) bool {
+	if id == "" || linkID == 0 {
+		return false
+	}
+
+	now := time.Now()
+	shareSessionsMutex.Lock()
+	defer shareSessionsMutex.Unlock()
+
+	session, found := shareSessions[id]
+	if !found || session.link != linkID || session.peer != targetPeerID || session.hash != hash {
+		return false
+	}
+	if now.Sub(session.used) > shareSessionIdle || now.Sub(session.started) > shareSessionMax {
+		delete(shareSessions, id)
+		return false
+	}
+	session.used = now
+	return true
+}
+
+// Answer share requests from gateways with the requested range of the file.
+func serveShares(node host.Host, db *sql.DB) {
+	node.SetStreamHandler(ShareProtocol, func(s network.Stream) {
+		defer s.Close()
+		handleShareStream(s, db, node)
+	})
+}
+
+// readShareHeader reads the line a share request or response is sent in, without
+// buffering more than shareHeaderMax bytes of it.
+func readShareHeader(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errShareHeaderTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), line...), nil
+}
+
+func handleShareStream(s network.Stream, db *sql.DB, node host.Host) {
+	targetPeerID := s.Conn().RemotePeer().String()
+
+	s.SetReadDeadline(time.Now().Add(shareHeaderTimeout))
+	line, err := readShareHeader(bufio.NewReaderSize(s, shareHeaderMax))
+	if err == errShareHeaderTooLong {
+		log.Printf("Refused share request from peer %s: %v", targetPeerID, err)
+		writeShareResponse(s, models.ShareResponse{Result: ShareInvalid})
+		return
+	} else if err != nil {
+		log.Printf("Error reading share request from peer %s: %v", targetPeerID, err)
+		s.Reset()
+		return
+	}
+
+	var request models.ShareRequest
+	err = json.Unmarshal(line, &request)
+	if err != nil {
+		log.Printf("Error parsing share request from peer %s: %v", targetPeerID, err)
+		writeShareResponse(s, models.ShareResponse{Result: ShareInvalid})
+		return
+	}
+	log.Printf("Handling share request from peer %s for file hash %s with token %s", targetPeerID, request.Hash, RedactToken(request.Token))
+
+	// Requests without a token are for files hosted publicly, whose accesses are
+	// not logged as link uses
+	var storing *models.Storing
+	var link models.Sharing
+	var result string
+	var exhausted bool
+	record := func(string, int64) {}
+	if request.Token == "" {
+		var price float64
+		storing, price, result = authorizeHosted(db, request.Hash, targetPeerID)
+		if result != ShareOK {
+			writeShareResponse(s, models.ShareResponse{Result: result, Price: price})
+			return
+		}
+	} else {
+		storing, link, result = authorizeShare(db, node, request.Hash, request.Token)
+		record = func(result string, bytes int64) {
+			recordShareAccess(db, link, request.Hash, targetPeerID, result, bytes)
+		}
+
+		// A link used up by a download still serves the rest of that download,
+		// which is checked once the content is known
+		if result == ShareExhausted && request.Session != "" {
+			result, exhausted = ShareOK, true
+		}
+		if result != ShareOK {
+			record(result, 0)
+			writeShareResponse(s, models.ShareResponse{Result: result})
+			return
+		}
+	}
+	linkID := link.ID
+
+	// Find what is asked for: the shared file, or a file or folder inside a shared
+	// folder. An encrypted link only serves its encrypted copy, so the file itself
+	// never leaves this node.
+	entry := models.ManifestEntry{Name: storing.Name, Hash: storing.Hash, Size: storing.Size}
+	extension := storing.Extension
+	filePath := storing.Path
+	if link.Encrypted {
+		entry.Hash, entry.Size = link.Content, EncryptedSize(storing.Size)
+		filePath = encryptedPath(link.TokenID)
+		if request.Path != "" || request.Archive != "" {
+			err = fmt.Errorf("encrypted links only serve a single file")
+		}
+	} else if storing.Extension == operations.FolderExtension {
+		entry, err = resolveFolderEntry(db, storing, request.Path)
+		if entry.Hash != storing.Hash {
+			extension = strings.TrimPrefix(path.Ext(entry.Name), ".")
+		}
+		filePath = ""
+	} else if request.Path != "" {
+		err = fmt.Errorf("%s is not a folder", storing.Name)
+	}
+	if err != nil {
+		log.Printf("Error resolving %q in file hash %s: %v", request.Path, request.Hash, err)
+		record(ShareNotFound, 0)
+		writeShareResponse(s, models.ShareResponse{Result: ShareNotFound})
+		return
+	}
+
+	if exhausted && (entry.Folder || request.Head || request.Archive != "") {
+		record(ShareExhausted, 0)
+		writeShareResponse(s, models.ShareResponse{Result: ShareExhausted})
+		return
+	}
+
+	if request.Archive != "" {
+		sendShareArchive(s, db, storing, entry, request, linkID, record)
+		return
+	}
+
+	response := models.ShareResponse{
+		Result:    ShareOK,
+		Hash:      entry.Hash,
+		Folder:    entry.Folder,
+		Name:      entry.Name,
+		Extension: extension,
+		Size:      entry.Size,
+	}
+
+	// A folder is answered with its manifest, which does not count as a download
+	var content io.ReadSeeker
+	if entry.Folder {
+		_, data, err := loadManifest(db, storing.Hash, entry.Hash)
+		if err != nil {
+			log.Printf("Error loading manifest %s: %v", entry.Hash, err)
+			record(ShareNotFound, 0)
+			writeShareResponse(s, models.ShareResponse{Result: ShareNotFound})
+			return
+		}
+		content = bytes.NewReader(data)
+		response.Size = int64(len(data))
+		request.Range = ""
+	}
+
+	// A file is only opened when its content is sent
+	if !entry.Folder && !request.Head && !request.Cached {
+		if filePath == "" {
+			filePath, err = folderFilePath(db, storing.Hash, entry.Hash)
+		}
+		var file *os.File
+		if err == nil {
+			file, err = os.Open(filePath)
+		}
+		if err != nil {
+			log.Printf("Failed to open file %s: %v", filePath, err)
+			record(ShareNotFound, 0)
+			writeShareResponse(s, models.ShareResponse{Result: ShareNotFound})
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			log.Printf("Failed to stat file %s: %v", filePath, err)
+			record(ShareFailed, 0)
+			writeShareResponse(s, models.ShareResponse{Result: ShareFailed})
+			return
+		}
+		content = file
+		response.Size = info.Size()
+	}
+	response.Length = response.Size
+
+	// A Range only applies while the client's copy is still current
+	if request.IfRange != "" && request.IfRange != fmt.Sprintf("\"%s\"", entry.Hash) {
+		request.Range = ""
+	}
+
+	// Invalid ranges are ignored and the whole file is sent, as HTTP allows
+	if request.Range != "" {
+		offset, length, err := parseByteRange(request.Range, response.Size)
+		if err == errRangeUnsatisfiable {
+			record(ShareUnsatisfiable, 0)
+			writeShareResponse(s, models.ShareResponse{Result: ShareUnsatisfiable, Size: response.Size})
+			return
+		} else if err == nil {
+			response.Offset, response.Length, response.Partial = offset, length, true
+		}
+	}
+
+	// Every transfer counts as a download, whatever range it starts at. The ranges
+	// fetched later in the same download, such as seeks through a video, present
+	// the session it was counted under.
+	if !entry.Folder && !request.Head {
+		if resumeShareSession(request.Session, linkID, targetPeerID, entry.Hash) {
+			response.Session = request.Session
+		} else {
+			result = countShareDownload(db, linkID)
+			if result != ShareOK {
+				record(result, 0)
+				writeShareResponse(s, models.ShareResponse{Result: result})
+				return
+			}
+			response.Session = startShareSession(linkID, targetPeerID, entry.Hash)
+		}
+	}
+
+	err = writeShareResponse(s, response)
+	if err != nil {
+		record(ShareFailed, 0)
+		return
+	}
+	if request.Head || (request.Cached && !entry.Folder) {
+		record(ShareOK, 0)
+		return
+	}
+
+	var sent int64
+	_, err = content.Seek(response.Offset, io.SeekStart)
+	if err == nil {
+		sent, err = io.CopyN(s, content, response.Length)
+	}
+	if err != nil {
+		log.Printf("Failed to send %s to peer %s: %v", entry.Name, targetPeerID, err)
+		record(ShareFailed, sent)
+		s.Reset()
+		return
+	}
+
+	log.Printf("Sent %d bytes of %s in file hash %s to peer %s", response.Length, entry.Name, request.Hash, targetPeerID)
+	record(ShareOK, sent)
+}
+
+// sendShareArchive streams a folder inside a share as a zip or tar archive. Its
+// size is not known up front, so the content runs to the end of the stream.
+func sendShareArchive(s network.Stream, db *sql.DB, storing *models.Storing, entry models.ManifestEntry, request models.ShareRequest, linkID int64, record func(string, int64)) {
+	targetPeerID := s.Conn().RemotePeer().String()
+
+	if !entry.Folder || (request.Archive != ArchiveZip && request.Archive != ArchiveTar) {
+		record(ShareNotFound, 0)
+		writeShareResponse(s, models.ShareResponse{Result: ShareNotFound})
+		return
+	}
+
+	response := models.ShareResponse{
+		Result:    ShareOK,
+		Name:      entry.Name + "." + request.Archive,
+		Extension: request.Archive,
+		Size:      -1,
+		Length:    -1,
+	}
+	if !request.Head {
+		result := countShareDownload(db, linkID)
+		if result != ShareOK {
+			record(result, 0)
+			writeShareResponse(s, models.ShareResponse{Result: result})
+			return
+		}
+	}
+
+	err := writeShareResponse(s, response)
+	if err != nil {
+		record(ShareFailed, 0)
+		return
+	}
+	if request.Head {
+		record(ShareOK, 0)
+		return
+	}
+
+	counter := &countingWriter{Writer: s}
+	err = writeFolderArchive(counter, db, storing.Hash, entry, request.Archive)
+	if err != nil {
+		log.Printf("Failed to send archive of %s to peer %s: %v", entry.Name, targetPeerID, err)
+		record(ShareFailed, counter.count)
+		s.Reset()
+		return
+	}
+
+	log.Printf("Sent %s archive of %s in file hash %s to peer %s", request.Archive, entry.Name, request.Hash, targetPeerID)
+	record(ShareOK, counter.count)
+}
+
+// countingWriter counts the bytes written through it, for content whose size is
+// not known up front.
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// writeShareResponse sends the response line of a share stream.
+func writeShareResponse(s network.Stream, response models.ShareResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Failed to send share response to peer %s: %v", s.Conn().RemotePeer(), err)
+	}
+	return err
+}
+
+// parseByteRange resolves a single range of an HTTP Range header against the
+// size of a file and returns its offset and length.
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	// A suffix range asks for the last bytes of the file
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, nil
+}
+
+// shareBody is the content of a share response, read straight from the stream.
+type shareBody struct {
+	*bufio.Reader
+	stream network.Stream
+	stop   func() bool
+}
+
+func (b *shareBody) Close() error {
+	b.stop()
+	return b.stream.Close()
+}
+
+// FetchShare asks the peer sharing a file for it and returns the response with a
+// reader of its content, so the caller can stream it on. The transfer is aborted
+// when the context is cancelled. The reader must be closed.
+func FetchShare(ctx context.Context, node host.Host, targetPeerID string, request models.ShareRequest) (models.ShareResponse, io.ReadCloser, error) {
+	var response models.ShareResponse
+
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		return response, nil, fmt.Errorf("invalid peer ID %s: %v", targetPeerID, err)
+	}
+
+	if node.Network().Connectedness(targetPeerIDParsed) != network.Connected {
+		connectToPeerUsingRelay(node, targetPeerID)
+	}
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, ShareProtocol), targetPeerIDParsed, ShareProtocol)
+	if err != nil {
+		return response, nil, fmt.Errorf("failed to open share stream to peer %s: %v", targetPeerID, err)
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		s.Reset()
+		return response, nil, err
+	}
+	_, err = s.Write(append(data, '\n'))
+	if err != nil {
+		s.Reset()
+		return response, nil, fmt.Errorf("failed to send share request to peer %s: %v", targetPeerID, err)
+	}
+	s.CloseWrite()
+
+	s.SetReadDeadline(time.Now().Add(shareHeaderTimeout))
+	reader := bufio.NewReaderSize(s, shareHeaderMax)
+	line, err := readShareHeader(reader)
+	if err != nil {
+		s.Reset()
+		return response, nil, fmt.Errorf("failed to read share response from peer %s: %v", targetPeerID, err)
+	}
+	err = json.Unmarshal(line, &response)
+	if err != nil {
+		s.Reset()
+		return response, nil, fmt.Errorf("invalid share response from peer %s: %v", targetPeerID, err)
+	}
+	s.SetReadDeadline(time.Time{})
+
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	return response, &shareBody{Reader: reader, stream: s, stop: stop}, nil
+}
@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/database"
+	"server/database/models"
+	"server/database/operations"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+func newTestHost(t *testing.T) host.Host {
+	node, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.Transport(tcp.NewTCPTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// A ranged request is a download like any other, so it uses up a link limited to
+// one download, while later ranges of the same download do not.
+func TestRangedDownloadUsesUpLink(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.SetupDatabase(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = database.CreateNewTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("content shared through a link that allows a single download")
+	filePath := filepath.Join(dir, "shared.txt")
+	err = os.WriteFile(filePath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	err = operations.AddStoring(db, hash, "shared", "txt", filePath, "today", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharer, gateway := newTestHost(t), newTestHost(t)
+	serveShares(sharer, db)
+	err = gateway.Connect(context.Background(), peer.AddrInfo{ID: sharer.ID(), Addrs: sharer.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := GenerateLink(db, sharer, hash, "once", 0, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := parsed.Query().Get("token")
+
+	fetch := func(request models.ShareRequest) models.ShareResponse {
+		response, body, err := FetchShare(context.Background(), gateway, sharer.ID().String(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, body)
+		body.Close()
+		return response
+	}
+
+	first := fetch(models.ShareRequest{Hash: hash, Token: token, Range: "bytes=1-"})
+	if first.Result != ShareOK || first.Session == "" {
+		t.Fatalf("first ranged download: got result %q and session %q", first.Result, first.Session)
+	}
+
+	resumed := fetch(models.ShareRequest{Hash: hash, Token: token, Range: "bytes=10-", Session: first.Session})
+	if resumed.Result != ShareOK {
+		t.Fatalf("range of the counted download: got result %q, want %q", resumed.Result, ShareOK)
+	}
+
+	for _, byteRange := range []string{"bytes=1-", "bytes=0-"} {
+		again := fetch(models.ShareRequest{Hash: hash, Token: token, Range: byteRange})
+		if again.Result != ShareExhausted {
+			t.Fatalf("new download with %s: got result %q, want %q", byteRange, again.Result, ShareExhausted)
+		}
+	}
+}
+
+// A share request longer than the header limit is refused without being read whole.
+func TestOversizedShareRequestIsRefused(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.SetupDatabase(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = database.CreateNewTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharer, gateway := newTestHost(t), newTestHost(t)
+	serveShares(sharer, db)
+	err = gateway.Connect(context.Background(), peer.AddrInfo{ID: sharer.ID(), Addrs: sharer.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := models.ShareRequest{Hash: strings.Repeat("a", shareHeaderMax), Token: "token"}
+	response, body, err := FetchShare(context.Background(), gateway, sharer.ID().String(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if response.Result != ShareInvalid {
+		t.Fatalf("oversized request: got result %q, want %q", response.Result, ShareInvalid)
+	}
+}
@@ -10,12 +10,17 @@ import (
 	"log"           // for logging
 	"os"            // for file operations
 	"path/filepath" // for file path manipulations
+	"server/btc"
 	"server/database/models"
 	"server/database/operations"
+	"server/proxy"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	// Add the necessary packages from libp2p, for example:
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/libp2p/go-libp2p/core/host"    // for host.Host
@@ -34,15 +39,27 @@ var (
 	infoSignal            = make(chan struct{})
 	passwordSignalChan    = make(chan struct{})
 	hashSignalChan        = make(chan struct{})
+	linkSignalChan        = make(chan string)
 	hostingUpdateSignal   = make(chan struct{})
 	successSignal         = make(chan struct{})
 	failureSignal         = make(chan struct{})
-	proxyList             []models.Proxy        // Global list to store received proxies
+	proxyList             []models.ProxyInfo    // Global list to store received proxies
 	proxySignal           = make(chan struct{}) // Channel to signal when a response is received
 	hostingList           []models.JoinedHosting
+	receivedInvoice       models.Invoice
+	invoiceSignal         = make(chan struct{}, 1) // Channel to signal when an invoice is received
+	receivedQuote         models.SignedQuote
+	receivedQuoteError    string
+	quoteSignal           = make(chan struct{}, 1) // Channel to signal when a quote response is received
+	quoteSignalChan       = make(chan struct{})
+	receivedCredentials   models.ProxyCredentials
+	credentialsSignal     = make(chan struct{}, 1) // Channel to signal when proxy credentials are received
 	dataMutex             sync.Mutex
 )
 
+// Fraction of a file released before payment in pay-on-delivery mode
+const payOnDeliveryFraction = 0.1
+
 // Channel for signaling when data is ready
 var signalChan = make(chan struct{}, 1)
 
@@ -111,10 +128,16 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 			// Send a signal based on the confirmation message
 			if message == "Processing successful" {
 				log.Println("Processing was successful. Sending success signal.")
-				successSignal <- struct{}{}
+				select {
+				case successSignal <- struct{}{}:
+				default: // Nobody waits for a confirmation that came too late
+				}
 			} else if message == "Processing failed" {
 				log.Println("Processing failed. Sending failure signal.")
-				failureSignal <- struct{}{}
+				select {
+				case failureSignal <- struct{}{}:
+				default:
+				}
 			} else {
 				log.Printf("Unknown confirmation message received: %s", message)
 			}
@@ -174,29 +197,28 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 			// Log that a proxy response was received
 			log.Println("Received proxy data, attempting to unmarshal JSON.")
 
-			// If a proxy is available, unmarshal the JSON data
-			var proxy models.Proxy
-			err = json.Unmarshal([]byte(response), &proxy)
+			// If proxies are available, unmarshal the JSON list of offers
+			var proxies []models.ProxyInfo
+			err = json.Unmarshal([]byte(response), &proxies)
 			if err != nil {
 				log.Printf("Error unmarshaling proxy data from peer %s: %v", s.Conn().RemotePeer(), err)
 				log.Printf("Received data was: %s", response)
-				log.Println("Ensure the response is valid JSON in the format: {\"IP\":\"<ip>\",\"Rate\":<rate>},\"Wallet\":<wallet>}")
+				log.Println("Ensure the response is a valid JSON list of proxy offers.")
 				// Send a signal even if there's an unmarshaling error
 				proxySignal <- struct{}{}
 				return
 			}
 
 			// Log the received proxy data
-			log.Printf("Received proxy from peer: %+v", proxy)
+			log.Printf("Received proxies from peer: %+v", proxies)
 
-			// Add the received proxy to the global list
+			// Add the received proxies to the global list
 			dataMutex.Lock()
-			proxyList = append(proxyList, proxy)
+			proxyList = append(proxyList, proxies...)
+			log.Printf("Proxies added to global list. Current list size: %d", len(proxyList))
 			dataMutex.Unlock()
 
-			log.Printf("Proxy added to global list. Current list size: %d", len(proxyList))
-
-			// Send a signal after adding the proxy
+			// Send a signal after adding the proxies
 			proxySignal <- struct{}{}
 		} else if header == "proxy_request" {
 			log.Printf("Processing 'proxy_request' request from peer: %s", s.Conn().RemotePeer())
@@ -206,10 +228,67 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 			if err != nil {
 				log.Printf("Error processing 'proxy_request': %v", err)
 			}
+		} else if header == "proxy_connect" {
+			log.Printf("Processing 'proxy_connect' request from peer: %s", s.Conn().RemotePeer())
+
+			// Read the offer the session is for, or select the cheapest over the protocol if none is given
+			line, _ := reader.ReadString('\n')
+			offer, _ := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+			line, _ = reader.ReadString('\n')
+			protocol := strings.TrimSpace(line)
+
+			err := sendProxyCredentialsToPeer(node, s.Conn().RemotePeer().String(), offer, protocol, db)
+			if err != nil {
+				log.Printf("Error processing 'proxy_connect': %v", err)
+			}
+		} else if header == "proxy_credentials" {
+			log.Printf("Processing 'proxy_credentials' response from peer: %s", s.Conn().RemotePeer())
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Printf("Error reading proxy credentials from peer %s: %v", s.Conn().RemotePeer(), err)
+				return
+			}
+
+			// An empty response means the peer refused to open a session
+			var credentials models.ProxyCredentials
+			err = json.Unmarshal(data, &credentials)
+			if err != nil {
+				log.Printf("No proxy credentials received from peer %s: %s", s.Conn().RemotePeer(), strings.TrimSpace(string(data)))
+			}
+
+			dataMutex.Lock()
+			receivedCredentials = credentials
+			dataMutex.Unlock()
+			credentialsSignal <- struct{}{}
 		} else if header == "download_request" {
-			handleDownloadRequest(s, db, node, s.Conn().RemotePeer().String())
+			handleDownloadRequest(s, db, node, s.Conn().RemotePeer().String(), btcwallet, netParams)
 		} else if header == "request_info" {
 			handleInfoRequest(s, db, node)
+		} else if header == "request_quote" {
+			handleQuoteRequest(s, db, node, btcwallet)
+		} else if header == "requested_quote" {
+			// Handle a signed quote, or the reason the peer refused to quote
+			log.Printf("Receiving requested quote from peer: %s", s.Conn().RemotePeer())
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Printf("Error reading requested quote from peer %s: %v", s.Conn().RemotePeer(), err)
+				return
+			}
+
+			var quote models.SignedQuote
+			quoteError := ""
+			err = json.Unmarshal(data, &quote)
+			if err != nil {
+				quoteError = strings.TrimSpace(string(data))
+			}
+
+			dataMutex.Lock()
+			receivedQuote = quote
+			receivedQuoteError = quoteError
+			dataMutex.Unlock()
+			quoteSignal <- struct{}{}
 		} else if header == "requested_info" {
 			// Handle received info
 			log.Printf("Receiving requested info from peer: %s", s.Conn().RemotePeer())
@@ -259,6 +338,18 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 				hashSignalChan <- struct{}{} // Notify the file signal channel
 				return
 
+			case "Link revoked", "Link expired", "Download limit reached":
+				log.Printf("Received '%s' message from peer.", message)
+				signalChan <- struct{}{}
+				linkSignalChan <- message // Notify the link signal channel with the reason
+				return
+
+			case "Invalid quote":
+				log.Println("Received 'Invalid quote' message from peer.")
+				signalChan <- struct{}{}
+				quoteSignalChan <- struct{}{} // Notify the quote signal channel
+				return
+
 			default:
 				log.Printf("Received unknown message from peer: %s", message)
 				return
@@ -277,6 +368,81 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 				return
 			}
 			signalChan <- struct{}{}
+		} else if header == "requested_file_part" {
+			// Handle the part of a file released before payment
+			log.Printf("Handling requested file part from peer %s", s.Conn().RemotePeer())
+
+			address, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading invoice address of file part from stream: %v", err)
+				return
+			}
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Printf("Error reading requested file part from stream: %v", err)
+				return
+			}
+
+			receivePaidFilePart(s.Conn().RemotePeer().String(), strings.TrimSpace(address), data)
+			log.Printf("Requested file part received successfully with %d bytes", len(data))
+		} else if header == "requested_file_rest" {
+			// Handle the rest of a file released once the invoice is paid
+			log.Printf("Handling rest of requested file from peer %s", s.Conn().RemotePeer())
+
+			address, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading invoice address of file rest from stream: %v", err)
+				return
+			}
+			digest, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading digest of file rest from stream: %v", err)
+				return
+			}
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Printf("Error reading rest of requested file from stream: %v", err)
+				return
+			}
+
+			receivePaidFileRest(s.Conn().RemotePeer().String(), strings.TrimSpace(address), strings.TrimSpace(digest), data)
+			log.Printf("Rest of requested file received successfully with %d bytes", len(data))
+		} else if header == "payment_failed" {
+			// Handle an invoice the peer did not receive the payment of in time
+			address, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading invoice address of failed payment from stream: %v", err)
+				return
+			}
+			address = strings.TrimSpace(address)
+
+			log.Printf("Peer %s did not receive the payment to %s", s.Conn().RemotePeer(), address)
+			finishPaidDelivery(s.Conn().RemotePeer().String(), address, nil, fmt.Errorf("payment was not received by peer"))
+		} else if header == "requested_invoice" {
+			// Handle an invoice that must be paid before the file is released
+			log.Printf("Handling invoice from peer: %s", s.Conn().RemotePeer())
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Printf("Error reading invoice from peer %s: %v", s.Conn().RemotePeer(), err)
+				return
+			}
+
+			var invoice models.Invoice
+			err = json.Unmarshal(data, &invoice)
+			if err != nil {
+				log.Printf("Error unmarshaling invoice: %v", err)
+				return
+			}
+
+			dataMutex.Lock()
+			receivedInvoice = invoice
+			dataMutex.Unlock()
+
+			log.Printf("Invoice received and stored: %+v", invoice)
+			invoiceSignal <- struct{}{}
 		} else if header == "request_all" {
 			log.Printf("Received 'send_all' request from peer: %s", s.Conn().RemotePeer())
 			handleSendAllRequest(s, db, node, s.Conn().RemotePeer().String())
@@ -308,6 +474,16 @@ func receiveDataFromPeer(node host.Host, db *sql.DB, folderPath string, btcwalle
 			hostingUpdateSignal <- struct{}{}
 			log.Println("Signal sent for hosting updates")
 
+		} else if header == "requested_hostings_error" {
+			// Handle a peer that could not send its hostings
+			message, err := reader.ReadString('\n')
+			if err != nil {
+				log.Printf("Error reading 'requested_hostings_error' message: %v", err)
+			}
+			log.Printf("Peer %s could not send its hostings: %s", s.Conn().RemotePeer(), strings.TrimSpace(message))
+
+			// The peer has answered, with no hostings
+			hostingUpdateSignal <- struct{}{}
 		} else if header == "requested_file_ext" {
 			// Handle file extension
 			log.Printf("Handling file extension transfer from peer: %s", s.Conn().RemotePeer())
@@ -402,17 +578,23 @@ func sendProxyResponseToPeer(node host.Host, targetPeerID string, db *sql.DB) er
 		return err
 	}
 
-	// Retrieve the proxy from the database
-	proxy, err := operations.GetProxy(db)
+	// Retrieve the proxy and its enabled offers from the database
+	settings, err := operations.GetProxy(db)
 	if err != nil {
 		// Send "no proxy anymore" if there's a database error
 		_, _ = s.Write([]byte("no proxy anymore\n"))
 		log.Printf("Error retrieving proxy from database: %v", err)
 		return err
 	}
+	offers, err := proxy.EnabledOffers(db)
+	if err != nil {
+		_, _ = s.Write([]byte("no proxy anymore\n"))
+		log.Printf("Error retrieving proxy offers from database: %v", err)
+		return err
+	}
 
-	if proxy == nil {
-		// No proxy found, send "no proxy anymore"
+	if settings == nil || len(offers) == 0 {
+		// No proxy offered, send "no proxy anymore"
 		_, err = s.Write([]byte("no proxy anymore\n"))
 		if err != nil {
 			log.Printf("Error sending 'no proxy anymore' message to peer %s: %v", targetPeerIDParsed, err)
@@ -422,8 +604,21 @@ func sendProxyResponseToPeer(node host.Host, targetPeerID string, db *sql.DB) er
 		return nil
 	}
 
-	// Proxy found, send it back as JSON
-	proxyData, err := json.Marshal(proxy)
+	proxies := []models.ProxyInfo{}
+	for _, offer := range offers {
+		proxies = append(proxies, models.ProxyInfo{
+			Offer:    offer.Id,
+			Protocol: offer.Protocol,
+			IP:       offer.IP,
+			Port:     offer.Port,
+			Rate:     offer.Rate,
+			Node:     node.ID().String(),
+			Wallet:   settings.Wallet,
+		})
+	}
+
+	// Proxies found, send them back as JSON
+	proxyData, err := json.Marshal(proxies)
 	if err != nil {
 		// Send "no proxy anymore" if JSON marshaling fails
 		_, _ = s.Write([]byte("no proxy anymore\n"))
@@ -437,11 +632,60 @@ func sendProxyResponseToPeer(node host.Host, targetPeerID string, db *sql.DB) er
 		return err
 	}
 
-	log.Printf("Successfully sent proxy data to peer %s: %+v", targetPeerIDParsed, proxy)
+	log.Printf("Successfully sent proxy data to peer %s: %+v", targetPeerIDParsed, proxies)
 	return nil
 }
 
-func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetPeerID string) {
+// sendProxyCredentialsToPeer opens a proxy session for a peer and sends it the credentials to authenticate with.
+func sendProxyCredentialsToPeer(node host.Host, targetPeerID string, offer int64, protocol string, db *sql.DB) error {
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a new stream to the target peer
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	// Send the "proxy_credentials" header
+	_, err = s.Write([]byte("proxy_credentials\n"))
+	if err != nil {
+		log.Printf("Failed to send 'proxy_credentials' header to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	credentials, err := proxy.NewSession(db, targetPeerID, offer, protocol)
+	if err != nil {
+		_, _ = s.Write([]byte("no proxy session\n"))
+		log.Printf("Error opening proxy session for peer %s: %v", targetPeerID, err)
+		return err
+	}
+
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		_, _ = s.Write([]byte("no proxy session\n"))
+		log.Printf("Error marshaling proxy credentials: %v", err)
+		return err
+	}
+
+	_, err = s.Write(data)
+	if err != nil {
+		log.Printf("Error sending proxy credentials to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	log.Printf("Proxy session %s opened for peer %s", credentials.Username, targetPeerID)
+
+	return nil
+}
+
+func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetPeerID string, btcwallet *rpcclient.Client, netParams *chaincfg.Params) {
 	log.Printf("Handling download request from peer %s", targetPeerID)
 
 	reader := bufio.NewReader(s)
@@ -456,6 +700,14 @@ func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetP
 	fileHash = strings.TrimSpace(fileHash)
 	log.Printf("Received file hash: %s", fileHash)
 
+	// Read the nonce of the quote for this download, if any
+	nonce, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Printf("Error reading quote nonce from stream from peer %s: %v", targetPeerID, err)
+		return
+	}
+	nonce = strings.TrimSpace(nonce)
+
 	// Retrieve file metadata from the database
 	log.Printf("Searching for file metadata in the database for hash: %s", fileHash)
 	storing, err := operations.FindStoring(db, fileHash)
@@ -467,6 +719,67 @@ func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetP
 
 	log.Printf("Found file metadata for file hash: %s", fileHash)
 
+	// Look up the price and the payment protocol to use
+	hosting, err := operations.FindHosting(db, fileHash)
+	if err != nil {
+		log.Printf("Error retrieving hosting record for hash %s: %v", fileHash, err)
+		return
+	}
+	paymentSettings, err := operations.GetPaymentSettings(db)
+	if err != nil {
+		log.Printf("Error retrieving payment settings: %v", err)
+		return
+	}
+
+	// Compute the effective price for this peer
+	var price float64
+	if hosting != nil {
+		price, err = operations.CalcPrice(db, *hosting, targetPeerID, time.Now())
+		if err != nil {
+			log.Printf("Error calculating price for hash %s: %v", fileHash, err)
+			return
+		}
+	}
+
+	// Paid downloads must redeem an unused quote, which fixes the price and the address to pay
+	address := ""
+	if nonce != "" || price > 0 {
+		quote, err := operations.UseQuotes(db, nonce, fileHash, targetPeerID, time.Now())
+		if err != nil {
+			log.Printf("Error redeeming quote for hash %s: %v", fileHash, err)
+			return
+		}
+		if quote == nil {
+			log.Printf("No valid quote from peer %s for file hash: %s", targetPeerID, fileHash)
+			sendDataToPeer(node, targetPeerID, "", "Invalid quote", "message", "", "")
+			return
+		}
+		price = quote.Price
+		address = quote.Address
+	}
+
+	mode := "none"
+	if price > 0 && paymentSettings != nil {
+		mode = paymentSettings.Mode
+	}
+	log.Printf("Using payment mode %s for file hash: %s", mode, fileHash)
+
+	// Folders are sent as an archive
+	filePath, fileSize, fileExt, cleanup, err := servedFile(db, storing)
+	if err != nil {
+		log.Printf("Error preparing file hash %s: %v", fileHash, err)
+		sendDataToPeer(node, targetPeerID, "", "File not found", "message", "", "")
+		return
+	}
+
+	// A paid file is released once the payment is received, which then cleans it up
+	waitingPayment := false
+	defer func() {
+		if !waitingPayment {
+			cleanup()
+		}
+	}()
+
 	// Send the file name
 	fileName := storing.Name
 	err = sendRequestedFileNameToPeer(node, targetPeerID, fileName)
@@ -477,7 +790,6 @@ func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetP
 	log.Printf("File name sent successfully to peer %s: %s", targetPeerID, fileName)
 
 	// Send the file extension
-	fileExt := storing.Extension
 	if fileExt == "" {
 		log.Printf("No extension found for file hash: %s", fileHash)
 		fileExt = "unknown"
@@ -489,26 +801,253 @@ func handleDownloadRequest(s network.Stream, db *sql.DB, node host.Host, targetP
 	}
 	log.Printf("File extension sent successfully to peer %s: %s", targetPeerID, fileExt)
 
-	// Send wallet address
-	err = sendWalletAddressToPeer(node, targetPeerID, db)
+	if mode == "none" {
+		// Send wallet address
+		if address == "" {
+			receiveAddress, err := operations.NewReceiveAddress(btcwallet, db, "download", fileHash, targetPeerID)
+			if err != nil {
+				log.Printf("Error generating receive address: %v", err)
+				return
+			}
+			address = receiveAddress.String()
+		}
+		err = sendWalletAddressToPeer(node, targetPeerID, address)
+		if err != nil {
+			log.Printf("Error sending wallet address to peer %s: %v", targetPeerID, err)
+			return
+		}
+		log.Printf("Wallet address sent successfully to peer %s", targetPeerID)
+
+		// Use sendDataToPeer to send the requested file back
+		log.Printf("Sending requested file back to peer %s from path: %s", targetPeerID, filePath)
+		err = sendRequestedFileToPeer(node, targetPeerID, filePath)
+		if err != nil {
+			log.Printf("Error sending requested file to peer %s: %v", targetPeerID, err)
+			return
+		}
+
+		log.Printf("File sent successfully to peer %s: %s", targetPeerID, filePath)
+		recordHostingDownload(db, hosting, targetPeerID)
+		return
+	}
+
+	// The payer checks the file it puts together against the digest of the whole file
+	digest := storing.Hash
+	if fileExt == ArchiveTar {
+		digest, err = operations.HashFile(filePath)
+		if err != nil {
+			log.Printf("Error hashing archive of folder hash %s: %v", fileHash, err)
+			return
+		}
+	}
+
+	// Release the first part of the file before payment in pay-on-delivery mode
+	var offset int64
+	if mode == "pay_on_delivery" {
+		offset = int64(float64(fileSize) * payOnDeliveryFraction)
+		err = sendFileRangeToPeer(node, targetPeerID, "requested_file_part", []string{address}, filePath, 0, offset)
+		if err != nil {
+			log.Printf("Error sending file part to peer %s: %v", targetPeerID, err)
+			return
+		}
+		log.Printf("Sent first %d bytes of file to peer %s before payment", offset, targetPeerID)
+	}
+
+	// Invoice the quoted address
+	invoiceAddress, err := btcutil.DecodeAddress(address, netParams)
 	if err != nil {
-		log.Printf("Error sending wallet address to peer %s: %v", targetPeerID, err)
+		log.Printf("Error decoding quoted address %s: %v", address, err)
 		return
 	}
-	log.Printf("Wallet address sent successfully to peer %s", targetPeerID)
 
-	// Use sendDataToPeer to send the requested file back
-	log.Printf("Sending requested file back to peer %s from path: %s", targetPeerID, storing.Path)
-	err = sendRequestedFileToPeer(node, targetPeerID, storing.Path)
+	invoice := models.Invoice{
+		Address:       address,
+		Amount:        price,
+		Mode:          mode,
+		Confirmations: paymentSettings.Confirmations,
+		Timeout:       paymentSettings.Timeout,
+	}
+	err = sendInvoiceToPeer(node, targetPeerID, invoice)
 	if err != nil {
-		log.Printf("Error sending requested file to peer %s: %v", targetPeerID, err)
+		log.Printf("Error sending invoice to peer %s: %v", targetPeerID, err)
 		return
 	}
+	log.Printf("Invoice sent successfully to peer %s: %+v", targetPeerID, invoice)
+
+	// Wait for the payment before releasing the rest of the file, without holding the request stream
+	waitingPayment = true
+	go func() {
+		defer cleanup()
 
-	log.Printf("File sent successfully to peer %s: %s", targetPeerID, storing.Path)
+		timeout := time.Duration(paymentSettings.Timeout) * time.Second
+		err := btc.WaitForPayment(btcwallet, invoiceAddress, price, int(paymentSettings.Confirmations), timeout)
+		if err != nil {
+			log.Printf("Payment from peer %s for file hash %s failed: %v", targetPeerID, fileHash, err)
+			sendPaymentFailedToPeer(node, targetPeerID, address)
+			return
+		}
+		log.Printf("Payment received from peer %s for file hash: %s", targetPeerID, fileHash)
+
+		log.Printf("Sending requested file back to peer %s from path: %s", targetPeerID, filePath)
+		err = sendFileRangeToPeer(node, targetPeerID, "requested_file_rest", []string{address, digest}, filePath, offset, -1)
+		if err != nil {
+			log.Printf("Error sending requested file to peer %s: %v", targetPeerID, err)
+			return
+		}
+
+		log.Printf("File sent successfully to peer %s: %s", targetPeerID, filePath)
+		recordHostingDownload(db, hosting, targetPeerID)
+	}()
+}
+
+// recordHostingDownload records a download of a hosted file so it counts towards demand and repeat pricing.
+func recordHostingDownload(db *sql.DB, hosting *models.JoinedHosting, targetPeerID string) {
+	if hosting == nil {
+		return
+	}
+
+	err := operations.AddHostingDownloads(db, hosting.Hash, targetPeerID)
+	if err != nil {
+		log.Printf("Error recording download of hash %s by peer %s: %v", hosting.Hash, targetPeerID, err)
+	}
+}
+
+func sendInvoiceToPeer(node host.Host, targetPeerID string, invoice models.Invoice) error {
+	log.Printf("Preparing to send invoice to peer %s", targetPeerID)
+
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a stream to the target peer
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	// Write the "requested_invoice" header
+	_, err = s.Write([]byte("requested_invoice\n"))
+	if err != nil {
+		log.Printf("Failed to send requested_invoice header to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	// Serialize and send the invoice
+	invoiceData, err := json.Marshal(invoice)
+	if err != nil {
+		log.Printf("Error marshaling invoice: %v", err)
+		return err
+	}
+
+	_, err = s.Write(invoiceData)
+	if err != nil {
+		log.Printf("Failed to send invoice to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	return nil
+}
+
+// sendFileRangeToPeer sends length bytes of a file starting at offset under the given header, followed by
+// one line for each field. A negative length sends everything up to the end of the file.
+func sendFileRangeToPeer(node host.Host, targetPeerID, header string, fields []string, filePath string, offset, length int64) error {
+	log.Printf("Preparing to send %s to peer %s, file: %s, offset: %d", header, targetPeerID, filePath, offset)
+
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a stream to the target peer first
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	// Open the file and seek to the start of the range
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filePath, err)
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		log.Printf("Failed to seek file %s: %v", filePath, err)
+		return err
+	}
+
+	// Write the header and its fields
+	_, err = s.Write([]byte(header + "\n"))
+	if err != nil {
+		log.Printf("Failed to send %s header to peer %s: %v", header, targetPeerIDParsed, err)
+		return err
+	}
+	for _, field := range fields {
+		_, err = s.Write([]byte(field + "\n"))
+		if err != nil {
+			log.Printf("Failed to send %s fields to peer %s: %v", header, targetPeerIDParsed, err)
+			return err
+		}
+	}
+
+	// Write the file content in the range
+	var content io.Reader = file
+	if length >= 0 {
+		content = io.LimitReader(file, length)
+	}
+
+	n, err := io.Copy(s, content)
+	if err != nil {
+		log.Printf("Failed to send file content to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	log.Printf("Sent %d bytes of file content to peer %s", n, targetPeerID)
+
+	return nil
+}
+
+// sendPaymentFailedToPeer tells a peer that the payment of the invoice to an address was not received in time.
+func sendPaymentFailedToPeer(node host.Host, targetPeerID, address string) error {
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a stream to the target peer
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	_, err = s.Write([]byte("payment_failed\n" + address + "\n"))
+	if err != nil {
+		log.Printf("Failed to send payment_failed to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	return nil
 }
 
-func sendWalletAddressToPeer(node host.Host, targetPeerID string, db *sql.DB) error {
+// sendWalletAddressToPeer sends the receive address issued for a download, so the payment can be attributed.
+func sendWalletAddressToPeer(node host.Host, targetPeerID, address string) error {
 	log.Printf("Preparing to send wallet address to peer %s", targetPeerID)
 
 	// Decode the target peer ID
@@ -537,25 +1076,13 @@ func sendWalletAddressToPeer(node host.Host, targetPeerID string, db *sql.DB) er
 	}
 	log.Printf("Sent 'requested_wallet_address' header to peer %s", targetPeerID)
 
-	// Retrieve wallet info from the database
-	walletInfo, err := operations.GetWalletInfo(db)
-	if err != nil {
-		log.Printf("Error retrieving wallet info from database: %v", err)
-		return err
-	}
-	if walletInfo == nil || walletInfo.Address == "" {
-		log.Printf("No wallet address found in the database.")
-		_, _ = s.Write([]byte("No wallet address available\n"))
-		return nil
-	}
-
 	// Send the wallet address as plain text
-	_, err = s.Write([]byte(walletInfo.Address + "\n"))
+	_, err = s.Write([]byte(address + "\n"))
 	if err != nil {
 		log.Printf("Error sending wallet address to peer %s: %v", targetPeerIDParsed, err)
 		return err
 	}
-	log.Printf("Wallet address sent to peer %s: %s", targetPeerID, walletInfo.Address)
+	log.Printf("Wallet address sent to peer %s: %s", targetPeerID, address)
 
 	return nil
 }
@@ -567,7 +1094,19 @@ func handleSendAllRequest(s network.Stream, db *sql.DB, node host.Host, targetPe
 	hostingRecords, err := operations.GetAllHosting(db)
 	if err != nil {
 		log.Printf("Error retrieving hosting records: %v", err)
-		return // Exit the function if retrieval fails
+		sendHostingsErrorToPeer(node, targetPeerID, "Error retrieving hostings")
+		return
+	}
+
+	// Return the effective price for the requesting peer
+	for i := range hostingRecords {
+		price, err := operations.CalcPrice(db, hostingRecords[i], targetPeerID, time.Now())
+		if err != nil {
+			log.Printf("Error calculating price for hash %s: %v", hostingRecords[i].Hash, err)
+			sendHostingsErrorToPeer(node, targetPeerID, "Error calculating prices")
+			return
+		}
+		hostingRecords[i].Price = price
 	}
 
 	// Decode the target peer ID
@@ -612,6 +1151,33 @@ func handleSendAllRequest(s network.Stream, db *sql.DB, node host.Host, targetPe
 	log.Printf("All hosting records sent successfully to peer: %s", targetPeerIDParsed)
 }
 
+// sendHostingsErrorToPeer tells a peer that asked for all hostings why they could not be sent.
+func sendHostingsErrorToPeer(node host.Host, targetPeerID, message string) error {
+	// Decode the target peer ID
+	targetPeerIDParsed, err := peer.Decode(targetPeerID)
+	if err != nil {
+		log.Printf("Failed to decode target peer ID: %v", err)
+		return err
+	}
+
+	// Open a stream to the target peer
+	ctx := context.Background()
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), targetPeerIDParsed, "/senddata/p2p")
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+	defer s.Close()
+
+	_, err = s.Write([]byte("requested_hostings_error\n" + message + "\n"))
+	if err != nil {
+		log.Printf("Failed to send requested_hostings_error to peer %s: %v", targetPeerIDParsed, err)
+		return err
+	}
+
+	return nil
+}
+
 func handleFileRequest(s network.Stream, db *sql.DB, node host.Host, targetPeerID string) {
 	log.Printf("Handling file request from peer %s", targetPeerID)
 
@@ -627,54 +1193,57 @@ func handleFileRequest(s network.Stream, db *sql.DB, node host.Host, targetPeerI
 	fileHash = strings.TrimSpace(fileHash)
 	log.Printf("Received file hash: %s", fileHash)
 
-	// Read the password
-	password, err := reader.ReadString('\n')
+	// Read the share link token
+	token, err := reader.ReadString('\n')
 	if err != nil {
-		log.Printf("Error reading password from stream from peer %s: %v", targetPeerID, err)
-		sendDataToPeer(node, targetPeerID, "", "Invalid password", "", "", "")
+		log.Printf("Error reading token from stream from peer %s: %v", targetPeerID, err)
+		recordShareAccess(db, models.Sharing{}, fileHash, targetPeerID, ShareInvalid, 0)
+		sendDataToPeer(node, targetPeerID, "", shareMessages[ShareInvalid], "", "", "")
 		return
 	}
-	password = strings.TrimSpace(password)
-	log.Printf("Received password (masked): %s", password)
+	token = strings.TrimSpace(token)
+	log.Printf("Received token: %s", RedactToken(token))
 
-	// Retrieve file metadata from the database
-	log.Printf("Searching for file metadata in the database for hash: %s", fileHash)
-	storing, err := operations.FindStoring(db, fileHash)
-	if err != nil || storing == nil {
-		log.Printf("File not found or error occurred while fetching file metadata for hash %s: %v", fileHash, err)
-		sendDataToPeer(node, targetPeerID, "", "File not found", "", "", "")
+	// Validate the link, then count the download against it
+	storing, link, result := authorizeShare(db, node, fileHash, token)
+	linkID := link.ID
+
+	// Only gateways hold the key to decrypt the copy served by an encrypted link
+	if result == ShareOK && link.Encrypted {
+		log.Printf("Share link %d is encrypted and can only be opened through a gateway", linkID)
+		result = ShareInvalid
+	}
+	if result == ShareOK {
+		result = countShareDownload(db, linkID)
+	}
+	if result != ShareOK {
+		recordShareAccess(db, link, fileHash, targetPeerID, result, 0)
+		sendDataToPeer(node, targetPeerID, "", shareMessages[result], "", "", "")
 		return
 	}
 
-	log.Printf("Found file metadata for file hash: %s", fileHash)
+	log.Printf("Share link %d validated successfully for file hash: %s", linkID, fileHash)
 
-	log.Printf("Checking password in the Sharing table for file hash: %s", fileHash)
-	sharing, err := operations.FindSharing(db, fileHash)
-	if err != nil || sharing == nil {
-		log.Printf("No password found in the Sharing table for file hash %s: %v", fileHash, err)
-		sendDataToPeer(node, targetPeerID, "", "Password not found", "", "", "")
-		return
-	}
-	// Validate the password
-	if sharing.Password != password {
-		log.Printf("Invalid password provided for file hash: %s", fileHash)
-		sendDataToPeer(node, targetPeerID, "", "Invalid password", "", "", "")
+	// Folders are sent as an archive
+	filePath, fileSize, fileExt, cleanup, err := servedFile(db, storing)
+	if err != nil {
+		log.Printf("Error preparing file hash %s: %v", fileHash, err)
+		recordShareAccess(db, link, fileHash, targetPeerID, ShareFailed, 0)
 		return
 	}
-
-	log.Printf("Password validated successfully for file hash: %s", fileHash)
+	defer cleanup()
 
 	// Send the file name
 	fileName := storing.Name
 	err = sendRequestedFileNameToPeer(node, targetPeerID, fileName)
 	if err != nil {
 		log.Printf("Error sending file name to peer %s: %v", targetPeerID, err)
+		recordShareAccess(db, link, fileHash, targetPeerID, ShareFailed, 0)
 		return
 	}
 	log.Printf("File name sent successfully to peer %s: %s", targetPeerID, fileName)
 
 	// Send the file extension
-	fileExt := storing.Extension
 	if fileExt == "" {
 		log.Printf("No extension found for file hash: %s", fileHash)
 		fileExt = "unknown"
@@ -682,20 +1251,22 @@ func handleFileRequest(s network.Stream, db *sql.DB, node host.Host, targetPeerI
 	err = sendRequestedFileExtToPeer(node, targetPeerID, fileExt)
 	if err != nil {
 		log.Printf("Error sending file extension to peer %s: %v", targetPeerID, err)
+		recordShareAccess(db, link, fileHash, targetPeerID, ShareFailed, 0)
 		return
 	}
 	log.Printf("File extension sent successfully to peer %s: %s", targetPeerID, fileExt)
 
 	// Use sendDataToPeer to send the requested file back
-	log.Printf("Sending requested file back to peer %s from path: %s", targetPeerID, storing.Path)
-	err = sendRequestedFileToPeer(node, targetPeerID, storing.Path)
+	log.Printf("Sending requested file back to peer %s from path: %s", targetPeerID, filePath)
+	err = sendRequestedFileToPeer(node, targetPeerID, filePath)
 	if err != nil {
 		log.Printf("Error sending requested file to peer %s: %v", targetPeerID, err)
+		recordShareAccess(db, link, fileHash, targetPeerID, ShareFailed, 0)
 		return
 	}
 
-	log.Printf("File sent successfully to peer %s: %s", targetPeerID, storing.Path)
-
+	log.Printf("File sent successfully to peer %s: %s", targetPeerID, filePath)
+	recordShareAccess(db, link, fileHash, targetPeerID, ShareOK, fileSize)
 }
 
 func sendRequestedFileNameToPeer(node host.Host, targetPeerID, fileName string) error {
@@ -831,6 +1402,10 @@ func sendDataToPeer(node host.Host, targetPeerID, filePath, message, dataType st
 	} else if dataType == "proxy_request" {
 		_, err = s.Write([]byte("proxy_request\n"))
 
+	} else if dataType == "proxy_connect" {
+		// The message is the offer the session is requested for and the protocol it must be over
+		_, err = s.Write([]byte("proxy_connect\n" + message + "\n"))
+
 	} else if dataType == "download_request" {
 		// Send a "download_request" header
 		log.Printf("Sending download request to peer %s for hash: %s", targetPeerIDParsed, hash)
@@ -840,14 +1415,32 @@ func sendDataToPeer(node host.Host, targetPeerID, filePath, message, dataType st
 			return err
 		}
 
-		// Write the hash of the file to download
-		_, err = s.Write([]byte(hash + "\n"))
+		// Write the hash of the file to download and the nonce of the quote for it
+		_, err = s.Write([]byte(hash + "\n" + password + "\n"))
 		if err != nil {
 			log.Printf("Failed to send hash for download to peer %s: %v", targetPeerIDParsed, err)
 			return err
 		}
 
 		log.Printf("Download request sent successfully to peer %s for hash: %s", targetPeerIDParsed, hash)
+	} else if dataType == "request_quote" {
+		log.Printf("Requesting quote from peer %s for hash: %s", targetPeerIDParsed, hash)
+
+		// Send "request_quote" header
+		_, err = s.Write([]byte("request_quote\n"))
+		if err != nil {
+			log.Printf("Failed to send request_quote header to peer %s: %v", targetPeerIDParsed, err)
+			return err
+		}
+
+		// Send the file hash
+		_, err = s.Write([]byte(hash + "\n"))
+		if err != nil {
+			log.Printf("Failed to send file hash to peer %s: %v", targetPeerIDParsed, err)
+			return err
+		}
+
+		log.Printf("Quote request sent successfully to peer %s", targetPeerIDParsed)
 	} else if dataType == "request_all" {
 		log.Printf("Sending 'request_all' signal to peer %s", targetPeerIDParsed)
 		_, err = s.Write([]byte("request_all\n"))
@@ -1112,6 +1705,17 @@ func handleInfoRequest(s network.Stream, db *sql.DB, node host.Host) {
 		return
 	}
 
+	// Return the effective price for the requesting peer
+	if joinedHosting != nil {
+		price, err := operations.CalcPrice(db, *joinedHosting, s.Conn().RemotePeer().String(), time.Now())
+		if err != nil {
+			log.Printf("Error calculating price for hash %s: %v", hash, err)
+			_, _ = s.Write([]byte(fmt.Sprintf("error: %v\n", err)))
+			return
+		}
+		joinedHosting.Price = price
+	}
+
 	// Send the file information back to the requesting peer
 	err = sendRequestedInfoToPeer(node, s.Conn().RemotePeer().String(), joinedHosting)
 	if err != nil {
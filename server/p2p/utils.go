@@ -1,8 +1,11 @@
 package p2p
 
 import (
+	"context"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,6 +14,8 @@ import (
 	"time"
 
 	"math/rand"
+	"strconv"
+	"strings"
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -89,6 +94,12 @@ func ProvideKey(key string) error {
 }
 
 func GetProviderIDs(node host.Host, key string) ([]string, error) {
+	// Use global context
+	return FindProviderIDs(globalCtx, node, key)
+}
+
+// FindProviderIDs looks up the providers of a key until the lookup ends or the context is done.
+func FindProviderIDs(ctx context.Context, node host.Host, key string) ([]string, error) {
 	// Assign dhtRouting to a local variable for clarity
 	dht := dhtRouting
 
@@ -97,9 +108,6 @@ func GetProviderIDs(node host.Host, key string) ([]string, error) {
 		return []string{}, fmt.Errorf("dhtRouting is not initialized")
 	}
 
-	// Use global context
-	ctx := globalCtx
-
 	// Convert the key to a multihash
 	data := []byte(key)
 	hash := sha256.Sum256(data)
@@ -129,21 +137,34 @@ func GetProviderIDs(node host.Host, key string) ([]string, error) {
 	return ids, nil
 }
 
-func SimplyDownload(node host.Host, targetPeerID, hash string) (string, []byte, string, string, error) {
+// SimplyDownload requests a file from a peer, redeeming the quote with the given nonce. If the peer answers
+// with an invoice, pay is called with its address and amount before the file is released. The returned wallet
+// address is only set when the peer expects to be paid after the download.
+func SimplyDownload(node host.Host, targetPeerID, hash, nonce string, pay func(address string, amount float64) error) (string, []byte, string, string, error) {
 	// Log the start of the function
 	log.Printf("Starting SendDownloadRequest to peer %s for hash %s", targetPeerID, hash)
 
 	// Call sendDataToPeer to send the download request
 	log.Println("Calling sendDataToPeer to send the download request...")
-	err := sendDataToPeer(node, targetPeerID, "", "", "download_request", hash, "")
+	err := sendDataToPeer(node, targetPeerID, "", "", "download_request", hash, nonce)
 	if err != nil {
 		log.Printf("Failed to send download request to peer %s: %v", targetPeerID, err)
 		return "", nil, "", "", err
 	}
 	log.Println("Download request sent successfully. Waiting for signal...")
 
-	// Wait for the first signal
-	<-signalChan
+	// Wait for the first signal, or for an invoice to pay before the file is released
+	select {
+	case <-invoiceSignal:
+		dataMutex.Lock()
+		invoice := receivedInvoice
+		receivedInvoice = models.Invoice{}
+		dataMutex.Unlock()
+
+		name, data, ext, err := receivePaidDownload(targetPeerID, hash, invoice, pay)
+		return name, data, ext, "", err
+	case <-signalChan:
+	}
 	log.Println("First signal received. Proceeding...")
 
 	time.Sleep(500 * time.Millisecond)
@@ -153,6 +174,9 @@ func SimplyDownload(node host.Host, targetPeerID, hash string) (string, []byte,
 	case <-hashSignalChan:
 		log.Println("Received hash signal indicating the hash is invalid.")
 		return "", nil, "", "", fmt.Errorf("hash is invalid")
+	case <-quoteSignalChan:
+		log.Println("Received quote signal indicating the quote is invalid.")
+		return "", nil, "", "", fmt.Errorf("quote is invalid, expired or already used")
 	case <-time.After(100 * time.Millisecond):
 		log.Println("No hash signal received within 100ms. Continuing...")
 	}
@@ -188,9 +212,54 @@ func SimplyDownload(node host.Host, targetPeerID, hash string) (string, []byte,
 	return name, data, ext, walletAddress, nil
 }
 
-func SendRequest(node host.Host, targetPeerID, hash, password string) (string, []byte, string, error) {
+// receivePaidDownload pays the invoice of a peer and waits for the file it releases once paid, which is
+// checked against the requested hash unless it is the archive of a folder.
+func receivePaidDownload(targetPeerID, hash string, invoice models.Invoice, pay func(address string, amount float64) error) (string, []byte, string, error) {
+	log.Printf("Invoice received from peer %s: %+v", targetPeerID, invoice)
+	if pay == nil {
+		return "", nil, "", fmt.Errorf("peer requires payment before download")
+	}
+
+	// Wait for the delivery from before paying, so no part of it is missed
+	delivered := waitPaidDelivery(targetPeerID, invoice.Address)
+	defer endPaidDelivery(targetPeerID, invoice.Address)
+
+	err := pay(invoice.Address, invoice.Amount)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("failed to pay invoice: %w", err)
+	}
+
+	timeout := time.Duration(invoice.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPaymentTimeout
+	}
+
+	var result deliveryResult
+	select {
+	case result = <-delivered:
+	case <-time.After(timeout + paidDeliveryGrace):
+		return "", nil, "", fmt.Errorf("peer did not release the file after payment")
+	}
+	if result.err != nil {
+		return "", nil, "", result.err
+	}
+
+	dataMutex.Lock()
+	name, ext := receivedFileName, receivedFileExt
+	receivedFileName, receivedFileExt = "", ""
+	dataMutex.Unlock()
+
+	sum := sha256.Sum256(result.data)
+	if hex.EncodeToString(sum[:]) != hash && ext != ArchiveTar {
+		return "", nil, "", fmt.Errorf("received file does not match the requested hash")
+	}
+
+	return name, result.data, ext, nil
+}
+
+func SendRequest(node host.Host, targetPeerID, hash, token string) (string, []byte, string, error) {
 	// Call sendDataToPeer to send the request
-	err := sendDataToPeer(node, targetPeerID, "", "", "request", hash, password)
+	err := sendDataToPeer(node, targetPeerID, "", "", "request", hash, token)
 	if err != nil {
 		return "", nil, "", err
 	}
@@ -215,6 +284,14 @@ func SendRequest(node host.Host, targetPeerID, hash, password string) (string, [
 		// No password signal received, continue
 	}
 
+	// Check for a refused share link
+	select {
+	case reason := <-linkSignalChan:
+		return "", nil, "", fmt.Errorf("share link refused: %s", strings.ToLower(reason))
+	case <-time.After(100 * time.Millisecond):
+		// No link signal received, continue
+	}
+
 	dataMutex.Lock() // Lock the mutex to safely access the global variables
 	defer dataMutex.Unlock()
 
@@ -235,12 +312,13 @@ func SendRequest(node host.Host, targetPeerID, hash, password string) (string, [
 	return name, data, ext, nil
 }
 
-func RandomProxiesInfo(node host.Host) ([]models.Proxy, error) {
+// RandomProxiesInfo asks up to 5 random proxies for their offers, checks them and returns them ranked, best first.
+func RandomProxiesInfo(node host.Host, db *sql.DB) ([]models.RankedProxies, error) {
 	// Get a list of provider IDs for the "PROXY" key from the DHT
 	providerIDs, err := GetProviderIDs(node, "PROXY")
 	if err != nil {
 		log.Printf("Failed to get provider IDs for PROXY key: %v", err)
-		return []models.Proxy{}, err
+		return []models.RankedProxies{}, err
 	}
 
 	// Log the original list of provider IDs
@@ -285,15 +363,43 @@ func RandomProxiesInfo(node host.Host) ([]models.Proxy, error) {
 
 	// Read, log, and clear the global list of proxies
 	dataMutex.Lock()
-	defer dataMutex.Unlock()
-
 	log.Printf("Returning global proxy list: %+v", proxyList)
-	result := make([]models.Proxy, len(proxyList))
+	result := make([]models.ProxyInfo, len(proxyList))
 	copy(result, proxyList) // Create a copy of the proxy list to return
 	proxyList = nil         // Clear the global list
 	log.Println("Global proxy list cleared.")
+	dataMutex.Unlock()
 
-	return result, nil
+	// Check that the proxies accept connections and rank them by their quality and rate
+	return rankProxies(node, db, result), nil
+}
+
+// RequestProxyCredentials opens a session with a proxy peer and returns the credentials to authenticate with.
+// An offer of 0 asks for the cheapest offer over protocol, or over any protocol if it is empty.
+func RequestProxyCredentials(node host.Host, targetPeerID string, offer int64, protocol string) (models.ProxyCredentials, error) {
+	err := sendDataToPeer(node, targetPeerID, "", strconv.FormatInt(offer, 10)+"\n"+protocol, "proxy_connect", "", "")
+	if err != nil {
+		log.Printf("Failed to send proxy connect request to peer %s: %v", targetPeerID, err)
+		return models.ProxyCredentials{}, err
+	}
+
+	select {
+	case <-credentialsSignal:
+		dataMutex.Lock()
+		credentials := receivedCredentials
+		receivedCredentials = models.ProxyCredentials{}
+		dataMutex.Unlock()
+
+		if credentials.Username == "" && protocol != "" {
+			return models.ProxyCredentials{}, fmt.Errorf("peer %s refused to open a %s proxy session", targetPeerID, protocol)
+		}
+		if credentials.Username == "" {
+			return models.ProxyCredentials{}, fmt.Errorf("peer %s refused to open a proxy session", targetPeerID)
+		}
+		return credentials, nil
+	case <-time.After(10 * time.Second):
+		return models.ProxyCredentials{}, fmt.Errorf("timed out waiting for proxy credentials from peer %s", targetPeerID)
+	}
 }
 
 func Explore(node host.Host, peerIDs []string) ([]models.JoinedHosting, error) {
@@ -359,8 +465,46 @@ func SendProxyBillWithConfirmation(node host.Host, peerID string, proxyBill mode
 	}
 }
 
+// Bills proxy clients for the usage of the offers of this node, see proxy.Biller
+type proxyBiller struct {
+	node      host.Host
+	btcwallet *rpcclient.Client
+	db        *sql.DB
+}
+
+// NewBill bills a proxy client for the bytes relayed on its behalf at a rate, with a fresh receive
+// address for the payment that refers to the bill.
+func (b *proxyBiller) NewBill(peerID string, rate float64, bytes int64) (models.ProxyBill, error) {
+	id := make([]byte, 16)
+	_, err := cryptorand.Read(id)
+	if err != nil {
+		return models.ProxyBill{}, err
+	}
+	billID := hex.EncodeToString(id)
+
+	address, err := operations.NewReceiveAddress(b.btcwallet, b.db, "proxy", billID, peerID)
+	if err != nil {
+		return models.ProxyBill{}, err
+	}
+
+	// The rate is per MB
+	return models.ProxyBill{
+		Id:     billID,
+		Rate:   rate,
+		Bytes:  bytes,
+		Amount: operations.RoundToSatoshi(rate * float64(bytes) / 1e6),
+		Wallet: address.String(),
+	}, nil
+}
+
+// SendBill sends a bill to a proxy client and waits for it to confirm the payment.
+func (b *proxyBiller) SendBill(peerID string, proxyBill models.ProxyBill) error {
+	return SendProxyBillWithConfirmation(b.node, peerID, proxyBill)
+}
+
 func handleProxyBill(node host.Host, proxyBill models.ProxyBill, peerID string, btcwallet *rpcclient.Client, netParams *chaincfg.Params, db *sql.DB) error {
 	log.Println("Received ProxyBill:")
+	log.Printf("Id: %s", proxyBill.Id)
 	log.Printf("IP: %s", proxyBill.IP)
 	log.Printf("Rate: %.2f", proxyBill.Rate)
 	log.Printf("Bytes: %d", proxyBill.Bytes)
@@ -368,7 +512,7 @@ func handleProxyBill(node host.Host, proxyBill models.ProxyBill, peerID string,
 	log.Printf("Wallet: %s", proxyBill.Wallet)
 
 	// Placeholder function for additional processing
-	err := processProxyBill(proxyBill, btcwallet, netParams, db)
+	err := processProxyBill(proxyBill, peerID, btcwallet, netParams, db)
 	if err != nil {
 		log.Printf("Failed to process ProxyBill: %v", err)
 
@@ -391,7 +535,7 @@ func handleProxyBill(node host.Host, proxyBill models.ProxyBill, peerID string,
 	return nil
 }
 
-func processProxyBill(proxyBill models.ProxyBill, btcwallet *rpcclient.Client, netParams *chaincfg.Params, db *sql.DB) error {
+func processProxyBill(proxyBill models.ProxyBill, peerID string, btcwallet *rpcclient.Client, netParams *chaincfg.Params, db *sql.DB) error {
 	log.Println("Processing ProxyBill...")
 
 	if proxyBill.Rate == -1 {
@@ -400,6 +544,18 @@ func processProxyBill(proxyBill models.ProxyBill, btcwallet *rpcclient.Client, n
 			return err
 		}
 	} else {
+		// A bill sent again because its confirmation was lost is not paid twice
+		paid, err := operations.GetTransactions(db, "proxy", peerID)
+		if err != nil {
+			return err
+		}
+		for _, transaction := range paid {
+			if proxyBill.Id != "" && transaction.Reference == proxyBill.Id {
+				log.Printf("ProxyBill %s was already paid in transaction %s", proxyBill.Id, transaction.Id)
+				return nil
+			}
+		}
+
 		walletInfo, err := operations.GetWalletInfo(db)
 		if err != nil {
 			return err
@@ -415,14 +571,21 @@ func processProxyBill(proxyBill models.ProxyBill, btcwallet *rpcclient.Client, n
 			return err
 		}
 
-		_, err = btcwallet.SendToAddress(btcutilAddress, btcutil.Amount(proxyBill.Amount*1e8))
+		amount, err := btcutil.NewAmount(proxyBill.Amount)
+		if err != nil {
+			return err
+		}
+
+		txid, err := btcwallet.SendToAddress(btcutilAddress, amount)
+		if err != nil {
+			return err
+		}
+
+		err = operations.AddTransactions(db, txid.String(), proxyBill.Wallet, "send", "proxy", proxyBill.Id, peerID, -proxyBill.Amount)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Simulate a processing error
-	err := fmt.Errorf("simulated processing error for ProxyBill with IP: %s", proxyBill.IP)
-	log.Printf("Error: %v", err)
-	return err
+	return nil
 }
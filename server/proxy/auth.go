@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net"
+	"strconv"
+
+	"server/database/models"
+	"server/database/operations"
+)
+
+// Checks SOCKS5 username/password credentials against the issued proxy sessions. Sessions can only
+// be used over the listener of their offer, or over tunnel streams if theirs is a tunnel offer.
+type sessionCredentials struct {
+	db       *sql.DB
+	offer    int64  // Offer of the listener, 0 for tunnel streams
+	protocol string // Protocol the credentials are used over
+}
+
+func (c *sessionCredentials) Valid(username, password string) bool {
+	session, err := operations.FindProxySessions(c.db, username)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if session == nil {
+		log.Printf("Unknown proxy session: %s", username)
+		return false
+	}
+
+	// Sessions end when their offer is withdrawn or disabled
+	offer, err := operations.FindProxyOffers(c.db, session.Offer)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if offer == nil || !offer.Enabled {
+		log.Printf("Proxy offer %d of session %s is no longer available", session.Offer, username)
+		return false
+	}
+	if offer.Protocol != c.protocol || (c.offer != 0 && offer.Id != c.offer) {
+		log.Printf("Proxy session %s of offer %d is not for this %s listener", username, session.Offer, c.protocol)
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashPassword(password)), []byte(session.PasswordHash)) == 1
+}
+
+// Only the hash of a session password is stored.
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate a random hex string from n random bytes.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewSession issues credentials for a new proxy session of a peer, billed at the current rate of an offer.
+// An offer of 0 selects the cheapest enabled offer over protocol, or over any protocol if it is empty.
+func NewSession(db *sql.DB, peer string, offer int64, protocol string) (models.ProxyCredentials, error) {
+	selected, err := FindOffer(db, offer, protocol)
+	if err != nil {
+		return models.ProxyCredentials{}, err
+	}
+
+	username, err := randomHex(8)
+	if err != nil {
+		return models.ProxyCredentials{}, err
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return models.ProxyCredentials{}, err
+	}
+
+	err = operations.AddProxySessions(db, username, hashPassword(password), peer, selected.Id, selected.Rate)
+	if err != nil {
+		return models.ProxyCredentials{}, err
+	}
+
+	credentials := models.ProxyCredentials{
+		Username: username,
+		Password: password,
+		Offer:    selected.Id,
+		Protocol: selected.Protocol,
+	}
+	if selected.Protocol != ProtocolTunnel {
+		credentials.Address = net.JoinHostPort(selected.IP, strconv.FormatInt(selected.Port, 10))
+	}
+
+	return credentials, nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"server/database/models"
+)
+
+/*
+The usage flushed to the ProxyLogs table is also billed to the peer each session was issued to, at
+the rate its offer had when the session was opened, so usage of offers withdrawn since is still
+billed. Usage is added up per peer and offer and billed every few minutes, once it is worth more
+than dust. A bill the peer does not confirm is sent again with the
+same id, so a peer that already paid it does not pay twice.
+*/
+
+// How often pending usage is billed
+const billInterval = 5 * time.Minute
+
+// Smallest amount billed in BTC, smaller usage waits for the next bill
+const minBillAmount = 0.00001
+
+// Biller issues bills for the usage of peers and sends them. It is set up by the p2p package, which
+// holds the wallet and the streams to peers.
+type Biller interface {
+	NewBill(peer string, rate float64, bytes int64) (models.ProxyBill, error)
+	SendBill(peer string, bill models.ProxyBill) error
+}
+
+// Usage is billed to a peer at the rate of an offer
+type billKey struct {
+	peer  string
+	offer int64
+	rate  float64
+}
+
+var (
+	biller           Biller
+	pendingUsage     = make(map[billKey]int64)            // Bytes not billed yet
+	unconfirmedBills = make(map[billKey]models.ProxyBill) // Bills sent but not confirmed
+	lastBilled       time.Time
+	billingMutex     sync.Mutex
+	billing          atomic.Bool // Whether a billing run is in progress
+)
+
+// SetBiller sets how usage is billed. Usage is only logged until it is set.
+func SetBiller(b Biller) {
+	billingMutex.Lock()
+	defer billingMutex.Unlock()
+
+	biller = b
+}
+
+// addUsage adds bytes relayed for a peer to the usage billed at the rate of an offer.
+func addUsage(peer string, offer int64, rate float64, bytes int64) {
+	if peer == "" || bytes <= 0 {
+		return
+	}
+
+	billingMutex.Lock()
+	defer billingMutex.Unlock()
+
+	pendingUsage[billKey{peer: peer, offer: offer, rate: rate}] += bytes
+}
+
+// billUsage bills the pending usage in the background, if it is due or always is set.
+func billUsage(always bool) {
+	billingMutex.Lock()
+	due := always || time.Since(lastBilled) >= billInterval
+	if due {
+		lastBilled = time.Now()
+	}
+	billingMutex.Unlock()
+
+	if due && billing.CompareAndSwap(false, true) {
+		go func() {
+			defer billing.Store(false)
+			sendBills()
+		}()
+	}
+}
+
+// sendBills sends the bills that were not confirmed again, and bills the pending usage of the other
+// peers and offers.
+func sendBills() {
+	billingMutex.Lock()
+	b := biller
+	keys := make(map[billKey]struct{})
+	for key := range pendingUsage {
+		keys[key] = struct{}{}
+	}
+	for key := range unconfirmedBills {
+		keys[key] = struct{}{}
+	}
+	billingMutex.Unlock()
+
+	if b == nil {
+		return
+	}
+
+	for key := range keys {
+		bill, err := nextBill(b, key)
+		if err != nil {
+			log.Printf("Error billing proxy usage of peer %s for offer %d: %v", key.peer, key.offer, err)
+			continue
+		}
+		if bill == nil {
+			continue
+		}
+
+		err = b.SendBill(key.peer, *bill)
+		if err != nil {
+			log.Printf("Bill %s of peer %s was not confirmed: %v", bill.Id, key.peer, err)
+			continue
+		}
+		log.Printf("Bill %s of %d bytes confirmed by peer %s", bill.Id, bill.Bytes, key.peer)
+
+		billingMutex.Lock()
+		delete(unconfirmedBills, key)
+		billingMutex.Unlock()
+	}
+}
+
+// nextBill returns the bill to send to a peer for an offer: the one it did not confirm, or a new bill
+// for the pending usage. It returns nil when there is nothing worth billing.
+func nextBill(b Biller, key billKey) (*models.ProxyBill, error) {
+	billingMutex.Lock()
+	bill, unconfirmed := unconfirmedBills[key]
+	bytes := pendingUsage[key]
+	billingMutex.Unlock()
+
+	if unconfirmed {
+		return &bill, nil
+	}
+
+	// Usage of free offers is not billed
+	if key.rate <= 0 {
+		billingMutex.Lock()
+		pendingUsage[key] -= bytes
+		if pendingUsage[key] <= 0 {
+			delete(pendingUsage, key)
+		}
+		billingMutex.Unlock()
+		return nil, nil
+	}
+
+	// The rate is per MB
+	if key.rate*float64(bytes)/1e6 < minBillAmount {
+		return nil, nil
+	}
+
+	bill, err := b.NewBill(key.peer, key.rate, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	billingMutex.Lock()
+	pendingUsage[key] -= bytes
+	if pendingUsage[key] <= 0 {
+		delete(pendingUsage, key)
+	}
+	unconfirmedBills[key] = bill
+	billingMutex.Unlock()
+
+	return &bill, nil
+}
@@ -0,0 +1,253 @@
+/*
+Proxies can be chained. A proxy node can route its egress through an upstream proxy peer, and
+clients can build circuits of several hops. Each hop authenticates with the next one using a
+session of its own, so every hop bills the hop before it and billing passes along the chain.
+Hops are reached over tunnel streams, so every hop needs a tunnel offer enabled.
+
+Circuits chain billing, they give no privacy. The remaining hops are sent to each hop in plain
+text, and the destination is sent through the circuit in the SOCKS5 request, so the first hop
+already learns the whole path and every hop sees where the traffic goes.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"server/database/models"
+	"server/database/operations"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Protocol of the streams proxy sessions are requested over
+const SessionProtocol = "/proxy/session/1.0.0"
+
+// Most hops a circuit can have
+const MaxHops = 5
+
+var (
+	proxyNode       host.Host
+	upstream        peer.ID                                     // Peer the egress of this proxy is routed through, if any
+	upstreamSession = make(map[peer.ID]models.ProxyCredentials) // Sessions of this node with other proxies
+	chainMutex      sync.Mutex
+)
+
+// Parse and check the peer IDs of a circuit.
+func parseCircuit(node host.Host, hops []string) ([]peer.ID, error) {
+	if len(hops) > MaxHops {
+		return nil, fmt.Errorf("circuit has more than %d hops", MaxHops)
+	}
+
+	circuit := []peer.ID{}
+	seen := make(map[peer.ID]bool)
+	for _, hop := range hops {
+		id, err := peer.Decode(hop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy peer ID %s: %v", hop, err)
+		}
+		if id == node.ID() || seen[id] {
+			return nil, fmt.Errorf("circuit visits peer %s more than once", id)
+		}
+		seen[id] = true
+		circuit = append(circuit, id)
+	}
+
+	return circuit, nil
+}
+
+// Read the remaining hops from the first line of a tunnel stream, without reading past it.
+func readCircuit(s network.Stream) ([]peer.ID, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(s, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) > 4096 {
+			return nil, fmt.Errorf("circuit header too long")
+		}
+	}
+
+	var hops []string
+	err := json.Unmarshal(line, &hops)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCircuit(proxyNode, hops)
+}
+
+// Open a tunnel stream to the first hop of a circuit and send it the remaining hops in plain text.
+func openTunnel(ctx context.Context, node host.Host, circuit []peer.ID) (network.Stream, error) {
+	s, err := node.NewStream(network.WithAllowLimitedConn(ctx, TunnelProtocol), circuit[0], TunnelProtocol)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := []string{}
+	for _, hop := range circuit[1:] {
+		hops = append(hops, hop.String())
+	}
+	header, err := json.Marshal(hops)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	_, err = s.Write(append(header, '\n'))
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Issue a session to every peer that asks for one over the session protocol. These sessions are used
+// by other hops of circuits, which reach this node over tunnel streams.
+func serveSessions(node host.Host, db *sql.DB) {
+	node.SetStreamHandler(SessionProtocol, func(s network.Stream) {
+		defer s.Close()
+
+		credentials, err := NewSession(db, s.Conn().RemotePeer().String(), 0, ProtocolTunnel)
+		if err != nil {
+			log.Printf("Error opening proxy session for peer %s: %v", s.Conn().RemotePeer(), err)
+			s.Reset()
+			return
+		}
+
+		err = json.NewEncoder(s).Encode(credentials)
+		if err != nil {
+			log.Printf("Error sending proxy credentials to peer %s: %v", s.Conn().RemotePeer(), err)
+		}
+	})
+}
+
+// Get the session of this node with another proxy, requesting one if needed.
+func sessionWith(ctx context.Context, id peer.ID) (models.ProxyCredentials, error) {
+	chainMutex.Lock()
+	credentials, exists := upstreamSession[id]
+	chainMutex.Unlock()
+	if exists {
+		return credentials, nil
+	}
+
+	s, err := proxyNode.NewStream(network.WithAllowLimitedConn(ctx, SessionProtocol), id, SessionProtocol)
+	if err != nil {
+		return models.ProxyCredentials{}, err
+	}
+	defer s.Close()
+
+	err = json.NewDecoder(bufio.NewReader(s)).Decode(&credentials)
+	if err != nil {
+		return models.ProxyCredentials{}, fmt.Errorf("error reading proxy credentials from peer %s: %v", id, err)
+	}
+
+	chainMutex.Lock()
+	upstreamSession[id] = credentials
+	chainMutex.Unlock()
+
+	return credentials, nil
+}
+
+// Dialer for the tunnel stream to the first hop of a circuit, whatever address it is asked for
+type tunnelDialer struct {
+	ctx     context.Context
+	circuit []peer.ID
+}
+
+func (d *tunnelDialer) Dial(network, addr string) (net.Conn, error) {
+	s, err := openTunnel(d.ctx, proxyNode, d.circuit)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{s}, nil
+}
+
+// Dial a target through a circuit of proxy peers, authenticating with the first hop.
+func dialThroughPeers(ctx context.Context, circuit []peer.ID, network, addr string) (net.Conn, error) {
+	if proxyNode == nil {
+		return nil, fmt.Errorf("proxy is not running")
+	}
+
+	credentials, err := sessionWith(ctx, circuit[0])
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &xproxy.Auth{User: credentials.Username, Password: credentials.Password}
+	dialer, err := xproxy.SOCKS5("tcp", circuit[0].String(), auth, &tunnelDialer{ctx: ctx, circuit: circuit})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		// The session may have expired, so request a new one next time
+		if strings.Contains(err.Error(), "authentication") {
+			chainMutex.Lock()
+			delete(upstreamSession, circuit[0])
+			chainMutex.Unlock()
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Dial a target directly, or through the circuit of the request or the configured upstream proxy.
+func dialEgress(ctx context.Context, network, addr string) (net.Conn, error) {
+	circuit, _ := ctx.Value("circuit").([]peer.ID)
+	if len(circuit) == 0 {
+		chainMutex.Lock()
+		if upstream != "" {
+			circuit = []peer.ID{upstream}
+		}
+		chainMutex.Unlock()
+	}
+
+	if len(circuit) == 0 {
+		return net.Dial(network, addr)
+	}
+	return dialThroughPeers(ctx, circuit, network, addr)
+}
+
+// Load the upstream proxy configured for this node.
+func loadUpstream(db *sql.DB) {
+	proxy, err := operations.GetProxy(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var id peer.ID
+	if proxy != nil && proxy.Upstream != "" {
+		id, err = peer.Decode(proxy.Upstream)
+		if err != nil {
+			log.Printf("Invalid upstream proxy %s: %v", proxy.Upstream, err)
+			return
+		}
+	}
+
+	chainMutex.Lock()
+	upstream = id
+	chainMutex.Unlock()
+}
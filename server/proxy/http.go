@@ -0,0 +1,188 @@
+/*
+HTTP/1.1 forward proxy for clients that expect an HTTP proxy rather than SOCKS5. CONNECT
+requests are tunneled and plain HTTP requests are forwarded. It authenticates with the same
+session credentials and dials through customDial, so traffic accounting, limits, the
+destination policy and billing are shared with the SOCKS server.
+*/
+
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// Headers that only apply to a single hop and are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type httpProxy struct {
+	db          *sql.DB
+	credentials *sessionCredentials
+	transport   *http.Transport
+}
+
+// Resolve a destination and dial it if the quota and destination policy allow it.
+func (p *httpProxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	// Resolve before checking, so the address that is checked is the one that is dialed
+	dest := &socks5.AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.FQDN = host
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", host)
+		}
+		dest.IP = ips[0].IP
+	}
+
+	identity, _ := ctx.Value("identity").(string)
+	clientIP, _ := ctx.Value("clientIP").(string)
+	ctx, allowed := allowRequest(ctx, p.db, identity, clientIP, dest)
+	if !allowed {
+		return nil, fmt.Errorf("destination %s rejected", addr)
+	}
+
+	return customDial(ctx, "tcp", net.JoinHostPort(dest.IP.String(), portText))
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok || !p.credentials.Valid(username, password) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="BlubberBytes"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "identity", username)
+	ctx = context.WithValue(ctx, "clientIP", r.RemoteAddr)
+
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r.WithContext(ctx))
+		return
+	}
+
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only absolute http URLs can be forwarded", http.StatusBadRequest)
+		return
+	}
+
+	outReq := r.Clone(ctx)
+	outReq.RequestURI = ""
+	for _, header := range hopHeaders {
+		outReq.Header.Del(header)
+	}
+
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		log.Printf("Error forwarding request to %s: %v", r.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Tunnel a CONNECT request to its destination.
+func (p *httpProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	target, err := p.dial(r.Context(), r.Host)
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	// Forward the client, including anything it sent before the tunnel was established
+	go func() {
+		io.Copy(target, buffered.Reader)
+		if closer, ok := target.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+	}()
+
+	io.Copy(conn, target)
+}
+
+// Parse the Basic credentials of a Proxy-Authorization header.
+func parseProxyAuthorization(header string) (string, string, bool) {
+	if header == "" {
+		return "", "", false
+	}
+
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+// Create the server of an HTTP offer.
+func newHTTPServer(db *sql.DB, offer int64) *http.Server {
+	p := &httpProxy{db: db, credentials: &sessionCredentials{db: db, offer: offer, protocol: ProtocolHTTP}}
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dial(ctx, addr)
+		},
+		// Connections are not reused, since their traffic is billed to the request's session
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	return &http.Server{Handler: p}
+}
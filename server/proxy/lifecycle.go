@@ -0,0 +1,291 @@
+/*
+The proxy only runs while at least one offer is enabled. Reload starts it, opens a listener for
+every enabled SOCKS5 and HTTP offer and closes the listeners of offers that were withdrawn or
+disabled. Tunnel streams are only accepted while a tunnel offer is enabled. When the last offer
+goes away the proxy stops: it stops accepting connections, lets open connections drain for a
+while, closes the rest and flushes their usage to ProxyLogs.
+*/
+
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/database/models"
+
+	"github.com/armon/go-socks5"
+)
+
+// How long open connections are given to finish when the proxy stops
+const drainTimeout = 30 * time.Second
+
+// How often usage is logged to the ProxyLogs table
+const flushInterval = 30 * time.Second
+
+// Listener of an enabled offer
+type offerListener struct {
+	address  string
+	listener net.Listener
+	server   *http.Server // Only for HTTP offers
+}
+
+// Stop accepting connections on the listener. Open connections are left to finish.
+func (l *offerListener) close() {
+	if l.server != nil {
+		go l.server.Shutdown(context.Background())
+		return
+	}
+	l.listener.Close()
+}
+
+var (
+	running        bool
+	proxyDB        *sql.DB
+	listeners      = make(map[int64]*offerListener) // Keyed by offer
+	tunnelServed   bool                             // Whether tunnel streams are served, while a tunnel offer is enabled
+	stopLoop       chan struct{}
+	lifecycleMutex sync.Mutex
+)
+
+// Get the local address an offer listens on.
+func listenAddress(offer models.ProxyOffers) string {
+	if offer.Listen != "" {
+		return offer.Listen
+	}
+	return net.JoinHostPort("0.0.0.0", strconv.FormatInt(offer.Port, 10))
+}
+
+// Reload starts or stops the proxy and its listeners to match the enabled offers. When the proxy
+// stops, it returns once the open connections are drained.
+func Reload(db *sql.DB) error {
+	lifecycleMutex.Lock()
+	drain, err := reload(db)
+	lifecycleMutex.Unlock()
+
+	// Other changes can be made while the connections drain
+	if drain != nil {
+		drain()
+	}
+	return err
+}
+
+// Match the enabled offers, returning the function that drains the open connections if the proxy
+// stopped. The lifecycle mutex must be held.
+func reload(db *sql.DB) (func(), error) {
+	offers, err := EnabledOffers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(offers) == 0 {
+		if running {
+			return stop(db), nil
+		}
+		return nil, nil
+	}
+
+	if !running {
+		err = start(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	enabled := make(map[int64]models.ProxyOffers)
+	tunnelOffered := false
+	for _, offer := range offers {
+		if offer.Protocol == ProtocolSOCKS5 || offer.Protocol == ProtocolHTTP {
+			enabled[offer.Id] = offer
+		} else if offer.Protocol == ProtocolTunnel {
+			tunnelOffered = true
+		}
+	}
+
+	// Only accept tunnel streams while a tunnel offer is enabled
+	if tunnelOffered && !tunnelServed {
+		serveTunnel(proxyNode, db)
+		tunnelServed = true
+	} else if !tunnelOffered && tunnelServed {
+		proxyNode.RemoveStreamHandler(TunnelProtocol)
+		tunnelServed = false
+		log.Println("Proxy stopped serving tunnels")
+	}
+
+	// Close the listeners of offers that are no longer enabled or moved to another address
+	for id, l := range listeners {
+		offer, exists := enabled[id]
+		if !exists || listenAddress(offer) != l.address {
+			log.Printf("Proxy offer %d stopped listening on %s", id, l.address)
+			l.close()
+			delete(listeners, id)
+		}
+	}
+
+	// Open listeners for new offers, keeping the others running if one fails
+	errs := []error{}
+	for id, offer := range enabled {
+		if _, exists := listeners[id]; exists {
+			continue
+		}
+
+		err := listen(db, offer)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// Open the listener of an offer and serve it. The lifecycle mutex must be held.
+func listen(db *sql.DB, offer models.ProxyOffers) error {
+	address := listenAddress(offer)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s for proxy offer %d: %v", address, offer.Id, err)
+	}
+
+	l := &offerListener{address: address, listener: listener}
+	if offer.Protocol == ProtocolHTTP {
+		l.server = newHTTPServer(db, offer.Id)
+		go l.server.Serve(listener)
+	} else {
+		// Each offer has a server of its own, which only accepts the sessions of the offer
+		credentials := &sessionCredentials{db: db, offer: offer.Id, protocol: ProtocolSOCKS5}
+		conf := &socks5.Config{Dial: customDial, Rules: &clientAddressRuleset{db: db}, Credentials: credentials}
+		server, err := socks5.New(conf)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		go server.Serve(listener)
+	}
+	listeners[offer.Id] = l
+
+	fmt.Printf("Proxy offer %d (%s) is running on %s.\n", offer.Id, offer.Protocol, address)
+	return nil
+}
+
+// Start serving tunnels, sessions and probes, and sampling traffic. The lifecycle mutex must be held.
+func start(db *sql.DB) error {
+	if proxyNode == nil {
+		return fmt.Errorf("proxy is not initialized")
+	}
+
+	// Serve sessions and probes, tunnels are served while a tunnel offer is enabled, see reload
+	loadUpstream(db)
+	serveSessions(proxyNode, db)
+	serveProbes(proxyNode)
+
+	stopLoop = make(chan struct{})
+	go sampleLoop(db, stopLoop)
+
+	running = true
+	log.Println("Proxy started")
+	return nil
+}
+
+// Sample open connections and log usage until stopped.
+func sampleLoop(db *sql.DB, stop chan struct{}) {
+	sampleTicker := time.NewTicker(sampleInterval)
+	defer sampleTicker.Stop()
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case <-sampleTicker.C:
+			sampleConnections()
+			enforceLimits(db)
+			loadUpstream(db)
+		case <-flushTicker.C:
+			flushUsage(db)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop accepting connections and return the function that drains the open ones and flushes their
+// usage, which is called once the lifecycle mutex is released. The lifecycle mutex must be held.
+func stop(db *sql.DB) func() {
+	log.Println("Stopping proxy, draining open connections")
+
+	for id, l := range listeners {
+		l.close()
+		delete(listeners, id)
+	}
+	proxyNode.RemoveStreamHandler(TunnelProtocol)
+	tunnelServed = false
+	proxyNode.RemoveStreamHandler(SessionProtocol)
+	proxyNode.RemoveStreamHandler(ProbeProtocol)
+
+	close(stopLoop)
+	running = false
+
+	// Connections of a proxy started again while these drain are left alone
+	open := openConnections()
+	return func() {
+		// Wait for open connections to finish, then close the rest
+		deadline := time.Now().Add(drainTimeout)
+		for len(stillOpen(open)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for _, t := range stillOpen(open) {
+			t.Close()
+		}
+
+		flushUsage(db)
+		billUsage(true)
+		log.Println("Proxy stopped")
+	}
+}
+
+// Get the open connections.
+func openConnections() []*trafficInterceptor {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	open := []*trafficInterceptor{}
+	for t := range connections {
+		open = append(open, t)
+	}
+	return open
+}
+
+// Get the connections that are still open out of the given ones.
+func stillOpen(given []*trafficInterceptor) []*trafficInterceptor {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	open := []*trafficInterceptor{}
+	for _, t := range given {
+		if _, exists := connections[t]; exists {
+			open = append(open, t)
+		}
+	}
+	return open
+}
+
+// Shutdown stops the proxy if it is running, so no usage is lost when the node exits.
+func Shutdown() {
+	lifecycleMutex.Lock()
+	var drain func()
+	if running {
+		drain = stop(proxyDB)
+	}
+	lifecycleMutex.Unlock()
+
+	if drain != nil {
+		drain()
+	}
+}
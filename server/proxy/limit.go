@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"server/database/operations"
+)
+
+/*
+Limits and quotas apply to the peer a session was issued to, not to the session itself, because a
+peer can open as many sessions as it likes.
+*/
+
+// Rate in bytes per second that clients over their quota are throttled to
+const overQuotaRate = 1024
+
+// Token bucket that allows rate bytes per second with bursts of up to one second
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// Take n tokens, sleeping for as long as the bucket is in debt.
+func (b *tokenBucket) wait(n int) {
+	b.mutex.Lock()
+	if b.rate <= 0 {
+		b.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+var (
+	globalBucket  = &tokenBucket{}
+	clientBuckets = make(map[string]*tokenBucket) // Keyed by peer
+	clientLimit   float64
+	quota         int64
+	quotaPeriod   int64
+	overQuota     = make(map[string]bool) // Peers over their quota in the current period
+	limitsMutex   sync.Mutex
+)
+
+// Get the peer a session was issued to. Sessions without a peer are limited on their own.
+func sessionPeer(db *sql.DB, identity string) string {
+	session, err := operations.FindProxySessions(db, identity)
+	if err != nil {
+		log.Println(err)
+		return identity
+	}
+	if session == nil || session.Peer == "" {
+		return identity
+	}
+	return session.Peer
+}
+
+// Get the rate of a client, which is lowered while it is over its quota.
+// The limits mutex must be held.
+func clientRate(peer string) float64 {
+	if overQuota[peer] && (clientLimit <= 0 || clientLimit > overQuotaRate) {
+		return overQuotaRate
+	}
+	return clientLimit
+}
+
+// Get the token bucket of a client, creating it if needed.
+func clientBucket(peer string) *tokenBucket {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+
+	bucket, exists := clientBuckets[peer]
+	if !exists {
+		bucket = &tokenBucket{rate: clientRate(peer)}
+		clientBuckets[peer] = bucket
+	}
+
+	return bucket
+}
+
+// Throttle n bytes of traffic of a client.
+func throttle(peer string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	clientBucket(peer).wait(n)
+	globalBucket.wait(n)
+}
+
+// Start of the current quota period.
+func periodStart(now time.Time, period int64) int64 {
+	if period <= 0 {
+		return 0
+	}
+	return now.Unix() - now.Unix()%period
+}
+
+// Get the bytes used by a peer in the current quota period, including usage not yet logged.
+func usage(db *sql.DB, peer string, period int64) (int64, error) {
+	used, err := operations.GetProxyUsage(db, peer, periodStart(time.Now(), period))
+	if err != nil {
+		return 0, err
+	}
+
+	mutex.Lock()
+	for key, value := range paymentInformation {
+		if key.peer == peer {
+			used += value
+		}
+	}
+	mutex.Unlock()
+
+	return used, nil
+}
+
+// Check whether a peer has used up its quota for the current period.
+func isOverQuota(db *sql.DB, peer string) bool {
+	limitsMutex.Lock()
+	currentQuota, currentPeriod := quota, quotaPeriod
+	limitsMutex.Unlock()
+
+	if currentQuota <= 0 {
+		return false
+	}
+
+	used, err := usage(db, peer, currentPeriod)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return used >= currentQuota
+}
+
+// Load the limits configured for the proxy and throttle the clients over their quota.
+// Called after every sample, so changes apply to open connections too.
+func enforceLimits(db *sql.DB) {
+	proxy, err := operations.GetProxy(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if proxy == nil {
+		return
+	}
+
+	globalBucket.setRate(float64(proxy.GlobalLimit))
+
+	limitsMutex.Lock()
+	clientLimit = float64(proxy.ClientLimit)
+	quota = proxy.Quota
+	quotaPeriod = proxy.QuotaPeriod
+	limitsMutex.Unlock()
+
+	// Only clients with open connections need to be throttled
+	mutex.Lock()
+	active := make(map[string]bool)
+	for t := range connections {
+		active[t.peer] = true
+	}
+	mutex.Unlock()
+
+	for peer := range active {
+		over := isOverQuota(db, peer)
+		if over {
+			log.Printf("Proxy client %s is over quota, throttling", peer)
+		}
+
+		limitsMutex.Lock()
+		overQuota[peer] = over
+		rate := clientRate(peer)
+		limitsMutex.Unlock()
+
+		clientBucket(peer).setRate(rate)
+	}
+
+	// Forget the clients without open connections
+	limitsMutex.Lock()
+	for peer := range clientBuckets {
+		if !active[peer] {
+			delete(clientBuckets, peer)
+			delete(overQuota, peer)
+		}
+	}
+	limitsMutex.Unlock()
+}
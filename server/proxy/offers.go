@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+
+	"server/database/models"
+	"server/database/operations"
+)
+
+// Protocols a proxy can be offered over
+const (
+	ProtocolSOCKS5 = "socks5"
+	ProtocolHTTP   = "http"
+	ProtocolTunnel = "tunnel" // SOCKS5 over libp2p streams, for proxies that are not reachable directly
+)
+
+// ValidateOffer checks that a proxy offer is well formed.
+func ValidateOffer(offer models.ProxyOffers) error {
+	if offer.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+
+	switch offer.Protocol {
+	case ProtocolSOCKS5, ProtocolHTTP:
+		if net.ParseIP(offer.IP) == nil {
+			return fmt.Errorf("invalid IP address %q", offer.IP)
+		}
+		if offer.Port < 1 || offer.Port > 65535 {
+			return fmt.Errorf("invalid port %d", offer.Port)
+		}
+		if offer.Listen != "" {
+			_, _, err := net.SplitHostPort(offer.Listen)
+			if err != nil {
+				return fmt.Errorf("invalid listen address %q: %v", offer.Listen, err)
+			}
+		}
+	case ProtocolTunnel:
+		if offer.IP != "" || offer.Port != 0 || offer.Listen != "" {
+			return fmt.Errorf("tunnel offers have no IP address, port or listen address")
+		}
+	default:
+		return fmt.Errorf("protocol must be %s, %s or %s", ProtocolSOCKS5, ProtocolHTTP, ProtocolTunnel)
+	}
+
+	return nil
+}
+
+// EnabledOffers gets the proxy offers that are currently enabled.
+func EnabledOffers(db *sql.DB) ([]models.ProxyOffers, error) {
+	offers, err := operations.GetAllProxyOffers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := []models.ProxyOffers{}
+	for _, offer := range offers {
+		if offer.Enabled {
+			enabled = append(enabled, offer)
+		}
+	}
+
+	return enabled, nil
+}
+
+// FindOffer gets an enabled proxy offer by its id, or the cheapest enabled offer if the id is 0.
+// Unless protocol is empty, only offers over that protocol are found.
+func FindOffer(db *sql.DB, id int64, protocol string) (*models.ProxyOffers, error) {
+	if id != 0 {
+		offer, err := operations.FindProxyOffers(db, id)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil || !offer.Enabled {
+			return nil, fmt.Errorf("proxy offer %d is not available", id)
+		}
+		if protocol != "" && offer.Protocol != protocol {
+			return nil, fmt.Errorf("proxy offer %d is not a %s offer", id, protocol)
+		}
+		return offer, nil
+	}
+
+	offers, err := EnabledOffers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var cheapest *models.ProxyOffers
+	for i := range offers {
+		if protocol != "" && offers[i].Protocol != protocol {
+			continue
+		}
+		if cheapest == nil || offers[i].Rate < cheapest.Rate {
+			cheapest = &offers[i]
+		}
+	}
+	if cheapest == nil && protocol != "" {
+		return nil, fmt.Errorf("no %s proxy offer is enabled", protocol)
+	}
+	if cheapest == nil {
+		return nil, fmt.Errorf("no proxy offer is enabled")
+	}
+
+	return cheapest, nil
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"server/database/models"
+	"server/database/operations"
+
+	"github.com/armon/go-socks5"
+)
+
+// Ranges blocked unless an allow rule matches, so clients cannot reach the LAN or local services
+var blockedRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var blockedNetworks = parseNetworks(blockedRanges)
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Check whether a port is in a list of ports and port ranges such as 80,8000-8100.
+func matchPorts(ports string, port int) bool {
+	for _, part := range strings.Split(ports, ",") {
+		low, high, err := parsePortRange(part)
+		if err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(part string) (int, int, error) {
+	part = strings.TrimSpace(part)
+	lowText, highText, isRange := strings.Cut(part, "-")
+	if !isRange {
+		highText = lowText
+	}
+
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", part)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", part)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", part)
+	}
+
+	return low, high, nil
+}
+
+// Check whether a domain matches a pattern such as example.com or *.example.com.
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+
+	if suffix, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+		return strings.HasSuffix(domain, "."+suffix)
+	}
+	return domain == pattern
+}
+
+// Check whether a rule matches a destination. Empty fields of the rule match anything.
+func matchPolicy(policy models.ProxyPolicies, dest *socks5.AddrSpec) bool {
+	if policy.CIDR != "" {
+		_, network, err := net.ParseCIDR(policy.CIDR)
+		if err != nil || dest.IP == nil || !network.Contains(dest.IP) {
+			return false
+		}
+	}
+
+	if policy.Ports != "" && !matchPorts(policy.Ports, dest.Port) {
+		return false
+	}
+
+	if policy.Domain != "" && !matchDomain(policy.Domain, dest.FQDN) {
+		return false
+	}
+
+	return true
+}
+
+// ValidatePolicy checks that a destination rule is well formed.
+func ValidatePolicy(policy models.ProxyPolicies) error {
+	if policy.Action != "allow" && policy.Action != "deny" {
+		return fmt.Errorf("action must be allow or deny")
+	}
+
+	if policy.CIDR != "" {
+		_, _, err := net.ParseCIDR(policy.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR block: %v", err)
+		}
+	}
+
+	if policy.Ports != "" {
+		for _, part := range strings.Split(policy.Ports, ",") {
+			_, _, err := parsePortRange(part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if policy.Domain != "" && strings.Contains(strings.TrimPrefix(policy.Domain, "*."), "*") {
+		return fmt.Errorf("domain wildcards are only supported as a *. prefix")
+	}
+
+	if policy.CIDR == "" && policy.Ports == "" && policy.Domain == "" {
+		return fmt.Errorf("rule must match a CIDR block, ports or a domain")
+	}
+
+	return nil
+}
+
+// Check a destination against the policy. Deny rules take precedence over allow rules,
+// and allow rules are needed to reach blocked ranges. Returns the reason if it is rejected.
+func checkDestination(db *sql.DB, dest *socks5.AddrSpec) (bool, string) {
+	policies, err := operations.GetAllProxyPolicies(db)
+	if err != nil {
+		log.Println(err)
+		return false, "policy unavailable"
+	}
+
+	allowed := false
+	for _, policy := range policies {
+		if !matchPolicy(policy, dest) {
+			continue
+		}
+
+		if policy.Action == "deny" {
+			return false, fmt.Sprintf("denied by rule %d", policy.Id)
+		}
+		allowed = true
+	}
+	if allowed {
+		return true, ""
+	}
+
+	if dest.IP == nil {
+		return false, "unresolved destination"
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(dest.IP) {
+			return false, fmt.Sprintf("private or reserved range %s", network)
+		}
+	}
+
+	return true, ""
+}
+
+// Log a rejected destination.
+func logRejection(db *sql.DB, identity, clientIP string, dest *socks5.AddrSpec, reason string) {
+	destination := dest.FQDN
+	if destination == "" && dest.IP != nil {
+		destination = dest.IP.String()
+	}
+	log.Printf("Rejected proxy request from %s to %s:%d: %s", identity, destination, dest.Port, reason)
+
+	err := operations.AddProxyRejections(db, identity, clientIP, destination, int64(dest.Port), reason)
+	if err != nil {
+		log.Println(err)
+	}
+}
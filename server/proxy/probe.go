@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"io"
+	"log"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Protocol of the streams clients measure the throughput of their connection to a proxy peer over
+const ProbeProtocol = "/proxy/probe/1.0.0"
+
+// Bytes sent in response to a probe
+const ProbeSize = 128 * 1024
+
+// Answer every probe with a small test transfer.
+func serveProbes(node host.Host) {
+	node.SetStreamHandler(ProbeProtocol, func(s network.Stream) {
+		defer s.Close()
+
+		_, err := io.CopyN(s, zeroReader{}, ProbeSize)
+		if err != nil {
+			log.Printf("Error answering proxy probe from peer %s: %v", s.Conn().RemotePeer(), err)
+			s.Reset()
+		}
+	})
+}
+
+// Reader of endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -1,7 +1,11 @@
 /*
-This is a SOCKS proxy using go. It logs the total number of ingoing and outgoing bytes
-for each user (1 user = 1 IP address) and every 5 minutes this information is logged to
-a txt file in the format [IP, bytes]\n[IP, bytes]\n[IP, bytes]
+This is a SOCKS proxy using go. It logs the total number of ingoing and outgoing bytes for each
+user (1 user = 1 proxy session, authenticated with SOCKS5 username/password). Open connections
+are sampled every 5 seconds and every 30 seconds the usage is logged to the ProxyLogs table, so
+long-lived connections are billed while they are still open. Usage is also flushed when the
+proxy stops. Traffic is rate limited per client and globally, and clients over their quota are
+throttled. Destinations are checked against the policy, which blocks private and loopback ranges
+by default.
 */
 
 package proxy
@@ -9,59 +13,95 @@ package proxy
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"server/database/models"
 	"server/database/operations"
 
 	"github.com/armon/go-socks5"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-var paymentInformation = make(map[string]int64)
+// Usage is billed to the authenticated identity, and kept apart per client address
+type clientKey struct {
+	ip       string
+	identity string
+	peer     string // Peer the session of the identity was issued to
+}
+
+// How often the traffic of open connections is sampled
+const sampleInterval = 5 * time.Second
+
+var paymentInformation = make(map[clientKey]int64)
+var connections = make(map[*trafficInterceptor]struct{}) // Open connections
 var mutex sync.Mutex
 
 type trafficInterceptor struct {
 	conn     net.Conn
 	clientIP string
-	read     int64
-	written  int64
+	identity string
+	peer     string // Peer the session of the identity was issued to, which limits apply to
+	target   string
+	started  time.Time
+	read     atomic.Int64
+	written  atomic.Int64
+	sampled  int64 // Bytes already added to paymentInformation, guarded by mutex
+}
+
+func (t *trafficInterceptor) key() clientKey {
+	return clientKey{ip: strings.Split(t.clientIP, ":")[0], identity: t.identity, peer: t.peer}
 }
 
 func (t *trafficInterceptor) Read(b []byte) (n int, err error) {
 	n, err = t.conn.Read(b)
-	if err == nil {
-		t.read += int64(n)
-	}
-	//log.Printf("Total received: %d", t.read)
+	t.read.Add(int64(n))
+	throttle(t.peer, n)
 	return
 }
 
 func (t *trafficInterceptor) Write(b []byte) (n int, err error) {
+	throttle(t.peer, len(b))
 	n, err = t.conn.Write(b)
-	if err == nil {
-		t.written += int64(n)
-	}
-	//log.Printf("Total sent %d", t.written)
+	t.written.Add(int64(n))
 	return
 }
 
 func (t *trafficInterceptor) Close() error {
-	log.Printf("Final bytes received: %d", t.read)
-	log.Printf("Final bytes sent: %d", t.written)
-	log.Printf("IP Of the bytes above: %s", t.clientIP)
-
-	updatePaymentInfo(strings.Split(t.clientIP, ":")[0], t.read+t.written)
+	mutex.Lock()
+	if _, open := connections[t]; open {
+		log.Printf("Final bytes received: %d", t.read.Load())
+		log.Printf("Final bytes sent: %d", t.written.Load())
+		log.Printf("IP Of the bytes above: %s", t.clientIP)
+		log.Printf("Identity of the bytes above: %s", t.identity)
+
+		sampleTraffic(t)
+		delete(connections, t)
+	}
+	mutex.Unlock()
 
 	return t.conn.Close()
 }
 
+// CloseWrite half-closes the connection, so the target sees the end of the request.
+func (t *trafficInterceptor) CloseWrite() error {
+	if closer, ok := t.conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
 func (t *trafficInterceptor) LocalAddr() net.Addr {
-	return t.conn.LocalAddr()
+	// The SOCKS server expects a TCP address, which chained connections through peers do not have
+	if addr, ok := t.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
 }
 
 func (t *trafficInterceptor) RemoteAddr() net.Addr {
@@ -81,42 +121,118 @@ func (t *trafficInterceptor) SetWriteDeadline(deadline time.Time) error {
 }
 
 func (t *trafficInterceptor) GetBytesSent() int64 {
-	return t.written
+	return t.written.Load()
 }
 
 func (t *trafficInterceptor) GetBytesReceived() int64 {
-	return t.read
+	return t.read.Load()
 }
 
 type clientAddressRuleset struct {
 	socks5.RuleSet
+	db      *sql.DB
+	client  string    // Peer ID of the client when tunneled over libp2p, otherwise empty
+	circuit []peer.ID // Remaining hops of the client's circuit
 }
 
-func updatePaymentInfo(key string, value int64) {
+// Add the traffic of a connection since it was last sampled to paymentInformation.
+// The mutex must be held.
+func sampleTraffic(t *trafficInterceptor) {
+	total := t.read.Load() + t.written.Load()
+	delta := total - t.sampled
+	if delta == 0 {
+		return
+	}
+	t.sampled = total
+
+	paymentInformation[t.key()] += delta
+}
+
+// Sample the traffic of every open connection.
+func sampleConnections() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for t := range connections {
+		sampleTraffic(t)
+	}
+}
+
+// LiveSessions returns the sessions with open connections and their in-flight usage.
+func LiveSessions() []models.LiveProxySessions {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	log.Printf("Key: %s value: %d\n", key, value)
+	sessions := make(map[clientKey]*models.LiveProxySessions)
+	for t := range connections {
+		key := t.key()
+		session, exists := sessions[key]
+		if !exists {
+			session = &models.LiveProxySessions{IP: key.ip, Identity: key.identity, Since: t.started.Unix()}
+			sessions[key] = session
+		}
 
-	if currentBytes, exists := paymentInformation[key]; exists {
-		paymentInformation[key] = currentBytes + value
-	} else {
-		paymentInformation[key] = value
+		session.Connections++
+		session.Targets = append(session.Targets, t.target)
+		session.Bytes += t.read.Load() + t.written.Load()
+		if t.started.Unix() < session.Since {
+			session.Since = t.started.Unix()
+		}
 	}
 
-}
+	liveSessions := []models.LiveProxySessions{}
+	for _, session := range sessions {
+		liveSessions = append(liveSessions, *session)
+	}
 
-func (r *clientAddressRuleset) Connect(ctx context.Context, conn net.Conn, target *socks5.AddrSpec) (*socks5.AddrSpec, error) {
-	//clientAddr := conn.RemoteAddr()
-	//log.Printf("Client address: %s", clientAddr)
-	return target, nil
+	return liveSessions
 }
 
 func (r *clientAddressRuleset) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
-	if req.RemoteAddr != nil {
-		clientIP := req.RemoteAddr.String()
+	// Every request is authenticated with the credentials of a proxy session
+	if req.AuthContext == nil || req.AuthContext.Payload["Username"] == "" {
+		log.Println("Denied unauthenticated proxy request")
+		return ctx, false
+	}
+	identity := req.AuthContext.Payload["Username"]
+
+	clientIP := ""
+	if r.client != "" {
+		// Sessions can only be used by the peer they were issued to
+		session, err := operations.FindProxySessions(r.db, identity)
+		if err != nil || session == nil || session.Peer != r.client {
+			log.Printf("Denied proxy request from peer %s with credentials of another session", r.client)
+			return ctx, false
+		}
+
+		clientIP = r.client
+		log.Printf("Client peer: %s", clientIP)
+	} else if req.RemoteAddr != nil {
+		clientIP = req.RemoteAddr.String()
 		log.Printf("Client IP: %s", clientIP)
-		return context.WithValue(ctx, "clientIP", clientIP), true
+	}
+
+	ctx, allowed := allowRequest(ctx, r.db, identity, clientIP, req.DestAddr)
+	return context.WithValue(ctx, "circuit", r.circuit), allowed
+}
+
+// Apply the quota and destination policy shared by the SOCKS and HTTP proxies to an authenticated request.
+func allowRequest(ctx context.Context, db *sql.DB, identity, clientIP string, dest *socks5.AddrSpec) (context.Context, bool) {
+	peer := sessionPeer(db, identity)
+	ctx = context.WithValue(ctx, "identity", identity)
+	ctx = context.WithValue(ctx, "peer", peer)
+	ctx = context.WithValue(ctx, "clientIP", clientIP)
+
+	if isOverQuota(db, peer) {
+		log.Printf("Denied proxy request from %s of peer %s, which is over quota", identity, peer)
+		return ctx, false
+	}
+
+	// Only relay to destinations allowed by the policy
+	allowed, reason := checkDestination(db, dest)
+	if !allowed {
+		logRejection(db, identity, clientIP, dest, reason)
+		return ctx, false
 	}
 
 	return ctx, true
@@ -124,53 +240,64 @@ func (r *clientAddressRuleset) Allow(ctx context.Context, req *socks5.Request) (
 
 func customDial(ctx context.Context, network, addr string) (net.Conn, error) {
 
-	//remoteSocksProxy := "23.239.12.179:8000"
-
-	conn, err := net.Dial(network, addr)
+	conn, err := dialEgress(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 
 	clientIP, _ := ctx.Value("clientIP").(string)
+	identity, _ := ctx.Value("identity").(string)
+	peer, _ := ctx.Value("peer").(string)
 	// Wrap the connection to intercept traffic
-	return &trafficInterceptor{conn: conn, clientIP: clientIP}, nil
-}
+	t := &trafficInterceptor{conn: conn, clientIP: clientIP, identity: identity, peer: peer, target: addr, started: time.Now()}
 
-func Proxy(node host.Host, db *sql.DB) {
-	dial := customDial
-	conf := &socks5.Config{Dial: dial, Rules: &clientAddressRuleset{}}
-	server, err := socks5.New(conf)
-	if err != nil {
-		panic(err)
-	}
+	mutex.Lock()
+	connections[t] = struct{}{}
+	mutex.Unlock()
 
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		for range ticker.C {
-			mutex.Lock()
+	return t, nil
+}
 
-			for key, value := range paymentInformation {
-				//log.Println("Hello!")
-				log.Printf("%s : %d", key, value)
-				operations.AddProxyLogs(db, key, value, time.Now().Unix())
-			}
+// Default port of SOCKS5 offers
+const SOCKSPort = 8000
 
-			// timeBefore := time.Now().Unix() - (5 * time.Minute).Milliseconds()
-			// log.Println("Sending request for proxy payment...")
-			// err := p2p.SendProxyBillWithConfirmation(node, )
+// Log the usage sampled since the last flush to the ProxyLogs table, and bill it when due.
+func flushUsage(db *sql.DB) {
+	sampleConnections()
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for key, value := range paymentInformation {
+		log.Printf("%+v : %d", key, value)
 
-			for key := range paymentInformation {
-				delete(paymentInformation, key)
-			}
+		// Attribute the usage to the peer the session was issued to, and bill it at the rate of its offer
+		session, err := operations.FindProxySessions(db, key.identity)
+		if err != nil {
+			log.Println(err)
+		} else if session != nil {
+			addUsage(session.Peer, session.Offer, session.Rate, value)
+		}
 
-			mutex.Unlock()
+		err = operations.AddProxyLogs(db, key.ip, key.identity, key.peer, value, time.Now().Unix())
+		if err != nil {
+			log.Println(err)
 		}
-	}()
+	}
+
+	for key := range paymentInformation {
+		delete(paymentInformation, key)
+	}
 
-	fmt.Println("Proxy is running on http://localhost:8000.")
+	billUsage(false)
+}
 
-	// Create SOCKS5 proxy on localhost port 8000
-	if err := server.ListenAndServe("tcp", "0.0.0.0:8000"); err != nil {
-		panic(err)
+// Proxy serves the offers of this node. It only runs while an offer is enabled, see Reload.
+func Proxy(node host.Host, db *sql.DB) {
+	proxyNode = node
+	proxyDB = db
+
+	err := Reload(db)
+	if err != nil {
+		log.Printf("Error starting proxy: %v", err)
 	}
 }
@@ -0,0 +1,167 @@
+/*
+Proxy traffic can also be tunneled over libp2p streams, so nodes behind NAT that are only
+reachable through the relay or hole punching can still serve as proxies. The client runs a
+local SOCKS listener and forwards each connection over a stream to the proxy peer, which
+serves SOCKS5 on the stream and bills the traffic to the session of the client.
+
+Every tunnel stream starts with a line listing the remaining hops of the circuit as a JSON
+array. A proxy with remaining hops dials its targets through the next hop instead of directly.
+*/
+
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/armon/go-socks5"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Protocol of the streams proxy traffic is tunneled over
+const TunnelProtocol = "/proxy/tunnel/1.0.0"
+
+// Address of the local SOCKS listener that forwards to the connected proxy peer
+const TunnelAddress = "127.0.0.1:8001"
+
+var tunnelListener net.Listener
+var tunnelMutex sync.Mutex
+
+// Address of the remote end of a tunnel, identified by its peer ID
+type peerAddr struct {
+	id peer.ID
+}
+
+func (a peerAddr) Network() string {
+	return "libp2p"
+}
+
+func (a peerAddr) String() string {
+	return a.id.String()
+}
+
+// Wraps a libp2p stream so it can be served as a net.Conn
+type streamConn struct {
+	network.Stream
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return peerAddr{c.Conn().LocalPeer()}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return peerAddr{c.Conn().RemotePeer()}
+}
+
+// Serve SOCKS5 on every tunnel stream opened by a client, billing the client by its peer ID.
+func serveTunnel(node host.Host, db *sql.DB) {
+	node.SetStreamHandler(TunnelProtocol, func(s network.Stream) {
+		clientPeer := s.Conn().RemotePeer().String()
+		log.Printf("New tunnel stream opened from peer: %s", clientPeer)
+
+		circuit, err := readCircuit(s)
+		if err != nil {
+			log.Printf("Error reading circuit from peer %s: %v", clientPeer, err)
+			s.Reset()
+			return
+		}
+
+		conf := &socks5.Config{
+			Dial:        customDial,
+			Rules:       &clientAddressRuleset{db: db, client: clientPeer, circuit: circuit},
+			Credentials: &sessionCredentials{db: db, protocol: ProtocolTunnel},
+		}
+		server, err := socks5.New(conf)
+		if err != nil {
+			log.Printf("Error creating SOCKS server for tunnel from peer %s: %v", clientPeer, err)
+			s.Reset()
+			return
+		}
+
+		err = server.ServeConn(&streamConn{s})
+		if err != nil {
+			log.Printf("Error serving tunnel from peer %s: %v", clientPeer, err)
+		}
+	})
+}
+
+// Tunnel listens on address and forwards every connection through a circuit of proxy peers.
+// Clients authenticate with the first hop. Any tunnel that was already running is closed.
+func Tunnel(node host.Host, hops []string, address string) error {
+	circuit, err := parseCircuit(node, hops)
+	if err != nil {
+		return err
+	}
+	if len(circuit) == 0 {
+		return fmt.Errorf("circuit has no hops")
+	}
+	targetPeerID := circuit[0]
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+
+	if tunnelListener != nil {
+		tunnelListener.Close()
+		tunnelListener = nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	tunnelListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Tunnel to peer %s closed: %v", targetPeerID, err)
+				return
+			}
+
+			go forwardToPeer(node, circuit, conn)
+		}
+	}()
+
+	log.Printf("Tunnel through %d hops exiting at peer %s listening on %s", len(circuit), circuit[len(circuit)-1], address)
+	return nil
+}
+
+// CloseTunnel stops the local listener of the running tunnel, if any.
+func CloseTunnel() {
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+
+	if tunnelListener != nil {
+		tunnelListener.Close()
+		tunnelListener = nil
+	}
+}
+
+// Forward a local connection over a new tunnel stream to the first hop of a circuit.
+func forwardToPeer(node host.Host, circuit []peer.ID, conn net.Conn) {
+	defer conn.Close()
+
+	s, err := openTunnel(context.Background(), node, circuit)
+	if err != nil {
+		log.Printf("Failed to open tunnel stream to peer %s: %v", circuit[0], err)
+		return
+	}
+	defer s.Close()
+
+	// Forward the request until the client is done sending
+	go func() {
+		io.Copy(s, conn)
+		s.CloseWrite()
+	}()
+
+	// Forward the response until the proxy closes the stream
+	io.Copy(conn, s)
+}
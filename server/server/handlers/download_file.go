@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"server/database/models"
 	"server/database/operations"
 	"server/p2p"
 	"time"
@@ -55,12 +56,11 @@ func RequestMetadataHandler(w http.ResponseWriter, r *http.Request, node host.Ho
 	json.NewEncoder(w).Encode(metadata)
 }
 
-func DownloadFileHandler(w http.ResponseWriter, r *http.Request, node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Params, db *sql.DB) {
+func RequestQuoteHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
 	decoder := json.NewDecoder(r.Body)
 	var request struct {
-		Peer  string  `json:"peer"`
-		Hash  string  `json:"hash"`
-		Price float64 `json:"price"`
+		Peer string `json:"peer"`
+		Hash string `json:"hash"`
 	}
 	err := decoder.Decode(&request)
 	if err != nil {
@@ -68,38 +68,110 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request, node host.Host,
 		return
 	}
 
-	walletInfo, err := operations.GetWalletInfo(db)
+	quote, err := p2p.RequestQuote(node, request.Peer, request.Hash)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = btcwallet.WalletPassphrase(walletInfo.PrivPassphrase, 300)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+func DownloadFileHandler(w http.ResponseWriter, r *http.Request, node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Params, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var request struct {
+		Peer  string              `json:"peer"`
+		Hash  string              `json:"hash"`
+		Price float64             `json:"price"`
+		Quote *models.SignedQuote `json:"quote"`
+	}
+	err := decoder.Decode(&request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	name, data, ext, address, err := p2p.SimplyDownload(node, request.Peer, request.Hash)
+	// Get a quote if the frontend did not already accept one
+	if request.Quote == nil {
+		quote, err := p2p.RequestQuote(node, request.Peer, request.Hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		request.Quote = &quote
+	}
+
+	err = p2p.VerifyQuote(*request.Quote, request.Peer, node.ID().String(), request.Hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Quote.Price > request.Price {
+		http.Error(w, fmt.Sprintf("quoted price %v is higher than the accepted price %v", request.Quote.Price, request.Price), http.StatusConflict)
+		return
+	}
+
+	walletInfo, err := operations.GetWalletInfo(db)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	btcutilAddress, err := btcutil.DecodeAddress(address, netParams)
+	err = btcwallet.WalletPassphrase(walletInfo.PrivPassphrase, 300)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	_, err = btcwallet.SendFrom("default", btcutilAddress, btcutil.Amount(request.Price*1e8))
+	// Pays the provider the quoted price at most, and only to the quoted address,
+	// then records the payment in the transaction ledger
+	pay := func(address string, amount float64) error {
+		if address != request.Quote.Address {
+			return fmt.Errorf("address %s does not match the quoted address %s", address, request.Quote.Address)
+		}
+		if amount > request.Quote.Price {
+			return fmt.Errorf("amount %v is higher than the quoted price %v", amount, request.Quote.Price)
+		}
+		if amount == 0 {
+			return nil
+		}
+
+		btcutilAddress, err := btcutil.DecodeAddress(address, netParams)
+		if err != nil {
+			return err
+		}
+
+		satoshis, err := btcutil.NewAmount(amount)
+		if err != nil {
+			return err
+		}
+
+		txid, err := btcwallet.SendFrom("default", btcutilAddress, satoshis)
+		if err != nil {
+			return err
+		}
+
+		return operations.AddTransactions(db, txid.String(), address, "send", "download", request.Hash, request.Peer, -amount)
+	}
+
+	name, data, ext, address, err := p2p.SimplyDownload(node, request.Peer, request.Hash, request.Quote.Nonce, pay)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Pays a provider that expects payment after the download
+	if address != "" {
+		err = pay(address, request.Quote.Price)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	date := time.Now().Local().Format("01/02/2006")
-	err = operations.AddDownloads(db, date, request.Hash, name, ext, int64(len(data)), request.Price)
+	err = operations.AddDownloads(db, date, request.Hash, name, ext, int64(len(data)), request.Quote.Price)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"server/database/models"
+	"server/database/operations"
+	"server/gateway"
+)
+
+func GatewayHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	gatewaySettings, err := operations.GetGateway(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gatewaySettings)
+}
+
+func UpdateGatewayHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.Gateway
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if m.Timeout == 0 {
+		m.Timeout = 30 // Requests get half a minute to reach a peer unless configured otherwise
+	}
+
+	err = gateway.ValidateSettings(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = operations.UpdateGateway(db, m.Listen, m.BaseURL, m.CertFile, m.KeyFile, m.SelfSigned)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = operations.UpdateGatewayLimits(db, m.ClientLimit, m.TokenLimit, m.MaxFetches, m.Timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Restart the gateway on its new address and certificate, with its new limits
+	err = gateway.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
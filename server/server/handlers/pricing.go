@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"server/database/models"
+	"server/database/operations"
+)
+
+func PricingRulesHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	rules, err := operations.GetPricingRules(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func UpdatePricingRulesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.PricingRules
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if m.PerMB < 0 || m.DemandThreshold < 0 {
+		http.Error(w, "Prices and thresholds cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	if m.PeakMultiplier <= 0 || m.DemandMultiplier <= 0 {
+		http.Error(w, "Multipliers must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	if m.PeakStart < 0 || m.PeakStart > 23 || m.PeakEnd < 0 || m.PeakEnd > 23 {
+		http.Error(w, "Peak hours must be between 0 and 23", http.StatusBadRequest)
+		return
+	}
+
+	if m.RepeatDiscount < 0 || m.RepeatDiscount > 1 {
+		http.Error(w, "Repeat discount must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+
+	err = operations.UpdatePricingRules(db, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func TrustedPeersHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	trustedPeersRecords, err := operations.GetAllTrustedPeers(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trustedPeersRecords)
+}
+
+func AddTrustedPeerHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = operations.AddTrustedPeers(db, string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteTrustedPeerHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = operations.DeleteTrustedPeers(db, string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -3,13 +3,18 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"server/database/models"
 	"server/database/operations"
 	"server/p2p"
+	"server/proxy"
+	"strconv"
+	"strings"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func UpdateProxyHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
@@ -21,28 +26,209 @@ func UpdateProxyHandler(w http.ResponseWriter, r *http.Request, node host.Host,
 		return
 	}
 
-	walletInfo, err := operations.GetWalletInfo(db)
+	if m.ClientLimit < 0 || m.GlobalLimit < 0 || m.Quota < 0 || m.QuotaPeriod < 0 {
+		http.Error(w, "limits and quota must not be negative", http.StatusBadRequest)
+		return
+	}
+	if m.QuotaPeriod == 0 {
+		m.QuotaPeriod = 86400 // Quotas are daily unless configured otherwise
+	}
+
+	// Route the egress of this proxy through another proxy peer, or directly if empty
+	if m.Upstream == node.ID().String() {
+		http.Error(w, "a proxy cannot be its own upstream", http.StatusBadRequest)
+		return
+	}
+	if m.Upstream != "" {
+		_, err = peer.Decode(m.Upstream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Nothing is saved unless all of the settings are valid
+	err = operations.UpdateProxyLimits(db, m.ClientLimit, m.GlobalLimit, m.Quota, m.QuotaPeriod)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	address := walletInfo.Address
 
-	err = p2p.ProvideKey("PROXY")
+	err = operations.UpdateProxyUpstream(db, m.Upstream)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
 
-	err = operations.UpdateProxy(db, m.IP, m.Rate, node.ID().String(), address)
+func ProxyOffersHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	proxyOffersRecords, err := operations.GetAllProxyOffers(db)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyOffersRecords)
+}
+
+func AddProxyOfferHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.ProxyOffers
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.ValidateOffer(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = operations.AddProxyOffers(db, m.Protocol, m.IP, m.Port, m.Listen, m.Rate, m.Enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = advertiseProxy(node, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func UpdateProxyOfferHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.ProxyOffers
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.ValidateOffer(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = operations.UpdateProxyOffers(db, m.Id, m.Protocol, m.IP, m.Port, m.Listen, m.Rate, m.Enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = advertiseProxy(node, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func WithdrawProxyOfferHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Once no offer is enabled, the PROXY key is no longer provided again, but its record stays in the DHT until
+	// it expires. Peers that still find this node through it are told there is no proxy.
+	err = operations.DeleteProxyOffers(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The proxy stops once its last offer is withdrawn
+	err = proxy.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func StartProxyHandler(w http.ResponseWriter, _ *http.Request, node host.Host, db *sql.DB) {
+	err := operations.EnableProxyOffers(db, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = advertiseProxy(node, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func StopProxyHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	err := operations.EnableProxyOffers(db, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Returns once open connections have drained
+	err = proxy.Reload(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// advertiseProxy provides the PROXY key if any offer is enabled, with the node and wallet offers are paid to.
+func advertiseProxy(node host.Host, db *sql.DB) error {
+	offers, err := proxy.EnabledOffers(db)
+	if err != nil {
+		return err
+	}
+	if len(offers) == 0 {
+		return nil
+	}
+
+	walletInfo, err := operations.GetWalletInfo(db)
+	if err != nil {
+		return err
+	}
+
+	err = operations.UpdateProxy(db, node.ID().String(), walletInfo.Address)
+	if err != nil {
+		return err
+	}
+
+	return p2p.ProvideKey("PROXY")
 }
 
 func RefreshProxiesHandler(w http.ResponseWriter, _ *http.Request, node host.Host, db *sql.DB) {
-	proxies, err := p2p.RandomProxiesInfo(node)
+	proxies, err := p2p.RandomProxiesInfo(node, db)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -59,19 +245,99 @@ func ConnectToProxyHandler(w http.ResponseWriter, r *http.Request, node host.Hos
 		return
 	}
 
-	connectRequest := models.ProxyBill{
-		IP:     "connect",
-		Rate:   0,
-		Bytes:  0,
-		Amount: 0,
-		Wallet: "",
+	connectThroughCircuit(w, node, []string{string(body)}, 0)
+}
+
+func ConnectToCircuitHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var request struct {
+		Hops  int      `json:"hops"`
+		Peers []string `json:"peers"`
+		Offer int64    `json:"offer"` // Offer of the first hop, 0 for its cheapest
 	}
+	err := decoder.Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Select the path from the advertised proxies unless the client chose one
+	hops := request.Peers
+	if len(hops) == 0 {
+		if request.Hops < 1 || request.Hops > proxy.MaxHops {
+			http.Error(w, fmt.Sprintf("hops must be between 1 and %d", proxy.MaxHops), http.StatusBadRequest)
+			return
+		}
+
+		proxies, err := p2p.RandomProxiesInfo(node, db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	err = p2p.SendProxyBillWithConfirmation(node, string(body), connectRequest)
+		// Proxies can have several offers, but each is visited once. Circuits are tunneled, so each
+		// of their hops needs a tunnel offer.
+		seen := make(map[string]bool)
+		for _, p := range proxies {
+			if request.Hops > 1 && p.Protocol != proxy.ProtocolTunnel {
+				continue
+			}
+			if len(hops) < request.Hops && p.Node != "" && p.Node != node.ID().String() && !seen[p.Node] {
+				seen[p.Node] = true
+				hops = append(hops, p.Node)
+			}
+		}
+		if len(hops) < request.Hops {
+			http.Error(w, fmt.Sprintf("only %d proxies are available", len(hops)), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	connectThroughCircuit(w, node, hops, request.Offer)
+}
+
+// connectThroughCircuit opens a session for an offer of the first hop of a circuit and connects to it.
+// A single hop is used directly at the advertised address of its offer, unless it is a tunnel offer.
+// Circuits of several hops are tunneled, so their first hop must have a tunnel offer.
+func connectThroughCircuit(w http.ResponseWriter, node host.Host, hops []string, offer int64) {
+	protocol := ""
+	if len(hops) > 1 {
+		protocol = proxy.ProtocolTunnel
+	}
+
+	// Open a session, whose credentials the first hop bills the traffic to
+	credentials, err := p2p.RequestProxyCredentials(node, hops[0], offer, protocol)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	address := credentials.Address
+	if credentials.Protocol == proxy.ProtocolTunnel {
+		// Tunnel through the proxy peers over libp2p so they do not need to be reachable directly
+		err = proxy.Tunnel(node, hops, proxy.TunnelAddress)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		address = proxy.TunnelAddress
+	} else if len(hops) > 1 || address == "" {
+		http.Error(w, fmt.Sprintf("peer %s did not open a session for an offer that can be connected to", hops[0]), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":  address,
+		"protocol": credentials.Protocol,
+		"username": credentials.Username,
+		"password": credentials.Password,
+		"hops":     hops,
+	})
+}
+
+func DisconnectFromProxyHandler(w http.ResponseWriter, _ *http.Request) {
+	proxy.CloseTunnel()
 }
 
 func ProxyLogsHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
@@ -84,3 +350,72 @@ func ProxyLogsHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(proxyLogsRecords)
 }
+
+func LiveProxySessionsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxy.LiveSessions())
+}
+
+func ProxyPoliciesHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	proxyPoliciesRecords, err := operations.GetAllProxyPolicies(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyPoliciesRecords)
+}
+
+func AddProxyPolicyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.ProxyPolicies
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = proxy.ValidatePolicy(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = operations.AddProxyPolicies(db, m.Action, m.CIDR, m.Ports, m.Domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteProxyPolicyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = operations.DeleteProxyPolicies(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func ProxyRejectionsHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	proxyRejectionsRecords, err := operations.GetProxyRejections(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyRejectionsRecords)
+}
@@ -9,6 +9,9 @@ import (
 	"server/database/models"
 	"server/database/operations"
 	"server/p2p"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
 )
@@ -33,16 +36,26 @@ func AddSharingHandler(w http.ResponseWriter, r *http.Request, node host.Host, d
 		return
 	}
 
-	record, err := operations.FindSharing(db, m.Hash)
+	if m.Expiry < 0 || m.MaxDownloads < 0 {
+		http.Error(w, "expiry and maxDownloads cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if m.Expiry != 0 && m.Expiry <= time.Now().Unix() {
+		http.Error(w, "expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	record, err := operations.FindStoring(db, m.Hash)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else if record != nil {
-		fmt.Fprint(w, "The file is already being shared.")
+	} else if record == nil {
+		http.Error(w, "The file is not stored.", http.StatusBadRequest)
 		return
 	}
 
-	link, err := p2p.GenerateLink(db, node, m.Hash)
+	// Every call adds another link, so a file can be shared with different limits
+	link, err := p2p.GenerateLink(db, node, m.Hash, m.Label, m.Expiry, m.MaxDownloads, m.Encrypted)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -51,6 +64,54 @@ func AddSharingHandler(w http.ResponseWriter, r *http.Request, node host.Host, d
 	fmt.Fprint(w, link)
 }
 
+func SharingLinksHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
+	hash := r.URL.Query().Get("hash")
+	if hash == "" {
+		http.Error(w, "Missing hash", http.StatusBadRequest)
+		return
+	}
+
+	links, err := operations.GetSharingLinks(db, hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only token hashes are stored, so each link is signed again to show it
+	sharingLinks := []models.SharingLink{}
+	for _, link := range links {
+		url, err := p2p.ShareLink(db, node, link)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sharingLinks = append(sharingLinks, models.SharingLink{Sharing: link, Link: url})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sharingLinks)
+}
+
+func RevokeSharingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = p2p.RevokeLink(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func DeleteSharingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -58,13 +119,54 @@ func DeleteSharingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	err = operations.DeleteSharing(db, string(body))
+	err = p2p.DeleteLinks(db, string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ShareAccessesHandler lists the accesses of a shared file, newest first, with their
+// totals per link. Accesses are filtered by the link, peer, result, since, until
+// and limit query parameters.
+func ShareAccessesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	hash := r.PathValue("hash")
+	query := r.URL.Query()
+	filter := models.ShareAccessFilter{
+		Peer:   query.Get("peer"),
+		Result: query.Get("result"),
+		Limit:  500, // The newest accesses unless asked for more
+	}
+
+	numbers := map[string]*int64{"link": &filter.Link, "since": &filter.Since, "until": &filter.Until, "limit": &filter.Limit}
+	for name, value := range numbers {
+		if query.Get(name) == "" {
+			continue
+		}
+		number, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil || number < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s", name), http.StatusBadRequest)
+			return
+		}
+		*value = number
+	}
+
+	accesses, err := operations.GetShareAccesses(db, hash, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	links, err := operations.GetShareLinkUsage(db, hash, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.ShareAccessReport{Accesses: accesses, Links: links})
 }
 
+// SharingLinkHandler returns the newest share link of a file that can still be used.
 func SharingLinkHandler(w http.ResponseWriter, r *http.Request, node host.Host, db *sql.DB) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -72,11 +174,25 @@ func SharingLinkHandler(w http.ResponseWriter, r *http.Request, node host.Host,
 		return
 	}
 
-	record, err := operations.FindSharing(db, string(body))
+	hash := string(body)
+	links, err := operations.GetSharingLinks(db, hash)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprintf(w, "http://localhost:3002/viewfile?address=%s&hash=%s&password=%s", node.ID().String(), record.Hash, record.Password)
+	// Encrypted links cannot be rebuilt with their key, so only plain links are returned
+	for _, link := range links {
+		if !link.Encrypted && p2p.CheckShareLink(&link, hash) == p2p.ShareOK {
+			url, err := p2p.ShareLink(db, node, link)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, url)
+			return
+		}
+	}
+
+	http.Error(w, "No usable share link for this file.", http.StatusNotFound)
 }
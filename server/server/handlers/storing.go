@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"server/database/models"
 	"server/database/operations"
+	"server/p2p"
 )
 
 func StoringHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
@@ -30,7 +32,23 @@ func AddStoringHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	hash, err := operations.HashFile(m.Path)
+	info, err := os.Stat(m.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A folder is stored under the hash of its manifest, with the manifests of its subfolders
+	var hash string
+	var tree models.FolderTree
+	if info.IsDir() {
+		tree, err = operations.HashFolder(m.Path)
+		hash = tree.Hash
+		m.Extension = operations.FolderExtension
+		m.Size = tree.Size
+	} else {
+		hash, err = operations.HashFile(m.Path)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -51,6 +69,14 @@ func AddStoringHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	if info.IsDir() {
+		err = operations.AddManifests(db, tree)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	err = operations.AddUploads(db, m.Date, hash, m.Name, m.Extension, m.Size)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -71,13 +97,19 @@ func DeleteStoringHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	err = operations.DeleteManifests(db, string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	err = operations.DeleteHosting(db, string(body))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = operations.DeleteSharing(db, string(body))
+	err = p2p.DeleteLinks(db, string(body))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
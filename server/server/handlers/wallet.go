@@ -50,3 +50,40 @@ func GenerateHandler(w http.ResponseWriter, _ *http.Request, btcwallet *rpcclien
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(block)
 }
+
+func PaymentSettingsHandler(w http.ResponseWriter, _ *http.Request, db *sql.DB) {
+	paymentSettings, err := operations.GetPaymentSettings(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(paymentSettings)
+}
+
+func UpdatePaymentSettingsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	decoder := json.NewDecoder(r.Body)
+	var m models.PaymentSettings
+	err := decoder.Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if m.Mode != "none" && m.Mode != "pay_first" && m.Mode != "pay_on_delivery" {
+		http.Error(w, "Invalid payment mode", http.StatusBadRequest)
+		return
+	}
+
+	if m.Confirmations < 0 || m.Timeout <= 0 {
+		http.Error(w, "Invalid confirmations or timeout", http.StatusBadRequest)
+		return
+	}
+
+	err = operations.UpdatePaymentSettings(db, m.Mode, m.Confirmations, m.Timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -51,6 +51,22 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.SharingHandler(w, r, db) })
 	})
 
+	http.HandleFunc("/sharing/{hash}/accesses", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ShareAccessesHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/sharinglinks", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.SharingLinksHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/pricingrules", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.PricingRulesHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/trustedpeers", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.TrustedPeersHandler(w, r, db) })
+	})
+
 	http.HandleFunc("/saved", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.SavedHandler(w, r, db) })
 	})
@@ -68,7 +84,7 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 	})
 
 	http.HandleFunc("/transactions", func(w http.ResponseWriter, r *http.Request) {
-		cors(w, r, func() { handlers.TransactionsHandler(w, r, btcwallet, db) })
+		cors(w, r, func() { handlers.TransactionsHandler(w, r, db) })
 	})
 
 	http.HandleFunc("/proxies", func(w http.ResponseWriter, r *http.Request) {
@@ -79,6 +95,14 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.WalletHandler(w, r, btcwallet, db) })
 	})
 
+	http.HandleFunc("/paymentsettings", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.PaymentSettingsHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/gateway", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.GatewayHandler(w, r, db) })
+	})
+
 	http.HandleFunc("/generate", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.GenerateHandler(w, r, btcwallet, db) })
 	})
@@ -91,6 +115,22 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.ProxyLogsHandler(w, r, db) })
 	})
 
+	http.HandleFunc("/liveproxysessions", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.LiveProxySessionsHandler(w, r) })
+	})
+
+	http.HandleFunc("/proxyoffers", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ProxyOffersHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/proxypolicies", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ProxyPoliciesHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/proxyrejections", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ProxyRejectionsHandler(w, r, db) })
+	})
+
 	// POST routes
 	http.HandleFunc("/getproviders", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.GetProvidersHandler(w, r, node, db) })
@@ -100,6 +140,10 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.RequestMetadataHandler(w, r, node, db) })
 	})
 
+	http.HandleFunc("/requestquote", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.RequestQuoteHandler(w, r, node, db) })
+	})
+
 	http.HandleFunc("/downloadfile", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.DownloadFileHandler(w, r, node, btcwallet, netParams, db) })
 	})
@@ -124,6 +168,18 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.DeleteHostingHandler(w, r, db) })
 	})
 
+	http.HandleFunc("/updatepricingrules", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.UpdatePricingRulesHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/addtrustedpeer", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.AddTrustedPeerHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/deletetrustedpeer", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.DeleteTrustedPeerHandler(w, r, db) })
+	})
+
 	http.HandleFunc("/addsharing", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.AddSharingHandler(w, r, node, db) })
 	})
@@ -132,6 +188,10 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.DeleteSharingHandler(w, r, db) })
 	})
 
+	http.HandleFunc("/revokesharing", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.RevokeSharingHandler(w, r, db) })
+	})
+
 	http.HandleFunc("/sharinglink", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.SharingLinkHandler(w, r, node, db) })
 	})
@@ -144,10 +204,58 @@ func Server(node host.Host, btcwallet *rpcclient.Client, netParams *chaincfg.Par
 		cors(w, r, func() { handlers.DeleteSavedHandler(w, r, db) })
 	})
 
+	http.HandleFunc("/updatepaymentsettings", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.UpdatePaymentSettingsHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/updategateway", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.UpdateGatewayHandler(w, r, db) })
+	})
+
 	http.HandleFunc("/updateproxy", func(w http.ResponseWriter, r *http.Request) {
 		cors(w, r, func() { handlers.UpdateProxyHandler(w, r, node, db) })
 	})
 
+	http.HandleFunc("/addproxyoffer", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.AddProxyOfferHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/updateproxyoffer", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.UpdateProxyOfferHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/withdrawproxyoffer", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.WithdrawProxyOfferHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/startproxy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.StartProxyHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/stopproxy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.StopProxyHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/connecttoproxy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ConnectToProxyHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/connecttocircuit", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.ConnectToCircuitHandler(w, r, node, db) })
+	})
+
+	http.HandleFunc("/disconnectfromproxy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.DisconnectFromProxyHandler(w, r) })
+	})
+
+	http.HandleFunc("/addproxypolicy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.AddProxyPolicyHandler(w, r, db) })
+	})
+
+	http.HandleFunc("/deleteproxypolicy", func(w http.ResponseWriter, r *http.Request) {
+		cors(w, r, func() { handlers.DeleteProxyPolicyHandler(w, r, db) })
+	})
+
 	// Run the server
 	fmt.Println("Server is running on port 3001...")
 	if err := http.ListenAndServe(":3001", nil); err != nil {